@@ -0,0 +1,285 @@
+package db_bitcask
+
+import (
+	"context"
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// 备份目录中记录所有文件信息的清单
+const backupManifestName = "BACKUP-MANIFEST"
+
+type backupManifest struct {
+	Files []*backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	CRC     uint32 `json:"crc32"`
+}
+
+// 需要备份的数据文件
+type backupSource struct {
+	name    string
+	path    string
+	size    int64
+	modTime int64
+	active  bool
+}
+
+// Backup 增量备份数据库到指定的目录
+// 持有锁期间只记录数据文件的状态并拷贝较小的元数据文件，数据文件的拷贝不会阻塞写入
+// 旧的数据文件不会再被修改，在同一个文件系统时使用硬链接，和上一次备份相同的文件会被跳过，活跃文件只拷贝到记录的写入位置
+// 冷存储目录中的数据文件和其他文件一起备份到 dir 中
+func (db *DB) Backup(dir string) error {
+	return db.BackupCtx(context.Background(), dir)
+}
+
+// BackupCtx 和 Backup 相同，每个文件之间检查 ctx，取消时返回 ctx.Err()
+// 中途取消时不会写入新的清单，再次备份时没有完成的文件会被重新拷贝
+func (db *DB) BackupCtx(ctx context.Context, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	// 备份期间数据文件不能被移动到冷存储目录
+	db.moveMu.RLock()
+	defer db.moveMu.RUnlock()
+
+	// 上一次备份的清单不存在或者损坏时全量备份
+	previous := make(map[string]*backupFile)
+	if manifest, err := readBackupManifest(dir); err == nil {
+		for _, file := range manifest.Files {
+			previous[file.Name] = file
+		}
+	}
+
+	manifest := &backupManifest{}
+	sources, err := db.collectBackupSources(dir, manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		srcPath := source.path
+		destPath := filepath.Join(dir, source.name)
+		file := &backupFile{Name: source.name, Size: source.size, ModTime: source.modTime}
+
+		// 和上一次备份的文件相同
+		if prev, ok := previous[source.name]; ok && prev.Size == source.size && prev.ModTime == source.modTime {
+			if info, err := os.Stat(destPath); err == nil && info.Size() == source.size {
+				manifest.Files = append(manifest.Files, prev)
+				continue
+			}
+		}
+
+		if source.active {
+			file.CRC, err = utils.CopyFileLimited(ctx, srcPath, destPath, source.size, db.rateLimiter)
+		} else {
+			file.CRC, err = utils.LinkOrCopyFileLimited(ctx, srcPath, destPath, db.rateLimiter)
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return err
+	}
+
+	// 删除已经不在清单中的文件
+	kept := make(map[string]bool)
+	for _, file := range manifest.Files {
+		kept[file.Name] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == backupManifestName || kept[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 持有锁记录所有数据文件的状态，并拷贝数据文件之外的元数据文件
+func (db *DB) collectBackupSources(dir string, manifest *backupManifest) ([]*backupSource, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []*backupSource
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == fileLockName || name == backupManifestName {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		if data.IsDataFileName(name) {
+			source := &backupSource{
+				name:    name,
+				path:    filepath.Join(db.options.DirPath, name),
+				size:    info.Size(),
+				modTime: info.ModTime().UnixNano(),
+			}
+			// 活跃文件之后写入的数据不属于本次备份
+			if db.activeFile != nil && name == filepath.Base(data.GetDataFileName("", db.activeFile.FileId)) {
+				source.size = db.activeFile.WriteOff
+				source.active = true
+			}
+			sources = append(sources, source)
+			continue
+		}
+
+		crc, err := utils.CopyFile(filepath.Join(db.options.DirPath, name), filepath.Join(dir, name), -1)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, &backupFile{
+			Name:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			CRC:     crc,
+		})
+	}
+
+	// 冷存储目录中只有旧的数据文件
+	for _, coldDirPath := range db.coldDirPaths() {
+		entries, err := os.ReadDir(coldDirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !data.IsDataFileName(name) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, &backupSource{
+				name:    name,
+				path:    filepath.Join(coldDirPath, name),
+				size:    info.Size(),
+				modTime: info.ModTime().UnixNano(),
+			})
+		}
+	}
+	return sources, nil
+}
+
+// Restore 校验备份目录中的清单，然后将备份的数据恢复到 dirPath 中，dirPath 需要为空目录
+func Restore(backupDir, dirPath string) error {
+	manifest, err := readBackupManifest(backupDir)
+	if err != nil {
+		return err
+	}
+
+	// 先校验所有的文件
+	for _, file := range manifest.Files {
+		path := filepath.Join(backupDir, file.Name)
+		info, err := os.Stat(path)
+		if err != nil || info.Size() != file.Size {
+			return ErrBackupCorrupted
+		}
+		crc, err := utils.FileCRC32(path)
+		if err != nil {
+			return err
+		}
+		if crc != file.CRC {
+			return ErrBackupCorrupted
+		}
+	}
+
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+
+	for _, file := range manifest.Files {
+		if _, err := utils.CopyFile(filepath.Join(backupDir, file.Name), filepath.Join(dirPath, file.Name), -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBackupManifest(dir string) (*backupManifest, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupManifestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest := &backupManifest{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, ErrBackupCorrupted
+	}
+	for _, file := range manifest.Files {
+		// 清单中的文件名不能指向备份目录之外
+		if file.Name != filepath.Base(file.Name) {
+			return nil, ErrBackupCorrupted
+		}
+	}
+	return manifest, nil
+}
+
+// 先写入临时文件再重命名，中途失败时保留上一次备份的清单
+func writeBackupManifest(dir string, manifest *backupManifest) error {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, backupManifestName+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, backupManifestName))
+}
@@ -0,0 +1,170 @@
+package db_bitcask
+
+import (
+	"context"
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Backup_Incremental(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-backup-incremental")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+
+	backupDir, _ := os.MkdirTemp("", "db-bitcask-backup-incremental-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	// 旧的数据文件使用硬链接，活跃文件只拷贝到写入位置
+	olderName := filepath.Base(data.GetDataFileName("", 0))
+	srcInfo, err := os.Stat(filepath.Join(dir, olderName))
+	assert.Nil(t, err)
+	destInfo, err := os.Stat(filepath.Join(backupDir, olderName))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(srcInfo, destInfo))
+
+	activeName := filepath.Base(data.GetDataFileName("", db.activeFile.FileId))
+	writeOff := db.activeFile.WriteOff
+	err = db.Put(utils.GetTestKey(3000), []byte("after backup"))
+	assert.Nil(t, err)
+	activeInfo, err := os.Stat(filepath.Join(backupDir, activeName))
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, activeInfo.Size())
+
+	// 第二次备份只拷贝变化的文件
+	manifest, err := readBackupManifest(backupDir)
+	assert.Nil(t, err)
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	manifest2, err := readBackupManifest(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(manifest.Files), len(manifest2.Files))
+	for i := range manifest.Files {
+		if manifest.Files[i].Name == activeName {
+			assert.True(t, manifest2.Files[i].Size > manifest.Files[i].Size)
+		}
+	}
+
+	// 恢复之后校验数据
+	restoreDir, _ := os.MkdirTemp("", "db-bitcask-backup-incremental-restore")
+	err = Restore(backupDir, restoreDir)
+	assert.Nil(t, err)
+	opts2 := DefaultOptions
+	opts2.DirPath = restoreDir
+	db2, err := Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(3000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after backup"), val)
+	assert.Equal(t, 2001, len(db2.ListKeys()))
+
+	// 目标目录不为空
+	err = Restore(backupDir, restoreDir)
+	assert.Equal(t, ErrRestoreDirNotEmpty, err)
+}
+
+func TestRestore_Corrupted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-restore-corrupted")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+
+	backupDir, _ := os.MkdirTemp("", "db-bitcask-restore-corrupted-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	restoreDir, _ := os.MkdirTemp("", "db-bitcask-restore-corrupted-restore")
+	defer func() {
+		_ = os.RemoveAll(restoreDir)
+	}()
+
+	// 没有清单
+	err = Restore(backupDir, restoreDir)
+	assert.Equal(t, ErrBackupManifestNotFound, err)
+
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	// 篡改备份的数据文件
+	activeName := filepath.Base(data.GetDataFileName("", db.activeFile.FileId))
+	file, err := os.OpenFile(filepath.Join(backupDir, activeName), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), 10)
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	err = Restore(backupDir, restoreDir)
+	assert.Equal(t, ErrBackupCorrupted, err)
+}
+
+func TestDB_BackupCtx(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-backup-ctx")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 1)
+
+	backupDir, _ := os.MkdirTemp("", "db-bitcask-backup-ctx-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+
+	// 拷贝部分文件之后取消，不会写入清单
+	err = db.BackupCtx(newCancelAfterContext(2), backupDir)
+	assert.Equal(t, context.Canceled, err)
+	_, err = readBackupManifest(backupDir)
+	assert.Equal(t, ErrBackupManifestNotFound, err)
+
+	err = db.BackupCtx(context.Background(), backupDir)
+	assert.Nil(t, err)
+
+	restoreDir, _ := os.MkdirTemp("", "db-bitcask-backup-ctx-restore")
+	defer func() {
+		_ = os.RemoveAll(restoreDir)
+	}()
+	err = Restore(backupDir, restoreDir)
+	assert.Nil(t, err)
+	opts.DirPath = restoreDir
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const nonTransactionSeqNo uint64 = 0
@@ -17,19 +18,23 @@ type WriteBatch struct {
 	mu            *sync.Mutex
 	db            *DB
 	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+	internal      bool                       // 内部使用的批量写，可以写入二级索引派生的 key
+	reindex       string                     // 重建索引时需要重新写入索引数据的索引名称
+	reindexKeys   [][]byte                   // 重建索引时需要重新写入索引数据的 key
 }
 
 // NewWriteBatch 初始化 WriteBatch
-func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seq no file not exists")
+// B+ 树索引没有保存事务序列号的文件时无法使用，返回 ErrWriteBatchUnavailable
+func (db *DB) NewWriteBatch(opts WriteBatchOptions) (*WriteBatch, error) {
+	if !db.writeBatchAvailable() {
+		return nil, ErrWriteBatchUnavailable
 	}
 	return &WriteBatch{
 		options:       opts,
 		mu:            new(sync.Mutex),
 		db:            db,
 		pendingWrites: make(map[string]*data.LogRecord),
-	}
+	}, nil
 }
 
 // Put 批量写数据
@@ -37,11 +42,14 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if !wb.internal && isSecondaryIndexKey(key) {
+		return ErrKeyReserved
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
 	// 暂存 LogRecord
-	logRecord := &data.LogRecord{Key: key, Value: value}
+	logRecord := &data.LogRecord{Key: key, Value: value, Timestamp: time.Now().UnixNano()}
 	wb.pendingWrites[string(key)] = logRecord
 	return nil
 }
@@ -51,11 +59,17 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if !wb.internal && isSecondaryIndexKey(key) {
+		return ErrKeyReserved
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
 	// 数据不存在则直接返回
-	logRecordPos := wb.db.index.Get(key)
+	logRecordPos, err := wb.db.index.Get(key)
+	if err != nil {
+		return err
+	}
 	if logRecordPos == nil {
 		// 并且还如果在write bitch中的话要删除
 		if wb.pendingWrites[string(key)] != nil {
@@ -71,35 +85,69 @@ func (wb *WriteBatch) Delete(key []byte) error {
 }
 
 // Commit 提交事务，将暂存的数据写到数据文件，并更新内存索引
-func (wb *WriteBatch) Commit() error {
+func (wb *WriteBatch) Commit() (err error) {
+	defer wb.db.metrics.batchCommit.observe(time.Now(), &err)
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
-	if len(wb.pendingWrites) == 0 {
+	if len(wb.pendingWrites) == 0 && len(wb.reindexKeys) == 0 {
 		return nil
 	}
+	if wb.db.readOnly() {
+		return ErrReadOnly
+	}
 	if uint(len(wb.pendingWrites)) > wb.options.MaxBatchNum {
 		return ErrExceedMaxBatchNum
 	}
+	if err := wb.db.waitDiskSpace(wb.onlyDeletes()); err != nil {
+		return err
+	}
 
 	// 加锁保证事务提交串行化
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
+	// 在同一个事务中更新二级索引
+	records := wb.pendingWrites
+	if len(wb.db.secondaryIndexes) > 0 {
+		var err error
+		if records, err = wb.db.indexRecords(wb.pendingWrites); err != nil {
+			return err
+		}
+		if wb.reindex != "" {
+			if err := wb.db.reindexRecords(records, wb.reindex, wb.reindexKeys); err != nil {
+				return err
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
 	// 获取当前最新的事务序列号
 	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
 
 	// 开始写数据到数据文件当中
 	positions := make(map[string]*data.LogRecordPos)
-	for _, record := range wb.pendingWrites {
+	for _, record := range records {
 		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
+			Key:       logRecordKeyWithSeq(record.Key, seqNo),
+			Value:     record.Value,
+			Type:      record.Type,
+			Timestamp: record.Timestamp,
+			Flags:     record.Flags,
 		})
 		if err != nil {
 			return err
 		}
+		// 流式写入的头部记录的大小包含所有的分块
+		if record.Type == data.LogRecordStream {
+			_, chunks, err := decodeStreamChunks(record.Value)
+			if err != nil {
+				return err
+			}
+			logRecordPos.Size = streamSpan(logRecordPos.Size, chunks)
+		}
 		positions[string(record.Key)] = logRecordPos
 	}
 
@@ -108,38 +156,88 @@ func (wb *WriteBatch) Commit() error {
 		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := wb.db.appendLogRecord(finishedRecord)
+	if err != nil {
+		return err
+	}
+	if err := wb.db.flushActiveFile(); err != nil {
 		return err
 	}
 
 	// 根据配置决定是否持久化
 	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+		if err := wb.db.syncActiveFile(); err != nil {
 			return err
 		}
 	}
 
 	// 更新内存索引
-	for _, record := range wb.pendingWrites {
+	for _, record := range records {
 		pos := positions[string(record.Key)]
 		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+		var err error
+		if record.Type == data.LogRecordNormal || record.Type == data.LogRecordStream {
+			oldPos, err = wb.db.index.Put(record.Key, pos)
 		}
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _, err = wb.db.index.Delete(record.Key)
 		}
+		if err != nil {
+			return err
+		}
+		wb.db.countIndexKey(record.Key, record.Type, oldPos != nil)
 		if oldPos != nil {
 			wb.db.reclaimSize += int64(oldPos.Size)
 		}
 	}
 
+	// 发布变更事件
+	wb.db.changes.publish(changeSeq(finishedPos.Fid, finishedPos.Offset+int64(finishedPos.Size)), func() *ChangeEvent {
+		ops := make([]*ChangeEvent, 0, len(wb.pendingWrites))
+		for _, record := range wb.pendingWrites {
+			if isSecondaryIndexKey(record.Key) {
+				continue
+			}
+			op := &ChangeEvent{Type: ChangePut, Key: copyBytes(record.Key), Value: copyBytes(record.Value)}
+			switch record.Type {
+			case data.LogRecordDeleted:
+				op.Type = ChangeDelete
+			case data.LogRecordStream:
+				op.Value, op.streamHead = nil, op.Value
+			}
+			ops = append(ops, op)
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		return &ChangeEvent{Type: ChangeBatch, Batch: ops}
+	})
+
 	// 清空暂存数据
 	wb.pendingWrites = make(map[string]*data.LogRecord)
+	wb.reindexKeys = nil
 
 	return nil
 }
 
+// B+ 树索引需要从保存事务序列号的文件中恢复序列号，没有正常关闭时无法使用事务
+func (db *DB) writeBatchAvailable() bool {
+	return db.options.IndexType != BPlusTree || db.seqNoFileExists || db.isInitial
+}
+
+// 暂存的数据是否都是删除操作，调用方需要持有 wb.mu
+func (wb *WriteBatch) onlyDeletes() bool {
+	if len(wb.reindexKeys) > 0 {
+		return false
+	}
+	for _, record := range wb.pendingWrites {
+		if record.Type != data.LogRecordDeleted {
+			return false
+		}
+	}
+	return true
+}
+
 // key+Seq Number 编码
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	seq := make([]byte, binary.MaxVarintLen64)
@@ -0,0 +1,132 @@
+package db_bitcask
+
+import (
+	"container/list"
+	"db-bitcask/data"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// value 缓存的分片数量，减少并发读取时的锁竞争
+	valueCacheShardNum = 16
+
+	// 每个缓存项除了 value 之外额外占用的空间估算
+	valueCacheEntryOverhead = 64
+)
+
+// valueCache 以数据的位置为 key 的分片 LRU 缓存
+// 覆盖写和删除之后 key 对应的位置会发生变化，旧位置的缓存项不会再被访问，最终被淘汰
+// merge 生成的数据文件使用新的文件 id，所以相同的位置不会对应不同的数据，替换之后旧文件的缓存项直接清空
+type valueCache struct {
+	shards [valueCacheShardNum]*valueCacheShard
+	hits   uint64
+	misses uint64
+}
+
+type valueCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[data.LogRecordPos]*list.Element
+	lru      *list.List
+}
+
+type valueCacheEntry struct {
+	pos   data.LogRecordPos
+	value []byte
+}
+
+// 容量小于等于 0 时不启用缓存，返回 nil
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	cache := &valueCache{}
+	shardCapacity := capacity / valueCacheShardNum
+	if shardCapacity == 0 {
+		shardCapacity = 1
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &valueCacheShard{
+			capacity: shardCapacity,
+			items:    make(map[data.LogRecordPos]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return cache
+}
+
+func (c *valueCache) shard(pos *data.LogRecordPos) *valueCacheShard {
+	h := fnv.New32a()
+	var buf [12]byte
+	buf[0], buf[1], buf[2], buf[3] = byte(pos.Fid), byte(pos.Fid>>8), byte(pos.Fid>>16), byte(pos.Fid>>24)
+	for i := 0; i < 8; i++ {
+		buf[4+i] = byte(pos.Offset >> (8 * i))
+	}
+	_, _ = h.Write(buf[:])
+	return c.shards[h.Sum32()%valueCacheShardNum]
+}
+
+// 返回的 value 是缓存数据的拷贝，调用方可以修改
+func (c *valueCache) get(pos *data.LogRecordPos) ([]byte, bool) {
+	s := c.shard(pos)
+	s.mu.Lock()
+	elem, ok := s.items[*pos]
+	if !ok {
+		s.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	value := copyBytes(elem.Value.(*valueCacheEntry).value)
+	s.mu.Unlock()
+	atomic.AddUint64(&c.hits, 1)
+	return value, true
+}
+
+func (c *valueCache) add(pos *data.LogRecordPos, value []byte) {
+	s := c.shard(pos)
+	size := int64(len(value)) + valueCacheEntryOverhead
+	// 超过单个分片容量的 value 不缓存，避免清空整个分片
+	if size > s.capacity {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[*pos]; ok {
+		return
+	}
+	entry := &valueCacheEntry{pos: *pos, value: copyBytes(value)}
+	if entry.value == nil {
+		entry.value = []byte{}
+	}
+	s.items[*pos] = s.lru.PushFront(entry)
+	s.size += size
+	for s.size > s.capacity {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+// 清空所有的缓存项，命中统计保留
+func (c *valueCache) purge() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[data.LogRecordPos]*list.Element)
+		s.lru.Init()
+		s.size = 0
+		s.mu.Unlock()
+	}
+}
+
+func (c *valueCache) stat() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func (s *valueCacheShard) removeElement(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*valueCacheEntry)
+	delete(s.items, entry.pos)
+	s.size -= int64(len(entry.value)) + valueCacheEntryOverhead
+}
@@ -0,0 +1,123 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCache(t *testing.T) {
+	assert.Nil(t, newValueCache(0))
+
+	cache := newValueCache(valueCacheShardNum * (valueCacheEntryOverhead + 10) * 2)
+	pos := &data.LogRecordPos{Fid: 1, Offset: 100, Size: 20}
+	_, ok := cache.get(pos)
+	assert.False(t, ok)
+
+	cache.add(pos, []byte("value"))
+	value, ok := cache.get(pos)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+	// 修改返回值不影响缓存的数据
+	value[0] = 'x'
+	value, _ = cache.get(pos)
+	assert.Equal(t, []byte("value"), value)
+
+	// 超过分片容量的 value 不会被缓存
+	big := &data.LogRecordPos{Fid: 1, Offset: 200, Size: 1000}
+	cache.add(big, make([]byte, 1000))
+	_, ok = cache.get(big)
+	assert.False(t, ok)
+
+	// 同一个分片中的数据按照 LRU 淘汰
+	s := cache.shard(pos)
+	var sameShard []*data.LogRecordPos
+	for offset := int64(300); len(sameShard) < 2; offset++ {
+		p := &data.LogRecordPos{Fid: 1, Offset: offset, Size: 20}
+		if cache.shard(p) == s {
+			sameShard = append(sameShard, p)
+		}
+	}
+	cache.add(sameShard[0], []byte("0123456789"))
+	_, _ = cache.get(pos)
+	cache.add(sameShard[1], []byte("0123456789"))
+	_, ok = cache.get(pos)
+	assert.True(t, ok)
+	_, ok = cache.get(sameShard[0])
+	assert.False(t, ok)
+	assert.True(t, s.size <= s.capacity)
+
+	hits, misses := cache.stat()
+	assert.Equal(t, uint64(4), hits)
+	assert.Equal(t, uint64(3), misses)
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-value-cache")
+	opts.DirPath = dir
+	opts.ValueCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	// 覆盖写之后位置发生变化，读到的是新的值
+	err = db.Put(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// merge 之后重新打开，缓存中不会有旧文件的数据
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	expected, err := db.Get(utils.GetTestKey(800))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	val, err = db2.Get(utils.GetTestKey(800))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, val)
+	stat2, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), stat2.CacheHits)
+
+	opts.ValueCacheSize = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,497 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// 内存中最多缓存的变更事件数量，更早的事件需要从数据文件中回放
+const changeLogCapacity = 4096
+
+// 订阅者通道的缓冲大小，写满之后由订阅者自己的 goroutine 阻塞等待，不会影响写入
+const subscriptionBufferSize = 64
+
+var errSubscriptionClosed = errors.New("subscription is closed")
+
+type ChangeType = byte
+
+const (
+	// ChangePut 写入数据
+	ChangePut ChangeType = iota + 1
+
+	// ChangeDelete 删除数据
+	ChangeDelete
+
+	// ChangeBatch 批量写入，具体的操作在 Batch 中
+	ChangeBatch
+)
+
+// ChangeEvent 已经提交的变更事件
+// Seq 由事件最后一条记录的结束位置组成（文件 id 左移 32 位加上偏移），单调递增
+type ChangeEvent struct {
+	Seq   uint64
+	Type  ChangeType
+	Key   []byte
+	Value []byte
+	Batch []*ChangeEvent // 批量写入中的每个操作
+
+	// 流式写入的头部记录，缓存中只保存分块的位置，投递给订阅者时才读取完整的 value
+	streamHead []byte
+}
+
+// ChangeFilter 根据 key 过滤变更事件，返回 true 表示需要该事件
+type ChangeFilter func(key []byte) bool
+
+// Subscription 变更事件订阅
+type Subscription struct {
+	db      *DB
+	cursor  uint64
+	filter  ChangeFilter
+	events  chan *ChangeEvent
+	done    chan struct{}
+	once    sync.Once
+	errLock sync.Mutex
+	err     error
+}
+
+// 内存中的变更事件缓存
+type changeLog struct {
+	mu       sync.Mutex
+	events   []*ChangeEvent
+	start    uint64 // 序列号大于 start 的事件都在内存中
+	notify   chan struct{}
+	subs     map[*Subscription]struct{}
+	watchers map[*watcher]struct{}
+	closed   bool
+	lastSeq  uint64
+}
+
+func newChangeLog(start uint64) *changeLog {
+	return &changeLog{
+		start:    start,
+		lastSeq:  start,
+		notify:   make(chan struct{}),
+		subs:     make(map[*Subscription]struct{}),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// 发布已经提交的事件，只有存在订阅者或者监听者时才会构造事件
+func (cl *changeLog) publish(seq uint64, build func() *ChangeEvent) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.lastSeq = seq
+	if len(cl.subs) == 0 && len(cl.watchers) == 0 {
+		cl.start = seq
+		return
+	}
+
+	// 只包含二级索引数据的事务没有可见的变更
+	event := build()
+	if event == nil {
+		return
+	}
+	event.Seq = seq
+
+	// 通知监听者，不会阻塞写入
+	for w := range cl.watchers {
+		w.notify(event)
+	}
+
+	if len(cl.subs) == 0 {
+		cl.start = seq
+		return
+	}
+	cl.events = append(cl.events, event)
+	if len(cl.events) > changeLogCapacity {
+		cl.start = cl.events[0].Seq
+		cl.events[0] = nil
+		cl.events = cl.events[1:]
+	}
+
+	// 唤醒所有等待的订阅者
+	close(cl.notify)
+	cl.notify = make(chan struct{})
+}
+
+// 获取序列号大于 cursor 的所有事件，如果这部分事件已经不在内存中则返回 false
+func (cl *changeLog) since(cursor uint64) ([]*ChangeEvent, <-chan struct{}, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cursor < cl.start {
+		return nil, nil, false
+	}
+	idx := sort.Search(len(cl.events), func(i int) bool {
+		return cl.events[i].Seq > cursor
+	})
+	events := make([]*ChangeEvent, len(cl.events)-idx)
+	copy(events, cl.events[idx:])
+	return events, cl.notify, true
+}
+
+func (cl *changeLog) startSeq() uint64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.start
+}
+
+func (cl *changeLog) subscribe(sub *Subscription) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return false
+	}
+	cl.subs[sub] = struct{}{}
+	return true
+}
+
+func (cl *changeLog) unsubscribe(sub *Subscription) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	delete(cl.subs, sub)
+	// 没有订阅者之后不再缓存事件
+	if len(cl.subs) == 0 {
+		cl.events = nil
+		cl.start = cl.lastSeq
+	}
+}
+
+// 关闭所有的订阅和监听
+func (cl *changeLog) close() {
+	cl.mu.Lock()
+	cl.closed = true
+	subs := make([]*Subscription, 0, len(cl.subs))
+	for sub := range cl.subs {
+		subs = append(subs, sub)
+	}
+	for w := range cl.watchers {
+		delete(cl.watchers, w)
+		close(w.events)
+	}
+	cl.mu.Unlock()
+
+	for _, sub := range subs {
+		_ = sub.Close()
+	}
+}
+
+// Subscribe 订阅序列号大于 fromSeq 的变更事件，事件只会在提交之后投递
+// 如果 fromSeq 对应的事件已经不在内存中，则会先从数据文件中回放，fromSeq 为 0 表示从头开始
+// fromSeq 所在的数据文件已经被 merge 重写时订阅终止，Err 返回 ErrChangesCompacted，需要重新同步之后从 0 或者新的位置订阅
+// 流式写入的 value 在投递时才从数据文件中读取，所在的数据文件已经被 merge 重写时同样返回 ErrChangesCompacted
+func (db *DB) Subscribe(fromSeq uint64, filter ChangeFilter) (*Subscription, error) {
+	sub := &Subscription{
+		db:     db,
+		cursor: fromSeq,
+		filter: filter,
+		events: make(chan *ChangeEvent, subscriptionBufferSize),
+		done:   make(chan struct{}),
+	}
+	if !db.changes.subscribe(sub) {
+		return nil, ErrDatabaseClosed
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// Events 变更事件通道，订阅关闭或者出错之后会被关闭
+func (sub *Subscription) Events() <-chan *ChangeEvent {
+	return sub.events
+}
+
+// Err 订阅因为错误终止时返回对应的错误
+func (sub *Subscription) Err() error {
+	sub.errLock.Lock()
+	defer sub.errLock.Unlock()
+	return sub.err
+}
+
+// Close 关闭订阅
+func (sub *Subscription) Close() error {
+	sub.once.Do(func() {
+		close(sub.done)
+		sub.db.changes.unsubscribe(sub)
+	})
+	return nil
+}
+
+func (sub *Subscription) run() {
+	defer close(sub.events)
+	for {
+		events, notify, ok := sub.db.changes.since(sub.cursor)
+		if !ok {
+			// 内存中的事件不足，先从数据文件中回放
+			target := sub.db.changes.startSeq()
+			if err := sub.db.replayChanges(sub.cursor, target, sub.deliver); err != nil {
+				if err != errSubscriptionClosed {
+					sub.errLock.Lock()
+					sub.err = err
+					sub.errLock.Unlock()
+				}
+				return
+			}
+			// (cursor, target] 之间的事件都已经投递过了
+			if sub.cursor < target {
+				sub.cursor = target
+			}
+			continue
+		}
+
+		for _, event := range events {
+			if err := sub.deliver(event); err != nil {
+				if err != errSubscriptionClosed {
+					sub.errLock.Lock()
+					sub.err = err
+					sub.errLock.Unlock()
+				}
+				return
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// 投递事件，通道已满时阻塞等待，实现背压
+func (sub *Subscription) deliver(event *ChangeEvent) error {
+	if event.Seq <= sub.cursor {
+		return nil
+	}
+	sub.cursor = event.Seq
+	if event = filterChangeEvent(event, sub.filter); event == nil {
+		return nil
+	}
+	// 在订阅者自己的 goroutine 中读取流式写入的 value，不持有任何锁
+	event, err := sub.db.loadStreamValues(event)
+	if err != nil {
+		return err
+	}
+	select {
+	case sub.events <- event:
+		return nil
+	case <-sub.done:
+		return errSubscriptionClosed
+	}
+}
+
+func filterChangeEvent(event *ChangeEvent, filter ChangeFilter) *ChangeEvent {
+	if filter == nil {
+		return event
+	}
+	if event.Type != ChangeBatch {
+		if filter(event.Key) {
+			return event
+		}
+		return nil
+	}
+
+	var ops []*ChangeEvent
+	for _, op := range event.Batch {
+		if filter(op.Key) {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return &ChangeEvent{Seq: event.Seq, Type: ChangeBatch, Batch: ops}
+}
+
+// 读取事件中流式写入的 value，缓存中的事件会被多个订阅者共享，需要返回新的事件
+func (db *DB) loadStreamValues(event *ChangeEvent) (*ChangeEvent, error) {
+	if event.Type != ChangeBatch {
+		if event.streamHead == nil {
+			return event, nil
+		}
+		value, err := db.readStreamHead(event.streamHead)
+		if err != nil {
+			return nil, err
+		}
+		return &ChangeEvent{Seq: event.Seq, Type: event.Type, Key: event.Key, Value: value}, nil
+	}
+
+	var ops []*ChangeEvent
+	for i, op := range event.Batch {
+		if op.streamHead == nil {
+			continue
+		}
+		if ops == nil {
+			ops = make([]*ChangeEvent, len(event.Batch))
+			copy(ops, event.Batch)
+		}
+		loaded, err := db.loadStreamValues(op)
+		if err != nil {
+			return nil, err
+		}
+		ops[i] = loaded
+	}
+	if ops == nil {
+		return event, nil
+	}
+	return &ChangeEvent{Seq: event.Seq, Type: ChangeBatch, Batch: ops}, nil
+}
+
+// 按分块读取头部记录对应的完整 value，每个分块只短暂地持有锁
+// 分块所在的数据文件已经被 merge 重写时返回 ErrChangesCompacted
+func (db *DB) readStreamHead(headValue []byte) ([]byte, error) {
+	size, chunks, err := decodeStreamChunks(headValue)
+	if err != nil {
+		return nil, err
+	}
+	reader := &streamReader{db: db, size: size, chunks: chunks, gen: db.acquireFiles()}
+	defer reader.Close()
+	value := make([]byte, size)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		if err == ErrDataFileNotFound {
+			return nil, ErrChangesCompacted
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// 从数据文件中回放序列号在 (from, to] 之间的事件
+func (db *DB) replayChanges(from, to uint64, fn func(*ChangeEvent) error) error {
+	db.mu.RLock()
+	if db.activeFile == nil {
+		db.mu.RUnlock()
+		return nil
+	}
+	fileIds := make([]int, 0, len(db.olderFiles)+1)
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+	fileIds = append(fileIds, int(db.activeFile.FileId))
+	db.mu.RUnlock()
+	sort.Ints(fileIds)
+
+	startFid, startOffset := uint32(from>>32), int64(from&0xffffffff)
+	// 已经被 merge 重写过的数据文件中的位置不再有效，重新回放会重复投递已经投递过的数据，需要订阅者重新同步
+	if _, err := os.Stat(filepath.Join(db.options.DirPath, data.MergeFinishedFileName)); err == nil && from > 0 {
+		compactedFileId, err := db.getMergeFileId(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		// 旧版本 merge 的输出和之前的数据文件 id 重复，非 merge 文件之前的位置都无效
+		if compactedFileId == 0 {
+			if compactedFileId, err = db.getNonMergeFileId(db.options.DirPath); err != nil {
+				return err
+			}
+		}
+		if startFid < compactedFileId {
+			return ErrChangesCompacted
+		}
+	}
+
+	transactionRecords := make(map[uint64][]*ChangeEvent)
+	for _, fid := range fileIds {
+		fileId := uint32(fid)
+		if fileId < startFid {
+			continue
+		}
+		var offset int64 = 0
+		if fileId == startFid {
+			offset = startOffset
+		}
+
+		for {
+			db.mu.RLock()
+			var logRecord *data.LogRecord
+			var size int64
+			var err error
+			if dataFile := db.getDataFile(fileId); dataFile != nil {
+				logRecord, size, err = dataFile.ReadLogRecord(offset)
+			} else {
+				err = ErrDataFileNotFound
+			}
+			db.mu.RUnlock()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+
+			seq := changeSeq(fileId, offset+size)
+			if seq > to {
+				return nil
+			}
+			offset += size
+
+			var event *ChangeEvent
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			if isSecondaryIndexKey(realKey) && logRecord.Type != data.LogRecordTxnFinished {
+				continue
+			}
+			switch logRecord.Type {
+			case data.LogRecordNormal:
+				event = &ChangeEvent{Type: ChangePut, Key: realKey, Value: logRecord.Value}
+			case data.LogRecordStream:
+				event = &ChangeEvent{Type: ChangePut, Key: realKey, streamHead: logRecord.Value}
+			case data.LogRecordDeleted:
+				event = &ChangeEvent{Type: ChangeDelete, Key: realKey}
+			case data.LogRecordTxnFinished:
+				ops := transactionRecords[seqNo]
+				delete(transactionRecords, seqNo)
+				for _, op := range ops {
+					op.Seq = seq
+				}
+				if len(ops) == 0 {
+					continue
+				}
+				if err := fn(&ChangeEvent{Seq: seq, Type: ChangeBatch, Batch: ops}); err != nil {
+					return err
+				}
+				continue
+			default:
+				continue
+			}
+
+			event.Seq = seq
+			if seqNo != nonTransactionSeqNo {
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], event)
+				continue
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 根据文件 id 和记录的结束位置生成变更事件的序列号
+func changeSeq(fid uint32, offset int64) uint64 {
+	return uint64(fid)<<32 | uint64(offset)
+}
+
+// 当前已经写入的数据的结束位置
+func (db *DB) endSeq() uint64 {
+	if db.activeFile == nil {
+		return 0
+	}
+	return changeSeq(db.activeFile.FileId, db.activeFile.WriteOff)
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,249 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveChange(t *testing.T, sub *Subscription) *ChangeEvent {
+	select {
+	case event, ok := <-sub.Events():
+		assert.True(t, ok)
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for change event")
+	}
+	return nil
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-subscribe")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	sub, err := db.Subscribe(db.endSeq(), nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub.Close()
+	}()
+
+	// 普通写入和删除
+	err = db.Put(utils.GetTestKey(1), []byte("value-1"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	event1 := receiveChange(t, sub)
+	assert.Equal(t, ChangePut, event1.Type)
+	assert.Equal(t, utils.GetTestKey(1), event1.Key)
+	assert.Equal(t, []byte("value-1"), event1.Value)
+
+	event2 := receiveChange(t, sub)
+	assert.Equal(t, ChangeDelete, event2.Type)
+	assert.True(t, event2.Seq > event1.Seq)
+
+	// 批量写入
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Put(utils.GetTestKey(2), []byte("value-2"))
+	_ = wb.Put(utils.GetTestKey(3), []byte("value-3"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	event3 := receiveChange(t, sub)
+	assert.Equal(t, ChangeBatch, event3.Type)
+	assert.Equal(t, 2, len(event3.Batch))
+}
+
+func TestDB_Subscribe_Backfill(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-subscribe-backfill")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 订阅之前写入的数据需要从数据文件中回放，跨越多个数据文件
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Put(utils.GetTestKey(1000), []byte("batch"))
+	_ = wb.Delete(utils.GetTestKey(0))
+	assert.Nil(t, wb.Commit())
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+
+	// 只订阅部分 key
+	filter := func(key []byte) bool {
+		return !bytes.Equal(key, utils.GetTestKey(0))
+	}
+	sub, err := db2.Subscribe(0, filter)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub.Close()
+	}()
+
+	var lastSeq uint64
+	for i := 0; i < 1000; i++ {
+		event := receiveChange(t, sub)
+		if i == 0 {
+			assert.Equal(t, utils.GetTestKey(1), event.Key)
+		}
+		assert.True(t, event.Seq > lastSeq)
+		lastSeq = event.Seq
+		if event.Type == ChangeBatch {
+			assert.Equal(t, 1, len(event.Batch))
+			assert.Equal(t, utils.GetTestKey(1000), event.Batch[0].Key)
+		}
+	}
+
+	// 回放完成之后继续接收新的事件
+	err = db2.Put(utils.GetTestKey(2000), []byte("new"))
+	assert.Nil(t, err)
+	event := receiveChange(t, sub)
+	assert.Equal(t, utils.GetTestKey(2000), event.Key)
+	assert.True(t, event.Seq > lastSeq)
+
+	// 从中间的序列号恢复订阅
+	sub2, err := db2.Subscribe(lastSeq, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub2.Close()
+	}()
+	event2 := receiveChange(t, sub2)
+	assert.Equal(t, event.Seq, event2.Seq)
+}
+
+func TestDB_Subscribe_Compacted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-subscribe-compacted")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	sub, err := db.Subscribe(db.endSeq(), nil)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("value"))
+		assert.Nil(t, err)
+	}
+	var cursor uint64
+	for i := 0; i < 10; i++ {
+		cursor = receiveChange(t, sub).Seq
+	}
+	assert.Nil(t, sub.Close())
+
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new-value"))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(10), []byte("value"))
+	assert.Nil(t, err)
+
+	// merge 之前的位置已经失效，不会重复投递 merge 之后的数据
+	sub2, err := db.Subscribe(cursor, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub2.Close()
+	}()
+	select {
+	case _, ok := <-sub2.Events():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for subscription to stop")
+	}
+	assert.Equal(t, ErrChangesCompacted, sub2.Err())
+
+	// 从头订阅时回放 merge 之后的所有数据
+	sub3, err := db.Subscribe(0, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub3.Close()
+	}()
+	keys := make(map[string]bool)
+	for i := 0; i < 11; i++ {
+		event := receiveChange(t, sub3)
+		assert.Equal(t, ChangePut, event.Type)
+		keys[string(event.Key)] = true
+	}
+	assert.Equal(t, 11, len(keys))
+}
+
+func TestDB_Subscribe_Stream(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-subscribe-stream")
+	opts.DirPath = dir
+	opts.StreamChunkSize = 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	sub, err := db.Subscribe(db.endSeq(), nil)
+	assert.Nil(t, err)
+
+	value1 := utils.RandomValue(10 * 1024)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value1), int64(len(value1)))
+	assert.Nil(t, err)
+	event := receiveChange(t, sub)
+	assert.Equal(t, ChangePut, event.Type)
+	assert.Equal(t, value1, event.Value)
+
+	// 缓存中的事件只保存分块的位置，不保存完整的 value
+	db.changes.mu.Lock()
+	cached := db.changes.events[len(db.changes.events)-1]
+	db.changes.mu.Unlock()
+	assert.Nil(t, cached.Value)
+	assert.NotNil(t, cached.streamHead)
+
+	// 注册了二级索引时流式写入通过事务提交
+	err = db.RegisterIndex("city", cityExtractor)
+	assert.Nil(t, err)
+	value2 := append([]byte("beijing:"), utils.RandomValue(10*1024)...)
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader(value2), int64(len(value2)))
+	assert.Nil(t, err)
+	event = receiveChange(t, sub)
+	assert.Equal(t, ChangeBatch, event.Type)
+	assert.Equal(t, 1, len(event.Batch))
+	assert.Equal(t, utils.GetTestKey(2), event.Batch[0].Key)
+	assert.Equal(t, value2, event.Batch[0].Value)
+	assert.Nil(t, sub.Close())
+
+	// 从数据文件中回放时同样读取完整的 value
+	sub2, err := db.Subscribe(0, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub2.Close()
+	}()
+	event = receiveChange(t, sub2)
+	assert.Equal(t, utils.GetTestKey(1), event.Key)
+	assert.Equal(t, value1, event.Value)
+	event = receiveChange(t, sub2)
+	assert.Equal(t, ChangeBatch, event.Type)
+	assert.Equal(t, value2, event.Batch[0].Value)
+}
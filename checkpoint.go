@@ -0,0 +1,117 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// 创建硬链接，测试时可以替换
+var linkFile = os.Link
+
+// Checkpoint 在 dir 中创建数据库当前状态的一个可以独立打开的副本，dir 需要不存在或者为空目录
+// 旧的数据文件和 hint 文件不会再被修改，直接使用硬链接，活跃文件只拷贝 sync 之后的部分
+// 冷存储目录中的数据文件也会链接到 dir 中，硬链接要求 dir 和数据目录、冷存储目录在同一个文件系统，
+// 否则返回 ErrCheckpointCrossDevice，不会退回到拷贝，需要跨文件系统的副本时使用 Backup
+func (db *DB) Checkpoint(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrCheckpointDirNotEmpty
+	}
+
+	// 创建期间数据文件不能被移动到冷存储目录
+	db.moveMu.RLock()
+	defer db.moveMu.RUnlock()
+	activeName, activeSize, err := db.linkCheckpointFiles(dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+
+	// 记录的位置之前的数据不会再被修改，拷贝时不需要持有锁
+	if activeName != "" {
+		srcPath := filepath.Join(db.options.DirPath, activeName)
+		if _, err := utils.CopyFile(srcPath, filepath.Join(dir, activeName), activeSize); err != nil {
+			_ = os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// 持有锁持久化活跃文件，并链接或者拷贝活跃文件之外的所有文件，返回活跃文件的名称和需要拷贝的大小
+func (db *DB) linkCheckpointFiles(dir string) (string, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var activeName string
+	var activeSize int64
+	if db.activeFile != nil {
+		if err := db.syncActiveFile(); err != nil {
+			return "", 0, err
+		}
+		activeName = filepath.Base(data.GetDataFileName("", db.activeFile.FileId))
+		activeSize = db.activeFile.WriteOff
+	}
+
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == fileLockName || name == backupManifestName || name == activeName {
+			continue
+		}
+		srcPath := filepath.Join(db.options.DirPath, name)
+		destPath := filepath.Join(dir, name)
+
+		// 索引等会被修改的文件需要拷贝
+		var err error
+		if data.IsDataFileName(name) || name == data.HintFileName || name == data.MergeFinishedFileName {
+			err = linkCheckpointFile(srcPath, destPath)
+		} else {
+			_, err = utils.CopyFile(srcPath, destPath, -1)
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	for _, coldDirPath := range db.coldDirPaths() {
+		entries, err := os.ReadDir(coldDirPath)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !data.IsDataFileName(name) {
+				continue
+			}
+			if err := linkCheckpointFile(filepath.Join(coldDirPath, name), filepath.Join(dir, name)); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	return activeName, activeSize, nil
+}
+
+// 使用硬链接把数据文件加入 checkpoint，跨文件系统时不拷贝，直接返回错误
+func linkCheckpointFile(src, dest string) error {
+	if err := linkFile(src, dest); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return ErrCheckpointCrossDevice
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+
+	checkpointDir := filepath.Join(os.TempDir(), filepath.Base(dir)+"-checkpoint")
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+
+	// 旧的数据文件是硬链接
+	name := filepath.Base(data.GetDataFileName("", 0))
+	srcInfo, err := os.Stat(filepath.Join(dir, name))
+	assert.Nil(t, err)
+	destInfo, err := os.Stat(filepath.Join(checkpointDir, name))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(srcInfo, destInfo))
+
+	// 目录不为空
+	err = db.Checkpoint(checkpointDir)
+	assert.Equal(t, ErrCheckpointDirNotEmpty, err)
+
+	// checkpoint 之后的写入互不影响
+	err = db.Put(utils.GetTestKey(5000), []byte("source"))
+	assert.Nil(t, err)
+
+	opts2 := opts
+	opts2.DirPath = checkpointDir
+	db2, err := Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(5000))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db2.Put(utils.GetTestKey(6000), []byte("checkpoint"))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(6000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val2, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, val2)
+}
+
+func TestDB_Checkpoint_CrossDevice(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-checkpoint-cross")
+	coldDir, _ := os.MkdirTemp("", "db-bitcask-checkpoint-cold")
+	defer os.RemoveAll(coldDir)
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 32 * 1024
+	opts.HotFileNum = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.MoveColdFiles()
+	assert.Nil(t, err)
+
+	// 模拟冷存储目录在另一个文件系统上
+	origin := linkFile
+	linkFile = func(oldname, newname string) error {
+		if filepath.Dir(oldname) == filepath.Clean(coldDir) {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+		}
+		return origin(oldname, newname)
+	}
+	defer func() {
+		linkFile = origin
+	}()
+
+	checkpointDir := filepath.Join(os.TempDir(), filepath.Base(dir)+"-checkpoint")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Equal(t, ErrCheckpointCrossDevice, err)
+	// 失败时不会留下不完整的 checkpoint
+	_, err = os.Stat(checkpointDir)
+	assert.True(t, os.IsNotExist(err))
+
+	// 在同一个文件系统时冷存储目录中的文件也是硬链接
+	linkFile = origin
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+	for fid := range db.olderFiles {
+		coldPath := data.GetDataFileName(coldDir, fid)
+		if !fileExists(coldPath) {
+			continue
+		}
+		srcInfo, err := os.Stat(coldPath)
+		assert.Nil(t, err)
+		destInfo, err := os.Stat(data.GetDataFileName(checkpointDir, fid))
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(srcInfo, destInfo))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	bitcask "db-bitcask"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const usage = `usage:
+  bitcask-dump export -dir <db dir> [-format jsonl|csv|binary] [-prefix p] [-start s] [-end e] [-out file]
+  bitcask-dump import -dir <db dir> [-format jsonl|csv|binary] [-in file]
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := flags.String("dir", "", "database directory")
+	format := flags.String("format", "jsonl", "export format: jsonl, csv or binary")
+	prefix := flags.String("prefix", "", "only export keys with this prefix")
+	start := flags.String("start", "", "first key to export (inclusive)")
+	end := flags.String("end", "", "last key to export (exclusive)")
+	out := flags.String("out", "", "output file, defaults to stdout")
+	_ = flags.Parse(args)
+
+	exportFormat, err := bitcask.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(*dir, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	count, err := db.Export(w, exportFormat, bitcask.ExportOptions{
+		Prefix: []byte(*prefix),
+		Start:  []byte(*start),
+		End:    []byte(*end),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d keys", count)
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := flags.String("dir", "", "database directory")
+	format := flags.String("format", "jsonl", "import format: jsonl, csv or binary")
+	in := flags.String("in", "", "input file, defaults to stdin")
+	_ = flags.Parse(args)
+
+	importFormat, err := bitcask.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(*dir, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	count, err := db.Import(r, importFormat)
+	if err != nil {
+		return err
+	}
+	log.Printf("imported %d keys", count)
+	return nil
+}
+
+func openDB(dir string, readOnly bool) (*bitcask.DB, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("the -dir flag is required")
+	}
+	options := bitcask.DefaultOptions
+	options.DirPath = dir
+	options.ReadOnly = readOnly
+	return bitcask.Open(options)
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -15,6 +17,7 @@ var (
 
 const (
 	DataFileNameSuffix    = ".data"
+	SegmentFileNameSuffix = ".seg"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
@@ -27,9 +30,9 @@ type DataFile struct {
 	IoManager fio.IOManager // io 读写管理
 }
 
-// OpenDataFile 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
-	fileName := GetDataFileName(dirPath, fileId)
+// OpenDataFile 打开新的数据文件，文件可能位于 dirPath 或者冷存储目录 coldDirPaths 中
+func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType, coldDirPaths ...string) (*DataFile, error) {
+	fileName := ResolveDataFileName(dirPath, fileId, coldDirPaths...)
 	return newDataFile(fileName, fileId, ioType)
 }
 
@@ -55,6 +58,37 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
+// GetSegmentFileName 旧的数据文件压缩之后的段文件名称
+func GetSegmentFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+SegmentFileNameSuffix)
+}
+
+// IsDataFileName 判断文件名是否为数据文件或者压缩之后的段文件
+func IsDataFileName(name string) bool {
+	return strings.HasSuffix(name, DataFileNameSuffix) || strings.HasSuffix(name, SegmentFileNameSuffix)
+}
+
+// ResolveDataFileName 依次在 dirPath 和冷存储目录中查找数据文件或者段文件，都不存在时返回 dirPath 中的数据文件路径
+func ResolveDataFileName(dirPath string, fileId uint32, coldDirPaths ...string) string {
+	for _, dir := range append([]string{dirPath}, coldDirPaths...) {
+		for _, fileName := range []string{GetDataFileName(dir, fileId), GetSegmentFileName(dir, fileId)} {
+			if _, err := os.Stat(fileName); err == nil {
+				return fileName
+			}
+		}
+	}
+	return GetDataFileName(dirPath, fileId)
+}
+
+// NewDataFile 使用已经初始化的 IOManager 创建数据文件
+func NewDataFile(fileId uint32, ioManager fio.IOManager) *DataFile {
+	return &DataFile{
+		FileId:    fileId,
+		WriteOff:  0,
+		IoManager: ioManager,
+	}
+}
+
 func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	// 初始化 IOManager 管理器接口
 	ioManager, err := fio.NewIOManager(fileName, ioType)
@@ -99,7 +133,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
 
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{
+		Type:      header.recordType,
+		Timestamp: header.timestamp,
+		Flags:     header.flags,
+	}
 	// 开始读取用户实际存储的 key/value 数据
 	if keySize > 0 || valueSize > 0 {
 		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
@@ -138,6 +176,14 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	return df.Write(encRecord)
 }
 
+// Flush 提交 IO 管理器中缓存的写入，不会缓存写入的 IO 类型直接返回
+func (df *DataFile) Flush() error {
+	if flusher, ok := df.IoManager.(fio.Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
 func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
@@ -146,6 +192,15 @@ func (df *DataFile) Close() error {
 	return df.IoManager.Close()
 }
 
+// Truncate 将文件截断到指定的大小，同时释放预先分配的空间
+func (df *DataFile) Truncate(size int64) error {
+	if err := df.IoManager.Truncate(size); err != nil {
+		return err
+	}
+	df.WriteOff = size
+	return nil
+}
+
 func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
 	if err := df.IoManager.Close(); err != nil {
 		return err
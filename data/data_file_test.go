@@ -110,3 +110,28 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_ReadLogRecord_Meta(t *testing.T) {
+	dataFile, err := OpenDataFile(os.TempDir(), 7777, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(GetDataFileName(os.TempDir(), 7777))
+	}()
+
+	rec := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("bitcask kv go"),
+		Timestamp: 1700000000000000000,
+		Flags:     9,
+	}
+	res, size := EncodeLogRecord(rec)
+	err = dataFile.Write(res)
+	assert.Nil(t, err)
+
+	readRec, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec, readRec)
+	assert.Equal(t, size, readSize)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 )
 
 type LogRecordType = byte
@@ -11,17 +12,24 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	LogRecordStream
+	LogRecordStreamChunk
 )
 
-// crc type keySize valueSize
-// 4 +  1  +  5   +   5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// 类型字段的最高位标识 header 中是否携带了元数据
+const logRecordMetaMask LogRecordType = 0x80
+
+// crc type keySize valueSize timestamp flags
+// 4 +  1  +  5   +   5   +   10    +  5 = 30
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + binary.MaxVarintLen64 + 5
 
 // LogRecord 写入到数据文件的记录
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key       []byte
+	Value     []byte
+	Type      LogRecordType
+	Timestamp int64  // 写入时间，Unix 纳秒，为 0 表示没有记录
+	Flags     uint32 // 用户自定义的标识
 }
 
 // LogRecord 的头部信息
@@ -30,6 +38,8 @@ type logRecordHeader struct {
 	recordType LogRecordType // 类型
 	keySize    uint32
 	valueSize  uint32
+	timestamp  int64
+	flags      uint32
 }
 
 // LogRecordPos 数据内存索引，主要是描述数据在磁盘上的位置
@@ -52,11 +62,20 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 
 	// 第五个字节存储 Type
 	header[4] = logRecord.Type
+	hasMeta := logRecord.Timestamp != 0 || logRecord.Flags != 0
+	if hasMeta {
+		header[4] |= logRecordMetaMask
+	}
 	var index = 5
 	// 5 字节之后，存储的是 key 和 value 的长度信息
 	// 使用变长类型
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	// 可选的元数据，写入时间和用户标识
+	if hasMeta {
+		index += binary.PutVarint(header[index:], logRecord.Timestamp)
+		index += binary.PutUvarint(header[index:], uint64(logRecord.Flags))
+	}
 
 	var size = index + len(logRecord.Key) + len(logRecord.Value)
 	encBytes := make([]byte, size)
@@ -74,6 +93,33 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	return encBytes, int64(size)
 }
 
+// DecodeLogRecord 从字节数组中解码出一条完整的 LogRecord，并校验 crc
+func DecodeLogRecord(buf []byte) (*LogRecord, int64, error) {
+	header, headerSize := decodeLogRecordHeader(buf)
+	if header == nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	var recordSize = headerSize + keySize + valueSize
+	if int64(len(buf)) < recordSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	logRecord := &LogRecord{
+		Key:       buf[headerSize : headerSize+keySize],
+		Value:     buf[headerSize+keySize : recordSize],
+		Type:      header.recordType,
+		Timestamp: header.timestamp,
+		Flags:     header.flags,
+	}
+	crc := getLogRecordCRC(logRecord, buf[crc32.Size:headerSize])
+	if crc != header.crc {
+		return nil, 0, ErrInvalidCRC
+	}
+	return logRecord, recordSize, nil
+}
+
 // EncodeLogRecordPos 对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
 	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
@@ -103,7 +149,7 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		recordType: buf[4] &^ logRecordMetaMask,
 	}
 
 	var index = 5
@@ -117,6 +163,17 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	// 取出元数据
+	if buf[4]&logRecordMetaMask != 0 {
+		timestamp, n := binary.Varint(buf[index:])
+		header.timestamp = timestamp
+		index += n
+
+		flags, n := binary.Uvarint(buf[index:])
+		header.flags = uint32(flags)
+		index += n
+	}
+
 	return header, int64(index)
 }
 
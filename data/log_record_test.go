@@ -2,6 +2,7 @@ package data
 
 import (
 	"hash/crc32"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -94,3 +95,46 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+func TestEncodeLogRecord_Meta(t *testing.T) {
+	rec := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("db-bitcask"),
+		Type:      LogRecordNormal,
+		Timestamp: 1700000000000000000,
+		Flags:     3,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.Equal(t, int64(len(res)), n)
+
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, rec.Timestamp, header.timestamp)
+	assert.Equal(t, rec.Flags, header.flags)
+	assert.Equal(t, n, headerSize+int64(len(rec.Key)+len(rec.Value)))
+}
+
+func TestDecodeLogRecord(t *testing.T) {
+	rec := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("db-bitcask"),
+		Type:      LogRecordNormal,
+		Timestamp: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+
+	decRec, size, err := DecodeLogRecord(res)
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	assert.Equal(t, rec, decRec)
+
+	// 数据不完整
+	_, _, err = DecodeLogRecord(res[:n-1])
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 数据被篡改
+	res[n-1] ^= 0xff
+	_, _, err = DecodeLogRecord(res)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
@@ -1,6 +1,7 @@
 package db_bitcask
 
 import (
+	"context"
 	"db-bitcask/data"
 	"db-bitcask/fio"
 	"db-bitcask/index"
@@ -8,12 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/flock"
 )
@@ -25,31 +28,63 @@ const (
 
 // DB bitcask 存储引擎实例
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     // 文件 id，加载索引的时候使用
-	activeFile      *data.DataFile            // 当前活跃数据文件，可以用于写入
-	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读
-	index           index.Indexer             // 内存索引
-	seqNo           uint64                    // 事务序列号，全局递增
-	isMerging       bool                      // 是否正在 merge
-	seqNoFileExists bool                      // 存储事务序列号的文件是否存在
-	isInitial       bool                      // 是否是第一次初始化此数据目录
-	fileLock        *flock.Flock              // 文件锁保证多进程之间的互斥
-	bytesWrite      uint                      // 累计写了多少个字节
-	reclaimSize     int64                     // 表示有多少数据是无效的
+	options          Options
+	mu               *sync.RWMutex
+	streamMu         *sync.RWMutex                        // 流式写入和 merge 之间的互斥
+	fileIds          []int                                // 文件 id，加载索引的时候使用
+	activeFile       *data.DataFile                       // 当前活跃数据文件，可以用于写入
+	olderFiles       map[uint32]*data.DataFile            // 旧的数据文件，只能用于读
+	index            index.Indexer                        // 内存索引
+	seqNo            uint64                               // 事务序列号，全局递增
+	isMerging        bool                                 // 是否正在 merge
+	seqNoFileExists  bool                                 // 存储事务序列号的文件是否存在
+	isInitial        bool                                 // 是否是第一次初始化此数据目录
+	fileLock         *flock.Flock                         // 文件锁保证多进程之间的互斥
+	bytesWrite       uint                                 // 累计写了多少个字节
+	reclaimSize      int64                                // 表示有多少数据是无效的
+	changes          *changeLog                           // 已提交的变更事件，用于订阅
+	replicaTxns      map[uint64][]*data.TransactionRecord // 从节点暂存的未完成事务数据
+	secondaryIndexes map[string]IndexExtractor            // 注册的二级索引
+	valueCache       *valueCache                          // value 缓存，未启用时为 nil
+	fileHandles      *fio.HandleCache                     // 旧数据文件的句柄缓存，没有限制打开文件数量时为 nil
+	moveMu           *sync.RWMutex                        // 移动冷数据文件和备份之间的互斥
+	bgStop           chan struct{}                        // 关闭时通知后台任务退出
+	bgWg             *sync.WaitGroup                      // 等待后台任务退出
+	metrics          *dbMetrics                           // 操作次数、耗时等指标
+	logger           Logger                               // 日志输出，没有配置时不输出
+	rateLimiter      *utils.RateLimiter                   // merge、备份以及加载索引时的读写限速
+	disk             *diskWatchdog                        // 磁盘空间状态，没有配置磁盘空间限制时为 nil
+	refs             *fileRefs                            // 迭代器以及流式读取使用的数据文件版本
+	retiredFiles     []*retiredFiles                      // merge 替换下来、仍然被读取使用的旧数据文件
+	compactedFileId  uint32                               // 小于此 id 的数据文件已经被 merge 重写过，没有 merge 过时为 0
+	indexKeyNum      int64                                // 二级索引派生的 key 的数量
 }
 
 // Stat 存储引擎统计信息
 type Stat struct {
-	KeyNum          uint  // key 的总数量
-	DataFileNum     uint  // 数据文件的数量
-	ReclaimableSize int64 // 可以进行 merge 回收的数据量，字节为单位
-	DiskSize        int64 // 数据目录所占磁盘空间大小
+	KeyNum          uint          // key 的总数量，不包括二级索引派生的 key
+	IndexKeyNum     uint          // 二级索引派生的 key 的数量
+	DataFileNum     uint          // 数据文件的数量
+	ReclaimableSize int64         // 可以进行 merge 回收的数据量，字节为单位
+	DiskSize        int64         // 数据目录以及冷存储目录所占磁盘空间大小
+	CacheHits       uint64        // value 缓存命中的次数
+	CacheMisses     uint64        // value 缓存未命中的次数
+	OpenFileNum     uint          // 当前打开的旧数据文件数量
+	FileOpenCount   uint64        // 限制打开文件数量时，累计打开旧数据文件的次数
+	ThrottledTime   time.Duration // merge、备份以及加载索引时因为限速累计等待的时长
+	DiskAvailable   uint64        // 最近一次检查时数据目录所在磁盘的可用空间，没有配置磁盘空间限制时为 0
+	DiskState       DiskState     // 最近一次检查时的磁盘空间状态
+}
+
+// Meta 数据的元信息
+type Meta struct {
+	Timestamp time.Time // 最近一次写入的时间，旧版本写入的数据为零值
+	Flags     uint32    // 用户自定义的标识
 }
 
 // Open 打开 bitcask 存储引擎实例
-func Open(options Options) (*DB, error) {
+func Open(options Options) (_ *DB, err error) {
+	start := time.Now()
 	// 校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
@@ -73,6 +108,12 @@ func Open(options Options) (*DB, error) {
 	if !hold {
 		return nil, ErrDatabaseIsUsing
 	}
+	// 之后的步骤失败时释放文件锁
+	defer func() {
+		if err != nil {
+			_ = fileLock.Unlock()
+		}
+	}()
 
 	entries, err := os.ReadDir(options.DirPath)
 	if err != nil {
@@ -82,20 +123,54 @@ func Open(options Options) (*DB, error) {
 		isInitial = true
 	}
 
+	indexer, err := index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites)
+	if err != nil {
+		return nil, err
+	}
+
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		options:     options,
+		mu:          new(sync.RWMutex),
+		streamMu:    new(sync.RWMutex),
+		moveMu:      new(sync.RWMutex),
+		bgStop:      make(chan struct{}),
+		bgWg:        new(sync.WaitGroup),
+		olderFiles:  make(map[uint32]*data.DataFile),
+		index:       indexer,
+		isInitial:   isInitial,
+		fileLock:    fileLock,
+		logger:      options.Logger,
+		rateLimiter: utils.NewRateLimiter(options.RateLimit),
+		refs:        newFileRefs(),
+	}
+	if db.logger == nil {
+		db.logger = nopLogger{}
+	}
+	defer func() {
+		if err != nil {
+			db.abortOpen()
+		}
+	}()
+	db.metrics = newDBMetrics(db.operationDone)
+	if options.MaxOpenFiles > 0 {
+		db.fileHandles = fio.NewHandleCache(options.MaxOpenFiles)
+	}
+	if options.ColdDirPath != "" {
+		if err := os.MkdirAll(options.ColdDirPath, os.ModePerm); err != nil {
+			return nil, err
+		}
 	}
 
 	// 加载 merge 数据目录
 	if err := db.loadMergeFiles(); err != nil {
 		return nil, err
 	}
+	compactedFileId, err := db.getCompactedFileId(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	db.compactedFileId = compactedFileId
 
 	// 加载数据文件
 	if err := db.loadDataFiles(); err != nil {
@@ -114,8 +189,26 @@ func Open(options Options) (*DB, error) {
 			return nil, err
 		}
 
-		// 重置 IO 类型为标准文件 IO
-		if db.options.MMapAtStartup {
+		// 丢弃活跃文件末尾没有写入数据的部分，例如 MMap 预先扩大的文件在关闭前崩溃
+		if db.activeFile != nil && !options.ReadOnly {
+			size, err := db.activeFile.IoManager.Size()
+			if err != nil {
+				return nil, err
+			}
+			if err := db.activeFile.Truncate(db.activeFile.WriteOff); err != nil {
+				return nil, err
+			}
+			if size > db.activeFile.WriteOff {
+				db.recoveryTruncated(RecoveryTruncationInfo{
+					FileId: db.activeFile.FileId,
+					Size:   size,
+					Offset: db.activeFile.WriteOff,
+				})
+			}
+		}
+
+		// 重置 IO 类型为配置的 IO 类型
+		if db.options.MMapAtStartup && db.options.IOType != MMapIO {
 			if err := db.resetIoType(); err != nil {
 				return nil, err
 			}
@@ -127,6 +220,8 @@ func Open(options Options) (*DB, error) {
 		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
+		// B+ 树索引不回放数据文件，只在打开时统计一次派生的 key 的数量
+		db.indexKeyNum = db.scanIndexKeyNum()
 		if db.activeFile != nil {
 			size, err := db.activeFile.IoManager.Size()
 			if err != nil {
@@ -136,16 +231,66 @@ func Open(options Options) (*DB, error) {
 		}
 	}
 
+	db.changes = newChangeLog(db.endSeq())
+
+	// merge 的数据文件已经在上面加载完成，之后才启用 value 缓存
+	db.valueCache = newValueCache(options.ValueCacheSize)
+
+	if options.ColdDirPath != "" && !db.readOnly() {
+		db.bgWg.Add(1)
+		go db.moveColdFilesInBackground()
+	}
+	if options.CompressSealedFiles && !db.readOnly() {
+		db.bgWg.Add(1)
+		go db.compressSealedFilesInBackground()
+	}
+
+	if (options.DiskSoftLimit > 0 || options.DiskHardLimit > 0) && !db.readOnly() {
+		db.disk = newDiskWatchdog()
+		if err := db.checkDiskSpace(); err != nil {
+			return nil, err
+		}
+		db.bgWg.Add(1)
+		go db.watchDiskSpaceInBackground()
+	}
+
+	db.registerStateMetrics()
+	db.metrics.open.observe(start, new(error))
+
 	return db, nil
 }
 
+// 打开失败时停止已经启动的后台任务并关闭已经打开的文件，文件锁由 Open 释放
+func (db *DB) abortOpen() {
+	close(db.bgStop)
+	db.bgWg.Wait()
+	_ = db.index.Close()
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+}
+
 // Close 关闭数据库
-func (db *DB) Close() error {
+func (db *DB) Close() (err error) {
 	defer func() {
-		if err := db.fileLock.Unlock(); err != nil {
-			panic(fmt.Sprintf("failed to unlock the directory, %v", err))
+		if unlockErr := db.fileLock.Unlock(); unlockErr != nil && err == nil {
+			err = fmt.Errorf("%w: %v", ErrDirectoryUnlock, unlockErr)
 		}
 	}()
+	// 关闭所有的变更订阅
+	db.changes.close()
+
+	// 等待后台任务退出
+	select {
+	case <-db.bgStop:
+	default:
+		close(db.bgStop)
+	}
+	db.bgWg.Wait()
+
 	if db.activeFile == nil {
 		return nil
 	}
@@ -184,21 +329,23 @@ func (db *DB) Close() error {
 			return err
 		}
 	}
-	return nil
+	// 关闭之后迭代器以及流式读取不能再使用，merge 替换下来的旧数据文件可以直接删除
+	return db.removeRetiredFiles(true)
 }
 
 // Sync 持久化数据文件
-func (db *DB) Sync() error {
+func (db *DB) Sync() (err error) {
+	defer db.metrics.sync.observe(time.Now(), &err)
 	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	return db.syncActiveFile()
 }
 
 // Stat 返回数据库的相关统计信息
-func (db *DB) Stat() *Stat {
+func (db *DB) Stat() (*Stat, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -207,63 +354,152 @@ func (db *DB) Stat() *Stat {
 		dataFiles += 1
 	}
 
-	dirSize, err := utils.DirSize(db.options.DirPath)
+	dirSize, err := db.totalDirSize()
 	if err != nil {
-		panic(fmt.Sprintf("failed to get dir size : %v", err))
+		return nil, err
+	}
+	keyNum, err := db.index.Size()
+	if err != nil {
+		return nil, err
 	}
-	return &Stat{
-		KeyNum:          uint(db.index.Size()),
+	indexKeyNum := uint(db.indexKeyNum)
+	stat := &Stat{
+		KeyNum:          uint(keyNum) - indexKeyNum,
+		IndexKeyNum:     indexKeyNum,
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize,
 	}
+	if db.valueCache != nil {
+		stat.CacheHits, stat.CacheMisses = db.valueCache.stat()
+	}
+	if db.fileHandles != nil {
+		openFiles, opens := db.fileHandles.Stat()
+		stat.OpenFileNum, stat.FileOpenCount = uint(openFiles), opens
+	} else {
+		stat.OpenFileNum = uint(len(db.olderFiles))
+	}
+	stat.ThrottledTime = db.rateLimiter.Throttled()
+	stat.DiskState, stat.DiskAvailable = db.DiskState()
+	return stat, nil
 }
 
-// Backup 备份数据库，将数据文件拷贝到新的目录中
-func (db *DB) Backup(dir string) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+// SetRateLimit 修改 merge、备份以及加载索引时的读写速率上限，字节每秒，为 0 表示不限速
+func (db *DB) SetRateLimit(bytesPerSec int64) error {
+	if bytesPerSec < 0 {
+		return ErrInvalidRateLimit
+	}
+	db.rateLimiter.SetRate(bytesPerSec)
+	return nil
 }
 
 // Put 写入 Key/Value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutWithFlags(key, value, 0)
+}
+
+// PutWithFlags 写入 Key/Value 数据，并附带用户自定义的标识
+func (db *DB) PutWithFlags(key []byte, value []byte, flags uint32) (err error) {
+	defer db.metrics.put.observe(time.Now(), &err)
 	// 判断 key 是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if isSecondaryIndexKey(key) {
+		return ErrKeyReserved
+	}
+	if err := db.waitDiskSpace(false); err != nil {
+		return err
+	}
 
 	// 构造 LogRecord 结构体
 	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:       logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:     value,
+		Type:      data.LogRecordNormal,
+		Timestamp: time.Now().UnixNano(),
+		Flags:     flags,
+	}
+
+	// 注册了二级索引时通过事务同时更新索引
+	if db.hasSecondaryIndexes() {
+		wb, err := db.newInternalWriteBatch()
+		if err != nil {
+			return err
+		}
+		wb.pendingWrites[string(key)] = &data.LogRecord{
+			Key:       key,
+			Value:     value,
+			Timestamp: logRecord.Timestamp,
+			Flags:     flags,
+		}
+		return wb.Commit()
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	// 追加写入到当前活跃数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
+	if err := db.flushActiveFile(); err != nil {
+		return err
+	}
 
 	// 更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
+	oldPos, err := db.index.Put(key, pos)
+	if err != nil {
+		return err
+	}
+	if oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
 	}
 
+	// 发布变更事件
+	db.changes.publish(changeSeq(pos.Fid, pos.Offset+int64(pos.Size)), func() *ChangeEvent {
+		return &ChangeEvent{Type: ChangePut, Key: copyBytes(key), Value: copyBytes(value)}
+	})
+
 	return nil
 }
 
 // Delete 根据 key 删除对应的数据
-func (db *DB) Delete(key []byte) error {
+func (db *DB) Delete(key []byte) (err error) {
+	defer db.metrics.delete.observe(time.Now(), &err)
 	// 判断 key 的有效性
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if isSecondaryIndexKey(key) {
+		return ErrKeyReserved
+	}
+	if err := db.waitDiskSpace(true); err != nil {
+		return err
+	}
+
+	// 注册了二级索引时通过事务同时删除索引
+	if db.hasSecondaryIndexes() {
+		wb, err := db.newInternalWriteBatch()
+		if err != nil {
+			return err
+		}
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+		return wb.Commit()
+	}
 
 	// 先检查 key 是否存在，如果不存在的话直接返回
-	if pos := db.index.Get(key); pos == nil {
-		return nil
+	if pos, err := db.index.Get(key); err != nil || pos == nil {
+		return err
 	}
 
 	// 构造 LogRecord，标识其是被删除的
@@ -271,26 +507,49 @@ func (db *DB) Delete(key []byte) error {
 		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Type: data.LogRecordDeleted,
 	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	// 写入到数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
-		return nil
+		return err
+	}
+	if err := db.flushActiveFile(); err != nil {
+		return err
 	}
 	db.reclaimSize += int64(pos.Size)
 
 	//	从内存索引中将对应的 key 删除
-	oldPos, ok := db.index.Delete(key)
+	oldPos, ok, err := db.index.Delete(key)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
 	if oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
 	}
+
+	// 发布变更事件
+	db.changes.publish(changeSeq(pos.Fid, pos.Offset+int64(pos.Size)), func() *ChangeEvent {
+		return &ChangeEvent{Type: ChangeDelete, Key: copyBytes(key)}
+	})
 	return nil
 }
 
 // Get 根据 key 读取数据
-func (db *DB) Get(key []byte) ([]byte, error) {
+func (db *DB) Get(key []byte) (value []byte, err error) {
+	return db.GetCtx(context.Background(), key)
+}
+
+// GetCtx 根据 key 读取数据，ctx 已经取消时返回 ctx.Err()
+func (db *DB) GetCtx(ctx context.Context, key []byte) (value []byte, err error) {
+	defer db.metrics.get.observe(time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -299,36 +558,144 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	}
 
 	// 从内存数据结构中取出 key 对应的索引信息
-	logRecordPos := db.index.Get(key)
-
+	logRecordPos, err := db.index.Get(key)
+	if err != nil {
+		return nil, err
+	}
 	if logRecordPos == nil {
 		return nil, ErrKeyNotFound
 	}
 
-	return db.getValueByPosition(logRecordPos)
+	return db.getCachedValue(logRecordPos)
+}
+
+// MultiGet 批量读取数据，返回的 value 和 keys 一一对应，不存在的 key 对应的 value 为 nil
+// 使用 io_uring 时所有的读请求一次提交
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	values := make([][]byte, len(keys))
+	var positions []*data.LogRecordPos
+	var indexes []int
+	for i, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrKeyIsEmpty
+		}
+		logRecordPos, err := db.index.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if logRecordPos == nil {
+			continue
+		}
+		if db.valueCache != nil {
+			if value, ok := db.valueCache.get(logRecordPos); ok {
+				values[i] = value
+				continue
+			}
+		}
+		positions = append(positions, logRecordPos)
+		indexes = append(indexes, i)
+	}
+
+	batchValues, err := db.getValuesByPositions(positions)
+	if err != nil {
+		return nil, err
+	}
+	for j, value := range batchValues {
+		if value == nil {
+			continue
+		}
+		values[indexes[j]] = value
+		if db.valueCache != nil {
+			db.valueCache.add(positions[j], value)
+		}
+	}
+	return values, nil
+}
+
+// GetWithMeta 根据 key 读取数据以及对应的元数据
+func (db *DB) GetWithMeta(key []byte) ([]byte, *Meta, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(key) == 0 {
+		return nil, nil, ErrKeyIsEmpty
+	}
+
+	logRecordPos, err := db.index.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if logRecordPos == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	logRecord, err := db.readLogRecord(logRecordPos)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := db.getValueByRecord(logRecord)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, newMeta(logRecord), nil
 }
 
 // ListKeys 获取数据库中所有的 key
 func (db *DB) ListKeys() [][]byte {
+	return db.listKeys(func() bool { return false })
+}
+
+// ListKeysCtx 获取数据库中所有的 key，每个 key 之间检查 ctx，取消时返回 ctx.Err()
+func (db *DB) ListKeysCtx(ctx context.Context) ([][]byte, error) {
+	keys := db.listKeys(func() bool { return ctx.Err() != nil })
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// 遍历索引获取所有的 key，每个 key 之前调用 canceled，返回 true 时终止遍历
+func (db *DB) listKeys(canceled func() bool) [][]byte {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	// 索引的数据量只用于预分配容量
+	size, _ := db.index.Size()
+	keys := make([][]byte, 0, size)
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if canceled() {
+			break
+		}
+		// 二级索引的数据对用户不可见
+		if isSecondaryIndexKey(iterator.Key()) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
 
 // Fold 获取所有的数据，并执行用户指定的操作，函数返回 false 时终止遍历
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
+	return db.FoldCtx(context.Background(), fn)
+}
+
+// FoldCtx 和 Fold 相同，每条数据之间检查 ctx，取消时终止遍历并返回 ctx.Err()
+func (db *DB) FoldCtx(ctx context.Context, fn func(key []byte, value []byte) bool) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isSecondaryIndexKey(iterator.Key()) {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -342,37 +709,134 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 // 根据索引信息获取对应的 value
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-	// 根据文件 id 找到对应的数据文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
+	logRecord, err := db.readLogRecord(logRecordPos)
+	if err != nil {
+		return nil, err
 	}
-	// 数据文件为空
-	if dataFile == nil {
-		return nil, ErrDataFileNotFound
+	return db.getValueByRecord(logRecord)
+}
+
+// 批量读取时单条记录的大小上限，超过的记录逐条读取
+const batchReadMaxSize = 64 * 1024
+
+// 根据多个索引信息批量读取对应的 value，已经被删除的数据对应的 value 为 nil
+// 调用方需要持有 db.mu
+func (db *DB) getValuesByPositions(positions []*data.LogRecordPos) ([][]byte, error) {
+	values := make([][]byte, len(positions))
+	requests := make([]*fio.ReadRequest, 0, len(positions))
+	var indexes []int
+	for i, pos := range positions {
+		dataFile := db.getDataFile(pos.Fid)
+		if dataFile == nil {
+			return nil, ErrDataFileNotFound
+		}
+		// 没有记录大小的位置信息无法一次读取完整的数据
+		// 流式写入的头部记录的大小包含了所有分块，较大的记录批量读取没有收益，都逐条读取
+		if pos.Size == 0 || pos.Size > batchReadMaxSize {
+			value, err := db.getValueByPosition(pos)
+			if err != nil && err != ErrKeyNotFound {
+				return nil, err
+			}
+			values[i] = value
+			continue
+		}
+		requests = append(requests, &fio.ReadRequest{
+			Manager: dataFile.IoManager,
+			Buf:     make([]byte, pos.Size),
+			Offset:  pos.Offset,
+		})
+		indexes = append(indexes, i)
+	}
+
+	fio.ReadBatch(requests)
+	for j, req := range requests {
+		// 流式写入的头部记录的大小超过了记录本身的长度，读到文件末尾时只使用实际读到的数据
+		if req.Err != nil && req.Err != io.EOF {
+			return nil, req.Err
+		}
+		logRecord, _, err := data.DecodeLogRecord(req.Buf[:req.N])
+		if err != nil {
+			return nil, err
+		}
+		value, err := db.getValueByRecord(logRecord)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		values[indexes[j]] = value
 	}
+	return values, nil
+}
 
-	// 根据偏移读取对应的数据
-	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+// 根据索引信息获取对应的 value，优先从 value 缓存中读取
+// 只有 Get 会填充缓存，避免迭代器和 Fold 的全量扫描把热点数据淘汰
+func (db *DB) getCachedValue(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	if db.valueCache == nil {
+		return db.getValueByPosition(logRecordPos)
+	}
+	if value, ok := db.valueCache.get(logRecordPos); ok {
+		return value, nil
+	}
+	value, err := db.getValueByPosition(logRecordPos)
 	if err != nil {
 		return nil, err
 	}
+	db.valueCache.add(logRecordPos, value)
+	return value, nil
+}
 
-	if logRecord.Type == data.LogRecordDeleted {
+// 根据 LogRecord 获取对应的 value
+func (db *DB) getValueByRecord(logRecord *data.LogRecord) ([]byte, error) {
+	switch logRecord.Type {
+	case data.LogRecordDeleted:
 		return nil, ErrKeyNotFound
+	case data.LogRecordStream:
+		// 流式写入的数据需要读取所有的分块
+		return db.readStreamValue(logRecord.Value)
 	}
 
 	return logRecord.Value, nil
 }
 
+// 根据索引信息读取对应的 LogRecord
+func (db *DB) readLogRecord(logRecordPos *data.LogRecordPos) (*data.LogRecord, error) {
+	// 根据文件 id 找到对应的数据文件
+	dataFile := db.getDataFile(logRecordPos.Fid)
+	// 数据文件为空
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+
+	// 根据偏移读取对应的数据
+	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	return logRecord, err
+}
+
+// 根据文件 id 找到对应的数据文件
+func (db *DB) getDataFile(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
+	}
+	if dataFile, ok := db.olderFiles[fid]; ok {
+		return dataFile
+	}
+	return db.getRetiredFile(fid)
+}
+
 func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	return db.appendLogRecord(logRecord)
 }
 
+// 提交活跃文件中缓存的写入，每次写入操作或者每个批次的所有记录写入之后调用一次
+// 在访问此方法前必须持有互斥锁
+func (db *DB) flushActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	return db.activeFile.Flush()
+}
+
 // 追加写数据到活跃文件中
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
 	// 判断当前活跃数据文件是否存在，因为数据库在没有写入的时候是没有文件生成的
@@ -388,17 +852,19 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	// 如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
 	if db.activeFile.WriteOff+size > db.options.DataFileSize {
 		// 先持久化数据文件
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.sealActiveFile(); err != nil {
 			return nil, err
 		}
 
 		// 当前活跃文件转换为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		sealedFile := db.activeFile
+		db.olderFiles[sealedFile.FileId] = sealedFile
 
 		// 打开新的数据文件
 		if err := db.setActiveDataFile(); err != nil {
 			return nil, err
 		}
+		db.fileRotated(sealedFile)
 	}
 
 	writeOff := db.activeFile.WriteOff
@@ -407,13 +873,14 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 
 	db.bytesWrite += uint(size)
+	db.metrics.bytesWritten.Add(uint64(size))
 	// 根据用户配置决定是否持久化
 	var needSync = db.options.SyncWrites
 	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
 		needSync = true
 	}
 	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
 		// 清空累计值
@@ -427,6 +894,36 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	return pos, nil
 }
 
+// 活跃文件转换为旧的数据文件之前进行持久化，并释放预先分配的空间
+// 限制了打开文件数量时，之后由句柄缓存管理这个文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) sealActiveFile() error {
+	if err := db.syncActiveFile(); err != nil {
+		return err
+	}
+	return db.sealDataFile(db.activeFile)
+}
+
+// 截断已经持久化的数据文件，限制打开文件数量时改为由句柄缓存管理
+// 在访问此方法前必须持有互斥锁
+func (db *DB) sealDataFile(dataFile *data.DataFile) error {
+	if err := dataFile.Truncate(dataFile.WriteOff); err != nil {
+		return err
+	}
+	if db.fileHandles == nil {
+		return nil
+	}
+	if err := dataFile.IoManager.Close(); err != nil {
+		return err
+	}
+	ioManager, err := db.newOlderIOManager(dataFile.FileId, db.options.IOType)
+	if err != nil {
+		return err
+	}
+	dataFile.IoManager = ioManager
+	return nil
+}
+
 // 设置当前活跃文件
 // 在访问此方法前必须持有互斥锁
 func (db *DB) setActiveDataFile() error {
@@ -434,33 +931,53 @@ func (db *DB) setActiveDataFile() error {
 	if db.activeFile != nil {
 		initialFileId = db.activeFile.FileId + 1
 	}
+	return db.setActiveDataFileWithId(initialFileId)
+}
+
+// 使用指定的文件 id 打开新的活跃文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) setActiveDataFileWithId(fileId uint32) error {
 	// 打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StandardFIO)
+	dataFile, err := data.OpenDataFile(db.options.DirPath, fileId, db.options.IOType)
 	if err != nil {
 		return err
 	}
+	// 预先分配数据文件的空间，避免写入时文件系统分配空间带来的延迟
+	if preallocator, ok := dataFile.IoManager.(fio.Preallocator); ok {
+		if err := preallocator.Preallocate(db.options.DataFileSize); err != nil {
+			_ = dataFile.Close()
+			return err
+		}
+	}
 	db.activeFile = dataFile
 	return nil
 }
 
 // 从磁盘中加载数据文件
 func (db *DB) loadDataFiles() error {
-	dirEntries, err := os.ReadDir(db.options.DirPath)
-	if err != nil {
-		return err
-	}
-
 	var fileIds []int
-	// 遍历目录中的所有文件，找到所有以 .data 结尾的文件
-	for _, entry := range dirEntries {
-		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
-			splitNames := strings.Split(entry.Name(), ".")
-			fileId, err := strconv.Atoi(splitNames[0])
-			// 数据目录有可能被损坏了
-			if err != nil {
-				return ErrDataDirectoryCorrupted
+	// 同一个文件在移动到冷存储目录的过程中可能同时存在于两个目录
+	seen := make(map[int]bool)
+	for _, dirPath := range append([]string{db.options.DirPath}, db.coldDirPaths()...) {
+		dirEntries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+
+		// 遍历目录中的所有文件，找到所有以 .data 结尾的数据文件以及压缩之后以 .seg 结尾的段文件
+		for _, entry := range dirEntries {
+			if data.IsDataFileName(entry.Name()) {
+				splitNames := strings.Split(entry.Name(), ".")
+				fileId, err := strconv.Atoi(splitNames[0])
+				// 数据目录有可能被损坏了
+				if err != nil {
+					return ErrDataDirectoryCorrupted
+				}
+				if !seen[fileId] {
+					seen[fileId] = true
+					fileIds = append(fileIds, fileId)
+				}
 			}
-			fileIds = append(fileIds, fileId)
 		}
 	}
 
@@ -470,18 +987,22 @@ func (db *DB) loadDataFiles() error {
 
 	// 遍历每个文件id，打开对应的数据文件
 	for i, fid := range fileIds {
-		ioType := fio.StandardFIO
+		ioType := db.options.IOType
 		if db.options.MMapAtStartup {
 			ioType = fio.MemoryMap
 		}
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
-		if err != nil {
-			return err
-		}
 		if i == len(fileIds)-1 { // 最后一个，id是最大的，说明是当前活跃文件
+			dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType, db.coldDirPaths()...)
+			if err != nil {
+				return err
+			}
 			db.activeFile = dataFile
 		} else { // 说明是旧的数据文件
-			db.olderFiles[uint32(fid)] = dataFile
+			ioManager, err := db.newOlderIOManager(uint32(fid), ioType)
+			if err != nil {
+				return err
+			}
+			db.olderFiles[uint32(fid)] = data.NewDataFile(uint32(fid), ioManager)
 		}
 	}
 	return nil
@@ -507,19 +1028,6 @@ func (db *DB) loadIndexFromDataFiles() error {
 		nonMergeFileId = fid
 	}
 
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
-		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
-		}
-	}
-
 	// 暂存事务数据
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
 	var currentSeqNo = nonTransactionSeqNo
@@ -531,12 +1039,7 @@ func (db *DB) loadIndexFromDataFiles() error {
 		if hasMerge && fileId < nonMergeFileId {
 			continue
 		}
-		var dataFile *data.DataFile
-		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.olderFiles[fileId]
-		}
+		dataFile := db.getDataFile(fileId)
 
 		var offset int64 = 0
 		for {
@@ -548,28 +1051,15 @@ func (db *DB) loadIndexFromDataFiles() error {
 				return err
 			}
 
+			if err := db.rateLimiter.WaitN(context.Background(), size); err != nil {
+				return err
+			}
+
 			// 构造内存索引
 			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
-
-			// 解析 key，拿到事务序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				// 非事务操作，直接更新内存索引
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 事务完成，对应的 seq no 的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
+			seqNo, err := db.replayLogRecord(logRecord, logRecordPos, transactionRecords)
+			if err != nil {
+				return err
 			}
 
 			// 更新事务序列号
@@ -591,6 +1081,77 @@ func (db *DB) loadIndexFromDataFiles() error {
 	return nil
 }
 
+// 根据数据文件中的一条记录更新内存索引，返回记录对应的事务序列号
+// 事务数据先暂存在 transactionRecords 中，读到事务完成的标识之后才会更新到内存索引
+func (db *DB) replayLogRecord(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos,
+	transactionRecords map[uint64][]*data.TransactionRecord) (uint64, error) {
+	// 流式写入的分块由头部记录引用，不单独构建索引
+	if logRecord.Type == data.LogRecordStreamChunk {
+		return nonTransactionSeqNo, nil
+	}
+	if logRecord.Type == data.LogRecordStream {
+		_, chunks, err := decodeStreamChunks(logRecord.Value)
+		if err != nil {
+			return 0, err
+		}
+		logRecordPos.Size = streamSpan(logRecordPos.Size, chunks)
+	}
+
+	// 解析 key，拿到事务序列号
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	if seqNo == nonTransactionSeqNo {
+		// 非事务操作，直接更新内存索引
+		if err := db.updateIndex(realKey, logRecord.Type, logRecordPos); err != nil {
+			return 0, err
+		}
+	} else {
+		// 事务完成，对应的 seq no 的数据可以更新到内存索引中
+		if logRecord.Type == data.LogRecordTxnFinished {
+			for _, txnRecord := range transactionRecords[seqNo] {
+				if err := db.updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos); err != nil {
+					return 0, err
+				}
+			}
+			delete(transactionRecords, seqNo)
+		} else {
+			logRecord.Key = realKey
+			transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
+				Record: logRecord,
+				Pos:    logRecordPos,
+			})
+		}
+	}
+	return seqNo, nil
+}
+
+// 根据记录类型更新内存索引，并累计可回收的数据量
+func (db *DB) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) error {
+	var oldPos *data.LogRecordPos
+	var err error
+	if typ == data.LogRecordDeleted {
+		oldPos, _, err = db.index.Delete(key)
+		db.reclaimSize += int64(pos.Size)
+	} else {
+		oldPos, err = db.index.Put(key, pos)
+	}
+	if err != nil {
+		return err
+	}
+	db.countIndexKey(key, typ, oldPos != nil)
+	if oldPos != nil {
+		db.reclaimSize += int64(oldPos.Size)
+	}
+	return nil
+}
+
+func newMeta(logRecord *data.LogRecord) *Meta {
+	meta := &Meta{Flags: logRecord.Flags}
+	if logRecord.Timestamp != 0 {
+		meta.Timestamp = time.Unix(0, logRecord.Timestamp)
+	}
+	return meta
+}
+
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return errors.New("database dir path is empty")
@@ -601,6 +1162,30 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.DataFileSize > math.MaxUint32 {
+		return errors.New("database data file size must be less than 4GB")
+	}
+	if options.StreamChunkSize < 0 {
+		return errors.New("stream chunk size must not be negative")
+	}
+	if options.IOType != StandardIO && options.IOType != MMapIO && options.IOType != DirectIO && options.IOType != IOUring {
+		return errors.New("unsupported io type")
+	}
+	if options.MaxOpenFiles < 0 {
+		return errors.New("max open files must not be negative")
+	}
+	if options.ValueCacheSize < 0 {
+		return errors.New("value cache size must not be negative")
+	}
+	if options.RateLimit < 0 {
+		return ErrInvalidRateLimit
+	}
+	if options.DiskSoftLimit > 0 && options.DiskHardLimit > options.DiskSoftLimit {
+		return ErrInvalidDiskLimit
+	}
+	if options.DiskStallTimeout < 0 {
+		return errors.New("disk stall timeout must not be negative")
+	}
 	return nil
 }
 
@@ -631,13 +1216,35 @@ func (db *DB) resetIoType() error {
 		return nil
 	}
 
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+	if err := db.activeFile.SetIOManager(db.options.DirPath, db.options.IOType); err != nil {
 		return err
 	}
 	for _, dataFile := range db.olderFiles {
-		if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		if err := dataFile.IoManager.Close(); err != nil {
 			return err
 		}
+		ioManager, err := db.newOlderIOManager(dataFile.FileId, db.options.IOType)
+		if err != nil {
+			return err
+		}
+		dataFile.IoManager = ioManager
 	}
 	return nil
 }
+
+// 初始化旧数据文件的 IOManager，文件可能位于数据目录或者冷存储目录中
+func (db *DB) newOlderIOManager(fid uint32, ioType fio.FileIOType) (fio.IOManager, error) {
+	fileName := data.ResolveDataFileName(db.options.DirPath, fid, db.coldDirPaths()...)
+	return db.openIOManager(fileName, ioType)
+}
+
+// 限制了打开文件数量时由句柄缓存在读取时打开文件，压缩之后的段文件只能以段文件的方式读取
+func (db *DB) openIOManager(fileName string, ioType fio.FileIOType) (fio.IOManager, error) {
+	if strings.HasSuffix(fileName, data.SegmentFileNameSuffix) {
+		ioType = fio.SegmentFIO
+	}
+	if db.fileHandles != nil {
+		return db.fileHandles.Open(fileName, ioType), nil
+	}
+	return fio.NewIOManager(fileName, ioType)
+}
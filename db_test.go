@@ -1,9 +1,16 @@
 package db_bitcask
 
 import (
+	"context"
+	"db-bitcask/data"
+	"db-bitcask/fio"
 	"db-bitcask/utils"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,6 +38,79 @@ func TestOpen(t *testing.T) {
 	assert.NotNil(t, db)
 }
 
+func TestOpen_UnsupportedIndexType(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-index-type")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	opts.IndexType = 100
+	_, err := Open(opts)
+	assert.Equal(t, ErrUnsupportedIndexType, err)
+
+	// 打开失败之后目录锁已经释放
+	opts.IndexType = BTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_LoadError(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-load-error")
+	opts.DirPath = dir
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Nil(t, db.Close())
+
+	// 加载数据文件失败之后目录锁已经释放
+	invalidFile := filepath.Join(dir, "invalid"+data.DataFileNameSuffix)
+	assert.Nil(t, os.WriteFile(invalidFile, nil, 0644))
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupted, err)
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupted, err)
+
+	assert.Nil(t, os.Remove(invalidFile))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_IndexError(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-index-error")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(24))
+	assert.Nil(t, err)
+
+	// 磁盘索引不可用时返回错误而不是 panic
+	assert.Nil(t, db.index.Close())
+	var indexErr *IndexError
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.ErrorAs(t, err, &indexErr)
+	assert.Equal(t, "get", indexErr.Op)
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(24))
+	assert.ErrorAs(t, err, &indexErr)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.ErrorAs(t, err, &indexErr)
+	_, err = db.Stat()
+	assert.ErrorAs(t, err, &indexErr)
+	assert.Equal(t, "size", indexErr.Op)
+}
+
 func TestDB_Put(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp("", "db-bitcask-put")
@@ -197,7 +277,14 @@ func TestDB_Delete(t *testing.T) {
 	assert.NotNil(t, val1)
 	assert.Nil(t, err)
 
-	// 5.重启之后，再进行校验
+	// 5.写入数据文件失败时返回错误
+	assert.Nil(t, db.activeFile.IoManager.Close())
+	err = db.Delete(utils.GetTestKey(22))
+	assert.NotNil(t, err)
+	db.activeFile.IoManager, err = fio.NewIOManager(data.GetDataFileName(dir, db.activeFile.FileId), fio.StandardFIO)
+	assert.Nil(t, err)
+
+	// 6.重启之后，再进行校验
 	err = db.Close()
 	assert.Nil(t, err)
 
@@ -271,6 +358,68 @@ func TestDB_Fold(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// 检查 n 次之后变为取消状态的 context，用于在操作中途取消
+type cancelAfterContext struct {
+	context.Context
+	n int32
+}
+
+func newCancelAfterContext(n int32) *cancelAfterContext {
+	return &cancelAfterContext{Context: context.Background(), n: n}
+}
+
+func (c *cancelAfterContext) Err() error {
+	if atomic.AddInt32(&c.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDB_FoldCtx(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-fold-ctx")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(20))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int
+	err = db.FoldCtx(ctx, func(key []byte, value []byte) bool {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 10, count)
+
+	// 已经取消的 context
+	_, err = db.GetCtx(ctx, utils.GetTestKey(1))
+	assert.Equal(t, context.Canceled, err)
+	_, err = db.ListKeysCtx(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	keys, err := db.ListKeysCtx(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(keys))
+	val, err := db.GetCtx(context.Background(), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	deadline, cancel2 := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel2()
+	_, err = db.ListKeysCtx(deadline)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
 func TestDB_Close(t *testing.T) {
 	opts := DefaultOptions
 	dir, _ := os.MkdirTemp("", "db-bitcask-close")
@@ -344,7 +493,8 @@ func TestDB_Stat(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	stat := db.Stat()
+	stat, err := db.Stat()
+	assert.Nil(t, err)
 	assert.NotNil(t, stat)
 }
 
@@ -386,3 +536,258 @@ func TestDB_Backup(t *testing.T) {
 //	assert.Nil(t, err)
 //	assert.NotNil(t, db)
 //}
+
+func TestDB_GetWithMeta(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-meta")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	before := time.Now()
+	err = db.PutWithFlags(utils.GetTestKey(1), []byte("value-1"), 42)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("value-2"))
+	assert.Nil(t, err)
+
+	val1, meta1, err := db.GetWithMeta(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-1"), val1)
+	assert.Equal(t, uint32(42), meta1.Flags)
+	assert.False(t, meta1.Timestamp.Before(before))
+
+	_, meta2, err := db.GetWithMeta(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), meta2.Flags)
+
+	_, _, err = db.GetWithMeta(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// merge 之后元数据保持不变
+	err = db.Put(utils.GetTestKey(2), []byte("value-2-new"))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	val3, meta3, err := db2.GetWithMeta(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val1, val3)
+	assert.Equal(t, meta1.Flags, meta3.Flags)
+	assert.True(t, meta1.Timestamp.Equal(meta3.Timestamp))
+}
+
+func TestDB_MMapIO(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = MMapIO
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+	// 转换为旧文件之后释放了预先分配的空间
+	for _, dataFile := range db.olderFiles {
+		stat, err := os.Stat(data.GetDataFileName(dir, dataFile.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, dataFile.WriteOff, stat.Size())
+	}
+	err = db.Sync()
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	activeFid := db.activeFile.FileId
+	writeOff := db.activeFile.WriteOff
+	err = db.Close()
+	assert.Nil(t, err)
+	stat, err := os.Stat(data.GetDataFileName(dir, activeFid))
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, stat.Size())
+
+	// 模拟崩溃之后活跃文件末尾残留的预分配空间
+	file, err := os.OpenFile(data.GetDataFileName(dir, activeFid), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Truncate(writeOff+4096))
+	assert.Nil(t, file.Close())
+
+	opts.IOType = StandardIO
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, db2.activeFile.WriteOff)
+	err = db2.Put([]byte("after-crash"), []byte("value"))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	opts.IOType = MMapIO
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	val, err = db3.Get([]byte("after-crash"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Equal(t, 1001, len(db3.ListKeys()))
+}
+
+func TestDB_DirectIO(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-direct-io")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = DirectIO
+	db, err := Open(opts)
+	if err == syscall.EINVAL {
+		_ = os.RemoveAll(dir)
+		t.Skip("the file system does not support O_DIRECT")
+	}
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+	for _, dataFile := range db.olderFiles {
+		stat, err := os.Stat(data.GetDataFileName(dir, dataFile.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, dataFile.WriteOff, stat.Size())
+	}
+	val, err := db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	val2, err := db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, val, val2)
+}
+
+func TestDB_MultiGet(t *testing.T) {
+	for _, ioType := range []IOType{StandardIO, MMapIO, IOUring} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-multi-get")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.IOType = ioType
+		opts.ValueCacheSize = 1024 * 1024
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		var keys [][]byte
+		for i := 0; i < 500; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(t, err)
+			keys = append(keys, utils.GetTestKey(i))
+		}
+		err = db.Delete(utils.GetTestKey(10))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(20), nil)
+		assert.Nil(t, err)
+		keys = append(keys, []byte("unknown"))
+		// 命中缓存的数据
+		_, err = db.Get(utils.GetTestKey(30))
+		assert.Nil(t, err)
+
+		values, err := db.MultiGet(keys)
+		assert.Nil(t, err)
+		assert.Equal(t, len(keys), len(values))
+		for i, key := range keys {
+			expected, err := db.Get(key)
+			if err == ErrKeyNotFound {
+				assert.Nil(t, values[i])
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, expected, values[i])
+		}
+		assert.Nil(t, values[10])
+		assert.NotNil(t, values[20])
+		assert.Equal(t, 0, len(values[20]))
+
+		_, err = db.MultiGet([][]byte{nil})
+		assert.Equal(t, ErrKeyIsEmpty, err)
+		destroyDB(db)
+	}
+}
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-open-files")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MaxOpenFiles = 3
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 3)
+	for i := 0; i < 2000; i += 7 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.OpenFileNum <= 3)
+	assert.True(t, stat.FileOpenCount > 3)
+
+	// 重新打开之后加载索引
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	keys := make([][]byte, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	values, err := db2.MultiGet(keys)
+	assert.Nil(t, err)
+	for i, value := range values {
+		assert.Equal(t, keys[i], value)
+	}
+	stat, err = db2.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.OpenFileNum <= 3)
+
+	opts.MaxOpenFiles = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
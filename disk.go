@@ -0,0 +1,181 @@
+package db_bitcask
+
+import (
+	"context"
+	"db-bitcask/utils"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 后台检查数据目录所在磁盘可用空间的间隔
+const diskCheckInterval = time.Second
+
+// 获取磁盘可用空间，测试时可以替换
+var availableDiskSize = utils.AvailableDiskSize
+
+// DiskState 数据目录所在磁盘的空间状态
+type DiskState int8
+
+const (
+	// DiskOK 可用空间充足
+	DiskOK DiskState = iota
+
+	// DiskLow 可用空间低于 DiskSoftLimit，写入等待或者返回 ErrDiskSpaceLow
+	DiskLow
+
+	// DiskFull 可用空间低于 DiskHardLimit，数据库只读
+	DiskFull
+)
+
+func (s DiskState) String() string {
+	switch s {
+	case DiskLow:
+		return "low"
+	case DiskFull:
+		return "full"
+	default:
+		return "ok"
+	}
+}
+
+// 最近一次检查的磁盘空间状态
+type diskWatchdog struct {
+	mu        sync.Mutex
+	state     DiskState
+	available uint64
+	changed   chan struct{} // 状态变化时关闭，唤醒等待空间的写入
+}
+
+func newDiskWatchdog() *diskWatchdog {
+	return &diskWatchdog{changed: make(chan struct{})}
+}
+
+func (w *diskWatchdog) get() (DiskState, uint64, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state, w.available, w.changed
+}
+
+// 更新状态，返回之前的状态
+func (w *diskWatchdog) set(state DiskState, available uint64) DiskState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := w.state
+	w.available = available
+	if old != state {
+		w.state = state
+		close(w.changed)
+		w.changed = make(chan struct{})
+	}
+	return old
+}
+
+// DiskState 返回最近一次检查的磁盘空间状态以及可用空间，没有配置磁盘空间限制时返回 DiskOK 和 0
+func (db *DB) DiskState() (DiskState, uint64) {
+	if db.disk == nil {
+		return DiskOK, 0
+	}
+	state, available, _ := db.disk.get()
+	return state, available
+}
+
+// 检查数据目录所在磁盘的可用空间并更新状态，空间不足时在后台触发 merge
+func (db *DB) checkDiskSpace() error {
+	available, err := availableDiskSize(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	state := DiskOK
+	if db.options.DiskHardLimit > 0 && available < db.options.DiskHardLimit {
+		state = DiskFull
+	} else if db.options.DiskSoftLimit > 0 && available < db.options.DiskSoftLimit {
+		state = DiskLow
+	}
+
+	old := db.disk.set(state, available)
+	if old == state {
+		return nil
+	}
+	info := DiskSpaceInfo{Old: old, New: state, Available: available}
+	if state == DiskOK {
+		db.logger.Log(LogInfo, "disk space recovered", "available", available)
+	} else {
+		db.logger.Log(LogWarn, "disk space is low", "state", state, "available", available)
+	}
+	if db.options.EventListener.DiskSpaceChanged != nil {
+		db.options.EventListener.DiskSpaceChanged(info)
+	}
+	if old == DiskOK {
+		db.bgWg.Add(1)
+		go db.mergeForDiskSpace()
+	}
+	return nil
+}
+
+// 可用空间不足时 merge 回收无效数据，关闭数据库时取消
+func (db *DB) mergeForDiskSpace() {
+	defer db.bgWg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-db.bgStop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := db.MergeCtx(ctx)
+	if errors.Is(err, ErrMergeIsProgress) || errors.Is(err, ErrMergeRatioUnreached) || errors.Is(err, context.Canceled) {
+		return
+	}
+	db.backgroundError("disk_space_merge", err)
+}
+
+func (db *DB) watchDiskSpaceInBackground() {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			db.backgroundError("check_disk_space", db.checkDiskSpace())
+		}
+	}
+}
+
+// 写入之前检查磁盘空间，可用空间低于 DiskSoftLimit 时最多等待 DiskStallTimeout
+// isDelete 为 true 时只受 DiskHardLimit 的限制
+func (db *DB) waitDiskSpace(isDelete bool) error {
+	if db.disk == nil {
+		return nil
+	}
+	var timer *time.Timer
+	for {
+		state, available, changed := db.disk.get()
+		switch {
+		case state == DiskFull:
+			return &DiskSpaceError{Available: available, Limit: db.options.DiskHardLimit, Err: ErrDiskFull}
+		case state == DiskOK || isDelete:
+			return nil
+		}
+
+		lowErr := &DiskSpaceError{Available: available, Limit: db.options.DiskSoftLimit, Err: ErrDiskSpaceLow}
+		if db.options.DiskStallTimeout <= 0 {
+			return lowErr
+		}
+		if timer == nil {
+			timer = time.NewTimer(db.options.DiskStallTimeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return lowErr
+		case <-db.bgStop:
+			return lowErr
+		}
+	}
+}
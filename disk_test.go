@@ -0,0 +1,158 @@
+package db_bitcask
+
+import (
+	"db-bitcask/utils"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 将磁盘可用空间替换为 available 的值，返回恢复的函数
+func stubAvailableDiskSize(available *uint64) func() {
+	origin := availableDiskSize
+	availableDiskSize = func(dirPath string) (uint64, error) {
+		return atomic.LoadUint64(available), nil
+	}
+	return func() {
+		availableDiskSize = origin
+	}
+}
+
+// 空间不足时后台可能正在 merge，先关闭等待后台任务退出再删除目录
+func closeDiskDB(db *DB) {
+	_ = db.Close()
+	_ = os.RemoveAll(db.options.DirPath)
+}
+
+func TestDB_DiskSoftLimit(t *testing.T) {
+	available := uint64(100)
+	defer stubAvailableDiskSize(&available)()
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-disk-soft")
+	opts.DirPath = dir
+	opts.DiskSoftLimit = 1000
+	var changes []DiskSpaceInfo
+	opts.EventListener.DiskSpaceChanged = func(info DiskSpaceInfo) {
+		changes = append(changes, info)
+	}
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer closeDiskDB(db)
+
+	state, size := db.DiskState()
+	assert.Equal(t, DiskLow, state)
+	assert.Equal(t, uint64(100), size)
+
+	// 没有设置等待时长时直接返回错误
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.True(t, errors.Is(err, ErrDiskSpaceLow))
+	var diskErr *DiskSpaceError
+	assert.True(t, errors.As(err, &diskErr))
+	assert.Equal(t, uint64(100), diskErr.Available)
+	assert.Equal(t, uint64(1000), diskErr.Limit)
+
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), utils.RandomValue(10)))
+	assert.True(t, errors.Is(wb.Commit(), ErrDiskSpaceLow))
+
+	// 空间恢复之后可以写入
+	atomic.StoreUint64(&available, 2000)
+	assert.Nil(t, db.checkDiskSpace())
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	// 删除不受软限制的影响
+	atomic.StoreUint64(&available, 100)
+	assert.Nil(t, db.checkDiskSpace())
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, DiskLow, stat.DiskState)
+	assert.Equal(t, uint64(100), stat.DiskAvailable)
+
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, DiskSpaceInfo{Old: DiskOK, New: DiskLow, Available: 100}, changes[0])
+	assert.Equal(t, DiskOK, changes[1].New)
+}
+
+func TestDB_DiskStall(t *testing.T) {
+	available := uint64(100)
+	defer stubAvailableDiskSize(&available)()
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-disk-stall")
+	opts.DirPath = dir
+	opts.DiskSoftLimit = 1000
+	opts.DiskStallTimeout = 50 * time.Millisecond
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer closeDiskDB(db)
+
+	// 等待超时之后返回错误
+	start := time.Now()
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.True(t, errors.Is(err, ErrDiskSpaceLow))
+	assert.True(t, time.Since(start) >= opts.DiskStallTimeout)
+
+	// 等待期间空间恢复时写入成功
+	db.options.DiskStallTimeout = time.Minute
+	done := make(chan error)
+	go func() {
+		done <- db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreUint64(&available, 2000)
+	assert.Nil(t, db.checkDiskSpace())
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write is not resumed after disk space recovered")
+	}
+}
+
+func TestDB_DiskHardLimit(t *testing.T) {
+	available := uint64(2000)
+	defer stubAvailableDiskSize(&available)()
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-disk-hard")
+	opts.DirPath = dir
+	opts.DiskSoftLimit = 1000
+	opts.DiskHardLimit = 500
+	opts.DiskStallTimeout = time.Minute
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer closeDiskDB(db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	// 低于硬限制时只读，不会等待
+	atomic.StoreUint64(&available, 100)
+	assert.Nil(t, db.checkDiskSpace())
+	err = db.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.True(t, errors.Is(err, ErrDiskFull))
+	err = db.Delete(utils.GetTestKey(1))
+	assert.True(t, errors.Is(err, ErrDiskFull))
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 空间恢复之后自动恢复写入
+	atomic.StoreUint64(&available, 2000)
+	assert.Nil(t, db.checkDiskSpace())
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("v2")))
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+
+	opts.DiskHardLimit = 2000
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidDiskLimit, err)
+}
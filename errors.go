@@ -1,6 +1,11 @@
 package db_bitcask
 
-import "errors"
+import (
+	"db-bitcask/fio"
+	"db-bitcask/index"
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrKeyIsEmpty             = errors.New("the key is empty")
@@ -13,4 +18,50 @@ var (
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrInvalidStreamSize      = errors.New("the stream size is invalid")
+	ErrStreamCorrupted        = errors.New("the stream value maybe corrupted")
+	ErrDatabaseClosed         = errors.New("the database is closed")
+	ErrReadOnly               = errors.New("the database is read only")
+	ErrInvalidLogPosition     = errors.New("the log position is invalid")
+	ErrInvalidShardNum        = errors.New("the shard num must be greater than 0")
+	ErrBackupManifestNotFound = errors.New("the backup manifest is not found")
+	ErrBackupCorrupted        = errors.New("the backup maybe corrupted")
+	ErrRestoreDirNotEmpty     = errors.New("the restore directory is not empty")
+	ErrCheckpointDirNotEmpty  = errors.New("the checkpoint directory is not empty")
+	ErrCheckpointCrossDevice  = errors.New("the checkpoint directory is not on the same filesystem as the data files")
+	ErrUnsupportedFormat      = errors.New("unsupported export format")
+	ErrInvalidExportData      = errors.New("the export data is invalid")
+	ErrKeyReserved            = errors.New("the key uses the reserved secondary index prefix")
+	ErrInvalidIndexName       = errors.New("the secondary index name is invalid")
+	ErrIndexNotFound          = errors.New("the secondary index is not registered")
+	ErrWriteBatchUnavailable  = errors.New("cannot use write batch, seq no file not exists")
+	ErrDirectoryUnlock        = errors.New("failed to unlock the database directory")
+	ErrInvalidRateLimit       = errors.New("rate limit must not be negative")
+	ErrMergeOutputTooLarge    = errors.New("merge output exceeds the reserved data file ids")
+	ErrNotReplica             = errors.New("the database is not opened as a replica")
+	ErrResyncRequired         = errors.New("the log position has been compacted by merge, resync required")
+	ErrChangesCompacted       = errors.New("the change cursor has been compacted by merge, resync required")
+	ErrInvalidDiskLimit       = errors.New("disk hard limit must not be greater than the soft limit")
+	ErrDiskSpaceLow           = errors.New("available disk space is below the soft limit")
+	ErrDiskFull               = errors.New("available disk space is below the hard limit, the database is read only")
+	ErrUnsupportedIndexType   = index.ErrUnsupportedIndexType
+	ErrUnsupportedIOType      = fio.ErrUnsupportedIOType
 )
+
+// IndexError 存储在磁盘上的索引读写失败时返回的错误，可以通过 errors.As 取出失败的操作和原始错误
+type IndexError = index.OpError
+
+// DiskSpaceError 磁盘可用空间低于限制时写入返回的错误，Err 为 ErrDiskSpaceLow 或者 ErrDiskFull
+type DiskSpaceError struct {
+	Available uint64 // 最近一次检查时的可用空间
+	Limit     uint64 // 触发的限制
+	Err       error
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("%v: available %d bytes, limit %d bytes", e.Err, e.Available, e.Limit)
+}
+
+func (e *DiskSpaceError) Unwrap() error {
+	return e.Err
+}
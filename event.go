@@ -0,0 +1,163 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"time"
+)
+
+// EventListener 数据库内部事件的回调，没有设置的回调不会被调用
+// 回调是同步调用的，调用时可能持有数据库内部的锁，所以不能在回调中调用数据库的方法，耗时的处理需要异步进行
+type EventListener struct {
+	// 活跃文件写满之后切换到新的数据文件
+	FileRotated func(FileRotationInfo)
+
+	// merge 开始以及结束，结束时带有 merge 的耗时和错误
+	MergeBegin func(MergeBeginInfo)
+	MergeEnd   func(MergeEndInfo)
+
+	// 打开数据库时丢弃了活跃文件末尾不完整的数据
+	RecoveryTruncated func(RecoveryTruncationInfo)
+
+	// 活跃文件持久化完成
+	SyncCompleted func(SyncInfo)
+
+	// 操作耗时超过了 Options.SlowOperationThreshold
+	SlowOperation func(SlowOperationInfo)
+
+	// 移动冷数据文件、压缩旧数据文件等后台任务失败
+	BackgroundError func(BackgroundErrorInfo)
+
+	// 数据目录所在磁盘的空间状态变化，例如可用空间低于 DiskSoftLimit 或者恢复
+	DiskSpaceChanged func(DiskSpaceInfo)
+}
+
+type FileRotationInfo struct {
+	SealedFileId uint32 // 写满的数据文件 id
+	SealedSize   int64  // 写满的数据文件大小
+	NewFileId    uint32 // 新的活跃文件 id
+}
+
+type MergeBeginInfo struct {
+	FileNum         int   // 参与 merge 的数据文件数量
+	ReclaimableSize int64 // 开始 merge 时可以回收的数据量
+	TotalSize       int64 // 开始 merge 时数据目录的大小
+}
+
+type MergeEndInfo struct {
+	Duration time.Duration
+	Err      error
+}
+
+type RecoveryTruncationInfo struct {
+	FileId uint32
+	Size   int64 // 截断之前的文件大小
+	Offset int64 // 最后一条完整记录的结束位置，文件被截断到此大小
+}
+
+type SyncInfo struct {
+	FileId   uint32
+	Duration time.Duration
+	Err      error
+}
+
+type SlowOperationInfo struct {
+	Op       string // 操作名称，例如 put、get、merge
+	Duration time.Duration
+	Err      error
+}
+
+type BackgroundErrorInfo struct {
+	Task string // 后台任务名称，例如 move_cold_files
+	Err  error
+}
+
+type DiskSpaceInfo struct {
+	Old       DiskState
+	New       DiskState
+	Available uint64 // 检查时的可用空间
+}
+
+// 持久化活跃文件，并记录耗时
+func (db *DB) syncActiveFile() error {
+	return db.syncDataFile(db.activeFile)
+}
+
+func (db *DB) syncDataFile(dataFile *data.DataFile) error {
+	start := time.Now()
+	err := dataFile.Sync()
+	if db.options.EventListener.SyncCompleted != nil {
+		db.options.EventListener.SyncCompleted(SyncInfo{
+			FileId:   dataFile.FileId,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}
+	if err != nil {
+		db.logger.Log(LogError, "failed to sync data file", "fid", dataFile.FileId, "err", err)
+	}
+	return err
+}
+
+// 活跃文件切换之后调用，db.activeFile 为新的活跃文件
+func (db *DB) fileRotated(sealed *data.DataFile) {
+	info := FileRotationInfo{
+		SealedFileId: sealed.FileId,
+		SealedSize:   sealed.WriteOff,
+		NewFileId:    db.activeFile.FileId,
+	}
+	db.logger.Log(LogInfo, "data file rotated", "sealed_fid", info.SealedFileId,
+		"sealed_size", info.SealedSize, "new_fid", info.NewFileId)
+	if db.options.EventListener.FileRotated != nil {
+		db.options.EventListener.FileRotated(info)
+	}
+}
+
+func (db *DB) mergeBegin(info MergeBeginInfo) {
+	db.logger.Log(LogInfo, "merge begin", "files", info.FileNum,
+		"reclaimable_size", info.ReclaimableSize, "total_size", info.TotalSize)
+	if db.options.EventListener.MergeBegin != nil {
+		db.options.EventListener.MergeBegin(info)
+	}
+}
+
+func (db *DB) mergeEnd(start time.Time, err error) {
+	info := MergeEndInfo{Duration: time.Since(start), Err: err}
+	if err != nil {
+		db.logger.Log(LogError, "merge failed", "duration", info.Duration, "err", err)
+	} else {
+		db.logger.Log(LogInfo, "merge end", "duration", info.Duration)
+	}
+	if db.options.EventListener.MergeEnd != nil {
+		db.options.EventListener.MergeEnd(info)
+	}
+}
+
+func (db *DB) recoveryTruncated(info RecoveryTruncationInfo) {
+	db.logger.Log(LogWarn, "truncated incomplete data at the end of active file", "fid", info.FileId,
+		"size", info.Size, "offset", info.Offset)
+	if db.options.EventListener.RecoveryTruncated != nil {
+		db.options.EventListener.RecoveryTruncated(info)
+	}
+}
+
+// 操作完成之后调用，耗时超过阈值时触发慢操作事件
+func (db *DB) operationDone(op string, duration time.Duration, err error) {
+	threshold := db.options.SlowOperationThreshold
+	if threshold <= 0 || duration < threshold {
+		return
+	}
+	db.logger.Log(LogWarn, "slow operation", "op", op, "duration", duration, "err", err)
+	if db.options.EventListener.SlowOperation != nil {
+		db.options.EventListener.SlowOperation(SlowOperationInfo{Op: op, Duration: duration, Err: err})
+	}
+}
+
+func (db *DB) backgroundError(task string, err error) {
+	if err == nil {
+		return
+	}
+	db.logger.Log(LogError, "background task failed", "task", task, "err", err)
+	if db.options.EventListener.BackgroundError != nil {
+		db.options.EventListener.BackgroundError(BackgroundErrorInfo{Task: task, Err: err})
+	}
+}
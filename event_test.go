@@ -0,0 +1,133 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_EventListener(t *testing.T) {
+	var (
+		rotations   []FileRotationInfo
+		mergeBegins []MergeBeginInfo
+		mergeEnds   []MergeEndInfo
+		syncs       []SyncInfo
+		slowOps     []SlowOperationInfo
+	)
+	var logs bytes.Buffer
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-event")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.Logger = NewTextLogger(&logs, LogDebug)
+	opts.SlowOperationThreshold = time.Nanosecond
+	opts.EventListener = EventListener{
+		FileRotated: func(info FileRotationInfo) { rotations = append(rotations, info) },
+		MergeBegin:  func(info MergeBeginInfo) { mergeBegins = append(mergeBegins, info) },
+		MergeEnd:    func(info MergeEndInfo) { mergeEnds = append(mergeEnds, info) },
+		SyncCompleted: func(info SyncInfo) {
+			syncs = append(syncs, info)
+		},
+		SlowOperation: func(info SlowOperationInfo) { slowOps = append(slowOps, info) },
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(rotations) > 0)
+	assert.Equal(t, uint32(0), rotations[0].SealedFileId)
+	assert.Equal(t, uint32(1), rotations[0].NewFileId)
+	assert.True(t, rotations[0].SealedSize > 0)
+	// 切换文件时持久化写满的文件
+	assert.Equal(t, len(rotations), len(syncs))
+
+	err = db.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, db.activeFile.FileId, syncs[len(syncs)-1].FileId)
+
+	// 阈值很小时所有的操作都是慢操作
+	assert.Equal(t, "open", slowOps[0].Op)
+	assert.Equal(t, "put", slowOps[1].Op)
+	assert.Equal(t, "sync", slowOps[len(slowOps)-1].Op)
+
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mergeBegins))
+	// merge 开始前会先切换活跃文件
+	assert.Equal(t, len(rotations), mergeBegins[0].FileNum)
+	assert.True(t, mergeBegins[0].ReclaimableSize > 0)
+	assert.Equal(t, 1, len(mergeEnds))
+	assert.Nil(t, mergeEnds[0].Err)
+
+	assert.Contains(t, logs.String(), `msg="data file rotated"`)
+	assert.Contains(t, logs.String(), `msg="merge begin"`)
+	assert.Contains(t, logs.String(), `msg="merge end"`)
+	assert.Contains(t, logs.String(), `msg="slow operation" op=open`)
+
+	db.backgroundError("move_cold_files", nil)
+	assert.NotContains(t, logs.String(), "background task failed")
+	var bgErrors []BackgroundErrorInfo
+	db.options.EventListener.BackgroundError = func(info BackgroundErrorInfo) { bgErrors = append(bgErrors, info) }
+	db.backgroundError("move_cold_files", errors.New("disk is full"))
+	assert.Equal(t, []BackgroundErrorInfo{{Task: "move_cold_files", Err: errors.New("disk is full")}}, bgErrors)
+	assert.Contains(t, logs.String(), `msg="background task failed" task=move_cold_files err="disk is full"`)
+}
+
+func TestDB_EventListener_RecoveryTruncated(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-event-recovery")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	writeOff := db.activeFile.WriteOff
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 模拟写入到一半时崩溃，活跃文件末尾只有不完整的记录
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(2), nonTransactionSeqNo),
+		Value: utils.RandomValue(64),
+	})
+	file, err := os.OpenFile(data.GetDataFileName(dir, 0), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(encRecord[:len(encRecord)-10])
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	var truncations []RecoveryTruncationInfo
+	opts.EventListener.RecoveryTruncated = func(info RecoveryTruncationInfo) {
+		truncations = append(truncations, info)
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []RecoveryTruncationInfo{{
+		FileId: 0,
+		Size:   writeOff + int64(len(encRecord)) - 10,
+		Offset: writeOff,
+	}}, truncations)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+}
@@ -0,0 +1,240 @@
+package db_bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strings"
+)
+
+// 二进制格式的文件头
+var binaryExportMagic = []byte("BITCASK-DUMP-1\n")
+
+// 导入时每个批次写入的数据量
+const importBatchSize = 1000
+
+// 导出和导入的一条数据
+type exportRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// ParseExportFormat 根据名称解析导出格式，支持 jsonl、csv 和 binary
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch strings.ToLower(name) {
+	case "jsonl", "json":
+		return ExportJSONL, nil
+	case "csv":
+		return ExportCSV, nil
+	case "binary", "bin":
+		return ExportBinary, nil
+	default:
+		return 0, ErrUnsupportedFormat
+	}
+}
+
+// Export 按照 key 的顺序将数据以指定的格式写入 w，返回导出的数据条数
+func (db *DB) Export(w io.Writer, format ExportFormat, opts ExportOptions) (int, error) {
+	writer := bufio.NewWriter(w)
+	encoder, err := newExportEncoder(writer, format)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	iter := db.NewIterator(IteratorOptions{Prefix: opts.Prefix})
+	defer iter.Close()
+	if len(opts.Start) > 0 {
+		iter.Seek(opts.Start)
+	} else {
+		iter.Rewind()
+	}
+	for ; iter.Valid(); iter.Next() {
+		if len(opts.End) > 0 && bytes.Compare(iter.Key(), opts.End) >= 0 {
+			break
+		}
+		value, err := iter.Value()
+		if err != nil {
+			return count, err
+		}
+		if err := encoder(&exportRecord{Key: iter.Key(), Value: value}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, writer.Flush()
+}
+
+// Import 读取 Export 导出的数据并写入，每 importBatchSize 条数据作为一个批次原子地提交，返回导入的数据条数
+func (db *DB) Import(r io.Reader, format ExportFormat) (int, error) {
+	decoder, err := newExportDecoder(bufio.NewReader(r), format)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	if err != nil {
+		return 0, err
+	}
+	var pending int
+	for {
+		record, err := decoder()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := wb.Put(record.Key, record.Value); err != nil {
+			return count, err
+		}
+		pending++
+		if pending >= importBatchSize {
+			if err := wb.Commit(); err != nil {
+				return count, err
+			}
+			count += pending
+			pending = 0
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return count, err
+	}
+	return count + pending, nil
+}
+
+func newExportEncoder(w *bufio.Writer, format ExportFormat) (func(*exportRecord) error, error) {
+	switch format {
+	case ExportJSONL:
+		encoder := json.NewEncoder(w)
+		return func(record *exportRecord) error {
+			return encoder.Encode(record)
+		}, nil
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"key", "value"}); err != nil {
+			return nil, err
+		}
+		return func(record *exportRecord) error {
+			if err := writer.Write([]string{
+				base64.StdEncoding.EncodeToString(record.Key),
+				base64.StdEncoding.EncodeToString(record.Value),
+			}); err != nil {
+				return err
+			}
+			writer.Flush()
+			return writer.Error()
+		}, nil
+	case ExportBinary:
+		if _, err := w.Write(binaryExportMagic); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.MaxVarintLen64)
+		writeBytes := func(b []byte) error {
+			n := binary.PutUvarint(buf, uint64(len(b)))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			_, err := w.Write(b)
+			return err
+		}
+		return func(record *exportRecord) error {
+			if err := writeBytes(record.Key); err != nil {
+				return err
+			}
+			return writeBytes(record.Value)
+		}, nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// 返回的解码函数读取完所有数据之后返回 io.EOF
+func newExportDecoder(r *bufio.Reader, format ExportFormat) (func() (*exportRecord, error), error) {
+	switch format {
+	case ExportJSONL:
+		decoder := json.NewDecoder(r)
+		return func() (*exportRecord, error) {
+			record := &exportRecord{}
+			if err := decoder.Decode(record); err != nil {
+				if err == io.EOF {
+					return nil, err
+				}
+				return nil, ErrInvalidExportData
+			}
+			return record, nil
+		}, nil
+	case ExportCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = 2
+		header, err := reader.Read()
+		if err == io.EOF {
+			return func() (*exportRecord, error) {
+				return nil, io.EOF
+			}, nil
+		}
+		if err != nil || header[0] != "key" || header[1] != "value" {
+			return nil, ErrInvalidExportData
+		}
+		return func() (*exportRecord, error) {
+			fields, err := reader.Read()
+			if err == io.EOF {
+				return nil, err
+			}
+			if err != nil {
+				return nil, ErrInvalidExportData
+			}
+			key, err := base64.StdEncoding.DecodeString(fields[0])
+			if err != nil {
+				return nil, ErrInvalidExportData
+			}
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, ErrInvalidExportData
+			}
+			return &exportRecord{Key: key, Value: value}, nil
+		}, nil
+	case ExportBinary:
+		magic := make([]byte, len(binaryExportMagic))
+		if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, binaryExportMagic) {
+			return nil, ErrInvalidExportData
+		}
+		readBytes := func() ([]byte, error) {
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if size > math.MaxUint32 {
+				return nil, ErrInvalidExportData
+			}
+			// 长度来自输入的数据，只按照实际读到的数据分配内存，截断或者损坏的数据不会导致一次分配过大的内存
+			var buf bytes.Buffer
+			if n, err := io.CopyN(&buf, r, int64(size)); err != nil || n != int64(size) {
+				return nil, ErrInvalidExportData
+			}
+			return buf.Bytes(), nil
+		}
+		return func() (*exportRecord, error) {
+			key, err := readBytes()
+			if err == io.EOF {
+				return nil, err
+			}
+			if err != nil {
+				return nil, ErrInvalidExportData
+			}
+			value, err := readBytes()
+			if err != nil {
+				return nil, ErrInvalidExportData
+			}
+			return &exportRecord{Key: key, Value: value}, nil
+		}, nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
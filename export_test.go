@@ -0,0 +1,129 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/utils"
+	"encoding/binary"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ExportImport(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-export")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(32))
+		assert.Nil(t, err)
+	}
+	// 二进制的 key 和空的 value
+	err = db.Put([]byte{0, 1, 2, '\n', ','}, nil)
+	assert.Nil(t, err)
+
+	for _, format := range []ExportFormat{ExportJSONL, ExportCSV, ExportBinary} {
+		buf := new(bytes.Buffer)
+		count, err := db.Export(buf, format, DefaultExportOptions)
+		assert.Nil(t, err)
+		assert.Equal(t, 2501, count)
+
+		opts2 := DefaultOptions
+		dir2, _ := os.MkdirTemp("", "db-bitcask-import")
+		opts2.DirPath = dir2
+		db2, err := Open(opts2)
+		assert.Nil(t, err)
+
+		count, err = db2.Import(buf, format)
+		assert.Nil(t, err)
+		assert.Equal(t, 2501, count)
+		assert.Equal(t, 2501, len(db2.ListKeys()))
+		val, err := db.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		val2, err := db2.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		assert.Equal(t, val, val2)
+		val3, err := db2.Get([]byte{0, 1, 2, '\n', ','})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(val3))
+		destroyDB(db2)
+	}
+}
+
+func TestDB_Export_Filter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-export-filter")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		err := db.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	buf := new(bytes.Buffer)
+	count, err := db.Export(buf, ExportJSONL, ExportOptions{Prefix: []byte("a")})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	buf.Reset()
+	count, err = db.Export(buf, ExportCSV, ExportOptions{Start: []byte("a2"), End: []byte("b2")})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 4, len(strings.Split(strings.TrimSpace(buf.String()), "\n")))
+
+	_, err = db.Export(buf, 100, DefaultExportOptions)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestDB_Import_Invalid(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-import-invalid")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Import(strings.NewReader("{\"key\": \"not base64\"}\n"), ExportJSONL)
+	assert.Equal(t, ErrInvalidExportData, err)
+	_, err = db.Import(strings.NewReader("foo,bar\n"), ExportCSV)
+	assert.Equal(t, ErrInvalidExportData, err)
+	_, err = db.Import(strings.NewReader("not a dump"), ExportBinary)
+	assert.Equal(t, ErrInvalidExportData, err)
+
+	// 截断的二进制数据
+	buf := new(bytes.Buffer)
+	err = db.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	_, err = db.Export(buf, ExportBinary, DefaultExportOptions)
+	assert.Nil(t, err)
+	_, err = db.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-2]), ExportBinary)
+	assert.Equal(t, ErrInvalidExportData, err)
+
+	// 长度字段远大于实际的数据时只按照读到的数据分配内存
+	hostile := append([]byte{}, binaryExportMagic...)
+	hostile = binary.AppendUvarint(hostile, math.MaxUint32)
+	hostile = append(hostile, "short"...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = db.Import(bytes.NewReader(hostile), ExportBinary)
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, ErrInvalidExportData, err)
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 1024*1024)
+
+	format, err := ParseExportFormat("CSV")
+	assert.Nil(t, err)
+	assert.Equal(t, ExportCSV, format)
+	_, err = ParseExportFormat("xml")
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
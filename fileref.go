@@ -0,0 +1,101 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"sync"
+)
+
+// 迭代器以及流式读取会在多次调用之间保存数据的位置，merge 替换数据文件之后旧的位置仍然需要可以读取
+// 每次 merge 替换数据文件时版本加一，被替换的旧数据文件在之前的版本中打开的读取都关闭之后才会被删除
+type fileRefs struct {
+	mu      sync.Mutex
+	gen     uint64         // 当前的数据文件版本
+	readers map[uint64]int // 每个版本中仍然打开的迭代器以及流式读取的数量
+}
+
+// merge 替换下来、仍然可能被读取的旧数据文件
+type retiredFiles struct {
+	gen          uint64 // 替换之前的版本，不大于此版本的读取都关闭之后才可以删除
+	files        map[uint32]*data.DataFile
+	removeBefore uint32 // 删除时移除文件 id 小于此值的数据文件
+}
+
+func newFileRefs() *fileRefs {
+	return &fileRefs{readers: make(map[uint64]int)}
+}
+
+// 打开一个读取，返回当前的版本，关闭时需要调用 releaseFiles
+// 需要在读取索引中的位置之前调用，之后替换下来的数据文件在关闭之前不会被删除
+func (db *DB) acquireFiles() uint64 {
+	db.refs.mu.Lock()
+	defer db.refs.mu.Unlock()
+	db.refs.readers[db.refs.gen]++
+	return db.refs.gen
+}
+
+// 关闭一个读取，不再被任何读取使用的旧数据文件会被关闭并删除
+func (db *DB) releaseFiles(gen uint64) {
+	db.refs.mu.Lock()
+	db.refs.readers[gen]--
+	if db.refs.readers[gen] <= 0 {
+		delete(db.refs.readers, gen)
+	}
+	db.refs.mu.Unlock()
+
+	db.mu.RLock()
+	retired := len(db.retiredFiles)
+	db.mu.RUnlock()
+	if retired == 0 {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.backgroundError("remove_retired_files", db.removeRetiredFiles(false))
+}
+
+// merge 替换数据文件之后调用，调用方需要持有 db.mu
+// 没有读取在使用时直接关闭并删除，否则等到读取都关闭之后再删除
+func (db *DB) retireFiles(files map[uint32]*data.DataFile, removeBefore uint32) error {
+	db.refs.mu.Lock()
+	db.retiredFiles = append(db.retiredFiles, &retiredFiles{gen: db.refs.gen, files: files, removeBefore: removeBefore})
+	db.refs.gen++
+	db.refs.mu.Unlock()
+	return db.removeRetiredFiles(false)
+}
+
+// 关闭并删除已经没有读取在使用的旧数据文件，force 为 true 时删除所有的旧数据文件，调用方需要持有 db.mu
+func (db *DB) removeRetiredFiles(force bool) error {
+	db.refs.mu.Lock()
+	minGen := db.refs.gen
+	for gen := range db.refs.readers {
+		if gen < minGen {
+			minGen = gen
+		}
+	}
+	db.refs.mu.Unlock()
+
+	for len(db.retiredFiles) > 0 {
+		retired := db.retiredFiles[0]
+		if !force && retired.gen >= minGen {
+			break
+		}
+		for _, dataFile := range retired.files {
+			_ = dataFile.Close()
+		}
+		db.retiredFiles = db.retiredFiles[1:]
+		if err := db.removeDataFilesBefore(retired.removeBefore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 查找被替换下来的旧数据文件，调用方需要持有 db.mu
+func (db *DB) getRetiredFile(fid uint32) *data.DataFile {
+	for _, retired := range db.retiredFiles {
+		if dataFile, ok := retired.files[fid]; ok {
+			return dataFile
+		}
+	}
+	return nil
+}
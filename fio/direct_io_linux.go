@@ -0,0 +1,180 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// O_DIRECT 要求读写的内存地址、文件偏移和长度都按照块大小对齐
+const directIOAlignSize = 4096
+
+// DirectIO 使用 O_DIRECT 绕过页缓存的文件 IO
+// 写入时不足一个块的部分会补齐之后写入，所以文件在磁盘上的大小可能大于实际写入的数据大小
+// 最后一个不完整的块保存在内存中，下一次写入时和新的数据一起重新写入
+type DirectIO struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	size int64  // 实际写入的数据大小
+	tail []byte // 最后一个不完整的块的数据
+	buf  []byte // 写入时使用的对齐的缓冲区
+}
+
+// NewDirectIOManager 初始化 Direct IO
+func NewDirectIOManager(fileName string) (*DirectIO, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|unix.O_DIRECT, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	dio := &DirectIO{
+		fd:   fd,
+		size: stat.Size(),
+		tail: alignedBuffer(directIOAlignSize),
+	}
+	if err := dio.loadTail(); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return dio, nil
+}
+
+func (dio *DirectIO) Read(b []byte, offset int64) (int, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= dio.size {
+		return 0, io.EOF
+	}
+	end := offset + int64(len(b))
+	if end > dio.size {
+		end = dio.size
+	}
+
+	start := alignDown(offset)
+	buf := alignedBuffer(int(alignUp(end) - start))
+	n, err := dio.fd.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if int64(n) < end-start {
+		return 0, io.ErrUnexpectedEOF
+	}
+	copied := copy(b, buf[offset-start:end-start])
+	if copied < len(b) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+func (dio *DirectIO) Write(b []byte) (int, error) {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+
+	// 从最后一个不完整的块开始，连同新的数据一起按块写入
+	start := alignDown(dio.size)
+	tailLen := int(dio.size - start)
+	total := tailLen + len(b)
+	n := int(alignUp(int64(total)))
+	if len(dio.buf) < n {
+		dio.buf = alignedBuffer(n)
+	}
+	buf := dio.buf[:n]
+	copy(buf, dio.tail[:tailLen])
+	copy(buf[tailLen:], b)
+	// 补齐的部分写入 0，崩溃恢复时会被当作文件的末尾
+	for i := total; i < n; i++ {
+		buf[i] = 0
+	}
+	if _, err := dio.fd.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+
+	dio.size += int64(len(b))
+	lastBlock := int(alignDown(int64(total)))
+	copy(dio.tail, buf[lastBlock:total])
+	return len(b), nil
+}
+
+func (dio *DirectIO) Sync() error {
+	return unix.Fdatasync(int(dio.fd.Fd()))
+}
+
+// Close 将文件截断到实际写入的大小，去掉补齐和预先分配的部分
+func (dio *DirectIO) Close() error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if err := dio.fd.Truncate(dio.size); err != nil {
+		return err
+	}
+	return dio.fd.Close()
+}
+
+func (dio *DirectIO) Size() (int64, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	return dio.size, nil
+}
+
+func (dio *DirectIO) Truncate(size int64) error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if err := dio.fd.Truncate(size); err != nil {
+		return err
+	}
+	dio.size = size
+	return dio.loadTail()
+}
+
+// Preallocate 使用 fallocate 预先分配磁盘空间，不改变文件的大小
+// 文件系统不支持时忽略
+func (dio *DirectIO) Preallocate(size int64) error {
+	err := unix.Fallocate(int(dio.fd.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil
+	}
+	return err
+}
+
+// 从文件中读取最后一个不完整的块，调用方需要持有写锁或者在初始化时调用
+func (dio *DirectIO) loadTail() error {
+	start := alignDown(dio.size)
+	if start == dio.size {
+		return nil
+	}
+	n, err := dio.fd.ReadAt(dio.tail, start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if int64(n) < dio.size-start {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// 分配起始地址按照块大小对齐的缓冲区
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignSize)
+	offset := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignSize - 1)); remainder != 0 {
+		offset = directIOAlignSize - remainder
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directIOAlignSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directIOAlignSize - 1)
+}
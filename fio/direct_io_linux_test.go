@@ -0,0 +1,99 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDirectIO(t *testing.T, path string) *DirectIO {
+	dio, err := NewDirectIOManager(path)
+	if err == syscall.EINVAL {
+		t.Skip("the file system does not support O_DIRECT")
+	}
+	assert.Nil(t, err)
+	return dio
+}
+
+func TestDirectIO_ReadWrite(t *testing.T) {
+	path := filepath.Join("/tmp", "direct-io-a.data")
+	defer destroyFile(path)
+
+	dio := newTestDirectIO(t, path)
+	n, err := dio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	// 跨越多个块的写入
+	big := make([]byte, directIOAlignSize*2+10)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	_, err = dio.Write(big)
+	assert.Nil(t, err)
+	_, err = dio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Sync())
+
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10+len(big)), size)
+
+	b := make([]byte, 5)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	b2 := make([]byte, len(big))
+	_, err = dio.Read(b2, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, big, b2)
+	_, err = dio.Read(b, size-5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+	n, err = dio.Read(b, size-2)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+
+	// 关闭之后去掉补齐的部分
+	assert.Nil(t, dio.Close())
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, size, stat.Size())
+
+	// 重新打开之后继续追加
+	dio2 := newTestDirectIO(t, path)
+	_, err = dio2.Write([]byte("key-c"))
+	assert.Nil(t, err)
+	_, err = dio2.Read(b, size-5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+	_, err = dio2.Read(b, size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-c"), b)
+	assert.Nil(t, dio2.Close())
+}
+
+func TestDirectIO_TruncatePreallocate(t *testing.T) {
+	path := filepath.Join("/tmp", "direct-io-b.data")
+	defer destroyFile(path)
+
+	dio := newTestDirectIO(t, path)
+	assert.Nil(t, dio.Preallocate(1024*1024))
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	_, err = dio.Write([]byte("aabbcc"))
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Truncate(4))
+	_, err = dio.Write([]byte("dd"))
+	assert.Nil(t, err)
+	b := make([]byte, 6)
+	_, err = dio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aabbdd"), b)
+	assert.Nil(t, dio.Close())
+}
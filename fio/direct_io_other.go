@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fio
+
+import "errors"
+
+// NewDirectIOManager 初始化 Direct IO，目前只支持 Linux
+func NewDirectIOManager(fileName string) (IOManager, error) {
+	return nil, errors.New("direct io is only supported on linux")
+}
@@ -22,6 +22,15 @@ func TestNewFileIOManager(t *testing.T) {
 	assert.NotNil(t, fio)
 }
 
+func TestNewIOManager_Unsupported(t *testing.T) {
+	path := filepath.Join("/tmp", "unsupported.data")
+	defer destroyFile(path)
+
+	manager, err := NewIOManager(path, FileIOType(100))
+	assert.Equal(t, ErrUnsupportedIOType, err)
+	assert.Nil(t, manager)
+}
+
 func TestFileIO_Write(t *testing.T) {
 	path := filepath.Join("/tmp", "a.data")
 	fio, err := NewFileIOManager(path)
@@ -91,3 +100,18 @@ func TestFileIO_Close(t *testing.T) {
 	err = fio.Close()
 	assert.Nil(t, err)
 }
+
+func TestFileIO_Truncate(t *testing.T) {
+	path := filepath.Join("/tmp", "a.data")
+	fio, err := NewFileIOManager(path)
+	defer destroyFile(path)
+	assert.Nil(t, err)
+
+	_, err = fio.Write([]byte("aabbcc"))
+	assert.Nil(t, err)
+	err = fio.Truncate(2)
+	assert.Nil(t, err)
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), size)
+}
@@ -0,0 +1,154 @@
+package fio
+
+import (
+	"container/list"
+	"sync"
+)
+
+// HandleCache 限制同时打开的文件数量
+// 超过限制时按照 LRU 关闭没有在使用的文件，正在读写的文件不会被关闭，所以打开的数量可能暂时超过限制
+type HandleCache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // 已经打开的文件，最近使用的在前面
+	opens    uint64     // 累计打开文件的次数
+}
+
+// CachedIOManager 由 HandleCache 管理的 IOManager，在读写时才打开文件
+type CachedIOManager struct {
+	cache    *HandleCache
+	fileName string
+	ioType   FileIOType
+	manager  IOManager     // 已经打开的 IOManager，关闭时为 nil
+	refs     int           // 正在进行的读写数量
+	elem     *list.Element // 在 LRU 链表中的位置
+}
+
+// NewHandleCache 初始化 HandleCache，capacity 为同时打开的文件数量上限
+func NewHandleCache(capacity int) *HandleCache {
+	return &HandleCache{
+		capacity: capacity,
+		lru:      list.New(),
+	}
+}
+
+// Open 返回延迟打开的 IOManager，此时并不会打开文件
+func (c *HandleCache) Open(fileName string, ioType FileIOType) *CachedIOManager {
+	return &CachedIOManager{
+		cache:    c,
+		fileName: fileName,
+		ioType:   ioType,
+	}
+}
+
+// Stat 返回当前打开的文件数量以及累计打开文件的次数
+func (c *HandleCache) Stat() (open int, opens uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.opens
+}
+
+// 关闭最久没有使用并且没有在读写的文件，直到打开的数量不超过上限，调用方需要持有 c.mu
+func (c *HandleCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.lru.Len() > c.capacity; {
+		prev := elem.Prev()
+		m := elem.Value.(*CachedIOManager)
+		if m.refs == 0 {
+			// 只读的旧数据文件关闭失败不影响之后重新打开
+			_ = m.manager.Close()
+			m.manager = nil
+			c.lru.Remove(elem)
+			m.elem = nil
+		}
+		elem = prev
+	}
+}
+
+// 打开文件并增加引用计数，使用完之后需要调用 release
+func (m *CachedIOManager) acquire() (IOManager, error) {
+	c := m.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.manager == nil {
+		manager, err := NewIOManager(m.fileName, m.ioType)
+		if err != nil {
+			return nil, err
+		}
+		m.manager = manager
+		m.elem = c.lru.PushFront(m)
+		c.opens++
+	} else {
+		c.lru.MoveToFront(m.elem)
+	}
+	m.refs++
+	c.evict()
+	return m.manager, nil
+}
+
+func (m *CachedIOManager) release() {
+	c := m.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.refs--
+	c.evict()
+}
+
+func (m *CachedIOManager) Read(b []byte, offset int64) (int, error) {
+	manager, err := m.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer m.release()
+	return manager.Read(b, offset)
+}
+
+func (m *CachedIOManager) Write(b []byte) (int, error) {
+	manager, err := m.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer m.release()
+	return manager.Write(b)
+}
+
+func (m *CachedIOManager) Sync() error {
+	manager, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer m.release()
+	return manager.Sync()
+}
+
+// Close 关闭已经打开的文件，之后再次读写时会重新打开
+func (m *CachedIOManager) Close() error {
+	c := m.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.manager == nil {
+		return nil
+	}
+	err := m.manager.Close()
+	m.manager = nil
+	c.lru.Remove(m.elem)
+	m.elem = nil
+	return err
+}
+
+func (m *CachedIOManager) Size() (int64, error) {
+	manager, err := m.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer m.release()
+	return manager.Size()
+}
+
+func (m *CachedIOManager) Truncate(size int64) error {
+	manager, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer m.release()
+	return manager.Truncate(size)
+}
@@ -0,0 +1,84 @@
+package fio
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleCache(t *testing.T) {
+	cache := NewHandleCache(2)
+	var managers []*CachedIOManager
+	for i := 0; i < 4; i++ {
+		path := filepath.Join("/tmp", fmt.Sprintf("handle-cache-%d.data", i))
+		defer destroyFile(path)
+		fio, err := NewFileIOManager(path)
+		assert.Nil(t, err)
+		_, err = fio.Write([]byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+		assert.Nil(t, fio.Close())
+		managers = append(managers, cache.Open(path, StandardFIO))
+	}
+
+	// 延迟到读取时才打开文件
+	open, opens := cache.Stat()
+	assert.Equal(t, 0, open)
+	assert.Equal(t, uint64(0), opens)
+
+	b := make([]byte, 7)
+	for i, m := range managers {
+		_, err := m.Read(b, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(b))
+	}
+	open, opens = cache.Stat()
+	assert.Equal(t, 2, open)
+	assert.Equal(t, uint64(4), opens)
+
+	// 最近使用的文件仍然打开
+	_, err := managers[3].Read(b, 0)
+	assert.Nil(t, err)
+	_, opens = cache.Stat()
+	assert.Equal(t, uint64(4), opens)
+
+	// 正在使用的文件不会被关闭
+	m0, err := managers[0].acquire()
+	assert.Nil(t, err)
+	m1, err := managers[1].acquire()
+	assert.Nil(t, err)
+	open, _ = cache.Stat()
+	assert.Equal(t, 2, open)
+	m2, err := managers[2].acquire()
+	assert.Nil(t, err)
+	open, _ = cache.Stat()
+	assert.Equal(t, 3, open)
+	for i, m := range []IOManager{m0, m1, m2} {
+		_, err := m.Read(b, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(b))
+	}
+	managers[0].release()
+	managers[1].release()
+	managers[2].release()
+	open, _ = cache.Stat()
+	assert.Equal(t, 2, open)
+
+	// 批量读取
+	requests := make([]*ReadRequest, len(managers))
+	for i, m := range managers {
+		requests[i] = &ReadRequest{Manager: m, Buf: make([]byte, 7)}
+	}
+	ReadBatch(requests)
+	for i, req := range requests {
+		assert.Nil(t, req.Err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(req.Buf))
+	}
+
+	for _, m := range managers {
+		assert.Nil(t, m.Close())
+	}
+	open, _ = cache.Stat()
+	assert.Equal(t, 0, open)
+}
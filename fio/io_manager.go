@@ -1,7 +1,11 @@
 package fio
 
+import "errors"
+
 const DataFilePerm = 0644
 
+var ErrUnsupportedIOType = errors.New("unsupported io type")
+
 type FileIOType = byte
 
 const (
@@ -10,6 +14,15 @@ const (
 
 	// MemoryMap 内存文件映射
 	MemoryMap
+
+	// DirectFIO 使用 O_DIRECT 绕过页缓存，只支持 Linux
+	DirectFIO
+
+	// IOUringFIO 使用 io_uring 提交读写请求，不支持时使用标准文件 IO
+	IOUringFIO
+
+	// SegmentFIO 压缩的只读段文件，由旧的数据文件转换而来
+	SegmentFIO
 )
 
 // IOManager 抽象 IO 管理接口，可以接入不同的 IO 类型
@@ -23,16 +36,76 @@ type IOManager interface {
 	Close() error
 
 	Size() (int64, error)
+
+	// Truncate 将文件截断到指定的大小
+	Truncate(size int64) error
+}
+
+// Preallocator 可以预先分配磁盘空间的 IOManager
+type Preallocator interface {
+	Preallocate(size int64) error
+}
+
+// Flusher 会在内存中缓存写入的 IOManager，Flush 将缓存的写入一次提交到文件
+type Flusher interface {
+	Flush() error
+}
+
+// ReadRequest 批量读取中的一个请求，N 和 Err 为读取的结果
+type ReadRequest struct {
+	Manager IOManager
+	Buf     []byte
+	Offset  int64
+	N       int
+	Err     error
+}
+
+// ReadBatch 批量读取，支持 io_uring 的请求会一次提交，其他的请求逐个读取
+func ReadBatch(requests []*ReadRequest) {
+	// 延迟打开的文件在整个批次读取期间保持打开
+	batch := make([]*ReadRequest, 0, len(requests))
+	unwrapped := make([]*ReadRequest, len(requests))
+	for i, req := range requests {
+		cached, ok := req.Manager.(*CachedIOManager)
+		if !ok {
+			batch = append(batch, req)
+			continue
+		}
+		manager, err := cached.acquire()
+		if err != nil {
+			req.N, req.Err = 0, err
+			continue
+		}
+		defer cached.release()
+		unwrapped[i] = &ReadRequest{Manager: manager, Buf: req.Buf, Offset: req.Offset}
+		batch = append(batch, unwrapped[i])
+	}
+
+	readBatch(batch)
+	for i, req := range unwrapped {
+		if req != nil {
+			requests[i].N, requests[i].Err = req.N, req.Err
+		}
+	}
 }
 
-// NewIOManager 初始化 IOManager，目前只支持标准 FileIO
+// NewIOManager 初始化 IOManager
 func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
 	switch ioType {
 	case StandardFIO:
 		return NewFileIOManager(fileName)
 	case MemoryMap:
 		return NewMMapIOManager(fileName)
+	case DirectFIO:
+		return NewDirectIOManager(fileName)
+	case IOUringFIO:
+		if !IOUringAvailable() {
+			return NewFileIOManager(fileName)
+		}
+		return NewIOUringIOManager(fileName)
+	case SegmentFIO:
+		return NewSegmentIOManager(fileName)
 	default:
-		panic("unsupported io type")
+		return nil, ErrUnsupportedIOType
 	}
 }
@@ -0,0 +1,196 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// 缓存的写入超过这个大小时立即提交，限制占用的内存
+const uringMaxPendingSize = 1024 * 1024
+
+// IOUring 基于 io_uring 的文件 IO，读写请求通过共享的 ring 提交
+// 批量读取时多个请求一次提交，写入先缓存在内存中，Flush 或者 Sync 时一次提交，减少系统调用的次数
+type IOUring struct {
+	mu      sync.RWMutex
+	fd      *os.File
+	size    int64  // 文件的大小，写入的位置，包含还没有提交的写入
+	pending []byte // 还没有提交的写入，位于文件的末尾
+	err     error  // 提交缓存的写入失败之后，之后的写入都返回此错误
+}
+
+// IOUringAvailable 当前系统是否支持 io_uring
+func IOUringAvailable() bool {
+	_, err := getUringPool()
+	return err == nil
+}
+
+// NewIOUringIOManager 初始化 io_uring IO
+func NewIOUringIOManager(fileName string) (*IOUring, error) {
+	if _, err := getUringPool(); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return &IOUring{fd: fd, size: stat.Size()}, nil
+}
+
+func (iou *IOUring) Read(b []byte, offset int64) (int, error) {
+	req := &ReadRequest{Manager: iou, Buf: b, Offset: offset}
+	readBatch([]*ReadRequest{req})
+	return req.N, req.Err
+}
+
+// Write 将数据追加到缓存中，缓存超过 uringMaxPendingSize 时才提交
+func (iou *IOUring) Write(b []byte) (int, error) {
+	iou.mu.Lock()
+	defer iou.mu.Unlock()
+	if iou.err != nil {
+		return 0, iou.err
+	}
+	iou.pending = append(iou.pending, b...)
+	iou.size += int64(len(b))
+	if len(iou.pending) >= uringMaxPendingSize {
+		if err := iou.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush 一次提交所有缓存的写入
+func (iou *IOUring) Flush() error {
+	iou.mu.Lock()
+	defer iou.mu.Unlock()
+	return iou.flush()
+}
+
+func (iou *IOUring) Sync() error {
+	if err := iou.Flush(); err != nil {
+		return err
+	}
+	return iou.fd.Sync()
+}
+
+func (iou *IOUring) Close() error {
+	err := iou.Flush()
+	if e := iou.fd.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (iou *IOUring) Size() (int64, error) {
+	iou.mu.RLock()
+	defer iou.mu.RUnlock()
+	return iou.size, nil
+}
+
+func (iou *IOUring) Truncate(size int64) error {
+	iou.mu.Lock()
+	defer iou.mu.Unlock()
+	if err := iou.flush(); err != nil {
+		return err
+	}
+	if err := iou.fd.Truncate(size); err != nil {
+		return err
+	}
+	iou.size = size
+	return nil
+}
+
+// 提交缓存的写入，调用方需要持有 mu 的写锁
+func (iou *IOUring) flush() error {
+	if iou.err != nil {
+		return iou.err
+	}
+	if len(iou.pending) == 0 {
+		return nil
+	}
+	buf, offset := iou.pending, iou.size-int64(len(iou.pending))
+	for len(buf) > 0 {
+		op := &uringOp{opcode: uringOpWrite, fd: int32(iou.fd.Fd()), buf: buf, offset: offset}
+		var n int
+		if err := submitUringOps([]*uringOp{op}); err != nil {
+			// ring 不可用时退回到普通的系统调用
+			if n, err = iou.fd.WriteAt(buf, offset); err != nil {
+				iou.err = err
+				return err
+			}
+		} else if op.res < 0 {
+			iou.err = syscall.Errno(-op.res)
+			return iou.err
+		} else if op.res == 0 {
+			iou.err = io.ErrShortWrite
+			return iou.err
+		} else {
+			n = int(op.res)
+		}
+		// 部分写入时继续提交剩余的数据
+		buf = buf[n:]
+		offset += int64(n)
+	}
+	iou.pending = iou.pending[:0]
+	return nil
+}
+
+// 读取之前提交缓存的写入
+func (iou *IOUring) flushPending() error {
+	iou.mu.RLock()
+	pending := len(iou.pending) > 0 || iou.err != nil
+	iou.mu.RUnlock()
+	if !pending {
+		return nil
+	}
+	return iou.Flush()
+}
+
+// 使用 io_uring 的请求一次提交，其他的请求逐个读取
+func readBatch(requests []*ReadRequest) {
+	var ops []*uringOp
+	var uringRequests []*ReadRequest
+	for _, req := range requests {
+		iou, ok := req.Manager.(*IOUring)
+		if !ok {
+			req.N, req.Err = req.Manager.Read(req.Buf, req.Offset)
+			continue
+		}
+		if err := iou.flushPending(); err != nil {
+			req.N, req.Err = 0, err
+			continue
+		}
+		ops = append(ops, &uringOp{opcode: uringOpRead, fd: int32(iou.fd.Fd()), buf: req.Buf, offset: req.Offset})
+		uringRequests = append(uringRequests, req)
+	}
+	if len(ops) == 0 {
+		return
+	}
+
+	if err := submitUringOps(ops); err != nil {
+		for _, req := range uringRequests {
+			req.N, req.Err = req.Manager.(*IOUring).fd.ReadAt(req.Buf, req.Offset)
+		}
+		return
+	}
+	for i, req := range uringRequests {
+		res := ops[i].res
+		switch {
+		case res < 0:
+			req.N, req.Err = 0, syscall.Errno(-res)
+		case int(res) < len(req.Buf):
+			// 读取的数据不足时继续读取剩余的部分，直到遇到文件末尾
+			n, err := req.Manager.(*IOUring).fd.ReadAt(req.Buf[res:], req.Offset+int64(res))
+			req.N, req.Err = int(res)+n, err
+		default:
+			req.N, req.Err = int(res), nil
+		}
+	}
+}
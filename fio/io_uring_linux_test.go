@@ -0,0 +1,155 @@
+package fio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIOUring(t *testing.T, path string) *IOUring {
+	if !IOUringAvailable() {
+		t.Skip("io_uring is not available")
+	}
+	iou, err := NewIOUringIOManager(path)
+	assert.Nil(t, err)
+	return iou
+}
+
+func TestIOUring_ReadWrite(t *testing.T) {
+	path := filepath.Join("/tmp", "io-uring-a.data")
+	defer destroyFile(path)
+
+	iou := newTestIOUring(t, path)
+	n, err := iou.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	_, err = iou.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, iou.Sync())
+
+	size, err := iou.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	b := make([]byte, 5)
+	n, err = iou.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), b)
+	n, err = iou.Read(b, 8)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, iou.Truncate(5))
+	_, err = iou.Write([]byte("key-c"))
+	assert.Nil(t, err)
+	_, err = iou.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-c"), b)
+	assert.Nil(t, iou.Close())
+}
+
+func TestIOUring_Flush(t *testing.T) {
+	path := filepath.Join("/tmp", "io-uring-e.data")
+	defer destroyFile(path)
+
+	iou := newTestIOUring(t, path)
+	defer iou.Close()
+
+	// 写入先缓存在内存中，Flush 时一次提交
+	for i := 0; i < 10; i++ {
+		_, err := iou.Write([]byte(fmt.Sprintf("value-%04d", i)))
+		assert.Nil(t, err)
+	}
+	size, err := iou.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), size)
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+
+	assert.Nil(t, iou.Flush())
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), stat.Size())
+
+	// 读取之前会提交缓存的写入
+	_, err = iou.Write([]byte("value-0010"))
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = iou.Read(b, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-0010"), b)
+
+	// 缓存超过限制时立即提交
+	_, err = iou.Write(make([]byte, uringMaxPendingSize))
+	assert.Nil(t, err)
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(110+uringMaxPendingSize), stat.Size())
+}
+
+func TestReadBatch(t *testing.T) {
+	path1 := filepath.Join("/tmp", "io-uring-b.data")
+	path2 := filepath.Join("/tmp", "io-uring-c.data")
+	defer destroyFile(path1)
+	defer destroyFile(path2)
+
+	iou := newTestIOUring(t, path1)
+	defer iou.Close()
+	fio, err := NewFileIOManager(path2)
+	assert.Nil(t, err)
+	defer fio.Close()
+
+	// 超过队列深度的请求分多次提交
+	var requests []*ReadRequest
+	for i := 0; i < uringEntries*2; i++ {
+		value := []byte(fmt.Sprintf("value-%04d", i))
+		for _, manager := range []IOManager{iou, fio} {
+			_, err := manager.Write(value)
+			assert.Nil(t, err)
+			requests = append(requests, &ReadRequest{Manager: manager, Buf: make([]byte, len(value)), Offset: int64(i * len(value))})
+		}
+	}
+	requests = append(requests, &ReadRequest{Manager: iou, Buf: make([]byte, 10), Offset: 1 << 20})
+
+	ReadBatch(requests)
+	for i, req := range requests[:len(requests)-1] {
+		assert.Nil(t, req.Err)
+		assert.Equal(t, fmt.Sprintf("value-%04d", i/2), string(req.Buf))
+	}
+	last := requests[len(requests)-1]
+	assert.Equal(t, 0, last.N)
+	assert.Equal(t, io.EOF, last.Err)
+}
+
+func TestIOUring_Fallback(t *testing.T) {
+	path := filepath.Join("/tmp", "io-uring-d.data")
+	defer destroyFile(path)
+
+	// 模拟系统不支持 io_uring
+	_, _ = getUringPool()
+	pool, poolErr := uringPool, uringPoolErr
+	uringPool, uringPoolErr = nil, syscall.ENOSYS
+	defer func() {
+		uringPool, uringPoolErr = pool, poolErr
+	}()
+
+	manager, err := NewIOManager(path, IOUringFIO)
+	assert.Nil(t, err)
+	_, ok := manager.(*FileIO)
+	assert.True(t, ok)
+	_, err = manager.Write([]byte("value"))
+	assert.Nil(t, err)
+
+	req := &ReadRequest{Manager: manager, Buf: make([]byte, 5)}
+	ReadBatch([]*ReadRequest{req})
+	assert.Nil(t, req.Err)
+	assert.Equal(t, []byte("value"), req.Buf)
+	assert.Nil(t, manager.Close())
+}
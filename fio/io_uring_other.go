@@ -0,0 +1,21 @@
+//go:build !linux
+
+package fio
+
+import "errors"
+
+// IOUringAvailable 当前系统是否支持 io_uring
+func IOUringAvailable() bool {
+	return false
+}
+
+// NewIOUringIOManager 初始化 io_uring IO，目前只支持 Linux
+func NewIOUringIOManager(fileName string) (IOManager, error) {
+	return nil, errors.New("io_uring is only supported on linux")
+}
+
+func readBatch(requests []*ReadRequest) {
+	for _, req := range requests {
+		req.N, req.Err = req.Manager.Read(req.Buf, req.Offset)
+	}
+}
@@ -1,44 +1,167 @@
+//go:build unix
+
 package fio
 
 import (
-	"golang.org/x/exp/mmap"
+	"io"
 	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 映射区域每次扩容的最小值
+	mmapMinGrowSize = 1024 * 1024 // 1MB
+
+	// 映射区域每次扩容的最大值，超过之后按照固定大小扩容
+	mmapMaxGrowSize = 64 * 1024 * 1024 // 64MB
 )
 
-// MMap IO，内存文件映射
+// MMap IO，内存文件映射，支持读写
+// 写入时会预先扩大文件和映射区域，关闭时将文件截断到实际写入的大小
 type MMap struct {
-	readerAt *mmap.ReaderAt
+	mu   sync.RWMutex
+	fd   *os.File
+	data []byte // 映射的区域，长度即为文件在磁盘上的大小
+	size int64  // 实际写入的数据大小
 }
 
 // NewMMapIOManager 初始化 MMap IO
 func NewMMapIOManager(fileName string) (*MMap, error) {
-	_, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
 	if err != nil {
 		return nil, err
 	}
-	readerAt, err := mmap.Open(fileName)
+	stat, err := fd.Stat()
 	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	m := &MMap{fd: fd, size: stat.Size()}
+	if err := m.remap(stat.Size()); err != nil {
+		_ = fd.Close()
 		return nil, err
 	}
-	return &MMap{readerAt: readerAt}, nil
+	return m, nil
+}
+
+func (m *MMap) Read(b []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= m.size {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[offset:m.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MMap) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	end := m.size + int64(len(b))
+	if end > int64(len(m.data)) {
+		if err := m.grow(end); err != nil {
+			return 0, err
+		}
+	}
+	copy(m.data[m.size:end], b)
+	m.size = end
+	return len(b), nil
+}
+
+func (m *MMap) Sync() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.size == 0 {
+		return nil
+	}
+	return unix.Msync(m.data[:m.size], unix.MS_SYNC)
 }
 
-func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
-	return mmap.readerAt.ReadAt(b, offset)
+// Close 解除映射并将文件截断到实际写入的大小
+func (m *MMap) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if err := m.fd.Truncate(m.size); err != nil {
+		return err
+	}
+	return m.fd.Close()
 }
 
-func (mmap *MMap) Write([]byte) (int, error) {
-	panic("not implemented")
+func (m *MMap) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
 }
 
-func (mmap *MMap) Sync() error {
-	panic("not implemented")
+// Truncate 丢弃 size 之后的数据，同时收缩文件和映射区域
+func (m *MMap) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size < 0 || size > m.size {
+		return os.ErrInvalid
+	}
+	if err := m.remap(size); err != nil {
+		return err
+	}
+	m.size = size
+	return nil
 }
 
-func (mmap *MMap) Close() error {
-	return mmap.readerAt.Close()
+// 扩容到至少能容纳 end 字节的数据，调用方需要持有写锁
+func (m *MMap) grow(end int64) error {
+	capacity := int64(len(m.data))
+	growSize := capacity
+	if growSize < mmapMinGrowSize {
+		growSize = mmapMinGrowSize
+	}
+	if growSize > mmapMaxGrowSize {
+		growSize = mmapMaxGrowSize
+	}
+	capacity += growSize
+	if capacity < end {
+		capacity = end
+	}
+	return m.remap(capacity)
 }
 
-func (mmap *MMap) Size() (int64, error) {
-	return int64(mmap.readerAt.Len()), nil
+// 调整文件大小并重新映射，调用方需要持有写锁
+func (m *MMap) remap(capacity int64) error {
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	stat, err := m.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != capacity {
+		if err := m.fd.Truncate(capacity); err != nil {
+			return err
+		}
+	}
+	if capacity == 0 {
+		return nil
+	}
+	data, err := unix.Mmap(int(m.fd.Fd()), 0, int(capacity), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
 }
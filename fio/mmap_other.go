@@ -0,0 +1,52 @@
+//go:build !unix
+
+package fio
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/exp/mmap"
+)
+
+// MMap IO，内存文件映射，当前平台只支持读取
+type MMap struct {
+	readerAt *mmap.ReaderAt
+}
+
+// NewMMapIOManager 初始化 MMap IO
+func NewMMapIOManager(fileName string) (*MMap, error) {
+	_, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	readerAt, err := mmap.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &MMap{readerAt: readerAt}, nil
+}
+
+func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
+	return mmap.readerAt.ReadAt(b, offset)
+}
+
+func (mmap *MMap) Write([]byte) (int, error) {
+	return 0, errors.New("mmap write is not supported on this platform")
+}
+
+func (mmap *MMap) Sync() error {
+	return nil
+}
+
+func (mmap *MMap) Close() error {
+	return mmap.readerAt.Close()
+}
+
+func (mmap *MMap) Size() (int64, error) {
+	return int64(mmap.readerAt.Len()), nil
+}
+
+func (mmap *MMap) Truncate(int64) error {
+	return errors.New("mmap truncate is not supported on this platform")
+}
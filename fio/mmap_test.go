@@ -3,6 +3,7 @@ package fio
 import (
 	"github.com/stretchr/testify/assert"
 	"io"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -41,3 +42,64 @@ func TestMMap_Read(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 2, n2)
 }
+
+func TestMMap_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-b.data")
+	defer destroyFile(path)
+
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+
+	n, err := mmapIO.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	// 超过预先分配的大小之后重新映射
+	big := make([]byte, mmapMinGrowSize+100)
+	big[len(big)-1] = 'x'
+	_, err = mmapIO.Write(big)
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Sync())
+
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5+len(big)), size)
+	b := make([]byte, 5)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	_, err = mmapIO.Read(b[:1], size-1)
+	assert.Nil(t, err)
+	assert.Equal(t, byte('x'), b[0])
+	_, err = mmapIO.Read(b, size-1)
+	assert.Equal(t, io.EOF, err)
+
+	// 关闭之后文件被截断到实际写入的大小
+	assert.Nil(t, mmapIO.Close())
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, size, stat.Size())
+}
+
+func TestMMap_Truncate(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-c.data")
+	defer destroyFile(path)
+
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	_, err = mmapIO.Write([]byte("aabbcc"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mmapIO.Truncate(4))
+	assert.NotNil(t, mmapIO.Truncate(10))
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), stat.Size())
+
+	_, err = mmapIO.Write([]byte("dd"))
+	assert.Nil(t, err)
+	b := make([]byte, 6)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aabbdd"), b)
+	assert.Nil(t, mmapIO.Close())
+}
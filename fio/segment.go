@@ -0,0 +1,278 @@
+package fio
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// 段文件中每个压缩块对应的原始数据大小
+	segmentBlockSize = 64 * 1024 // 64KB
+
+	// 块索引中每一项的大小：压缩块的偏移 8 字节，压缩块的大小 4 字节，压缩块的 crc 4 字节
+	segmentIndexEntrySize = 16
+
+	// 文件末尾的 footer：块索引的偏移 8 字节，块数量 4 字节，块大小 4 字节，原始数据大小 8 字节，魔数 8 字节
+	segmentFooterSize = 32
+
+	segmentMagic uint64 = 0x626974636b736567 // "bitckseg"
+)
+
+var (
+	ErrSegmentCorrupted = errors.New("segment file is corrupted")
+	ErrSegmentReadOnly  = errors.New("segment file is read only")
+)
+
+// 块索引中的一项，原始数据中的偏移 offset 位于第 offset/blockSize 个块中
+type segmentBlock struct {
+	offset int64 // 压缩块在段文件中的偏移
+	size   uint32
+	crc    uint32
+}
+
+// Segment 只读的压缩段文件，由旧的数据文件按块压缩生成
+// 块索引记录了每个原始数据块对应的压缩块位置，读取时将原始数据中的偏移转换为压缩块，
+// 所以索引中记录的 LogRecordPos 在压缩之后仍然有效
+type Segment struct {
+	fd        *os.File
+	blocks    []segmentBlock
+	blockSize int64
+	size      int64 // 原始数据的大小
+
+	mu         sync.Mutex
+	cacheIndex int    // 最近一次解压的块，同一条记录的 header 和 key/value 通常在同一个块中
+	cacheData  []byte // 最近一次解压的块的数据
+}
+
+// NewSegmentIOManager 打开段文件并加载块索引
+func NewSegmentIOManager(fileName string) (*Segment, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	seg := &Segment{fd: fd, cacheIndex: -1}
+	if err := seg.loadIndex(); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (s *Segment) loadIndex() error {
+	stat, err := s.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < segmentFooterSize {
+		return ErrSegmentCorrupted
+	}
+	footer := make([]byte, segmentFooterSize)
+	if _, err := s.fd.ReadAt(footer, stat.Size()-segmentFooterSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[24:]) != segmentMagic {
+		return ErrSegmentCorrupted
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	blockNum := int64(binary.LittleEndian.Uint32(footer[8:]))
+	s.blockSize = int64(binary.LittleEndian.Uint32(footer[12:]))
+	s.size = int64(binary.LittleEndian.Uint64(footer[16:]))
+	if s.blockSize <= 0 || indexOffset+blockNum*segmentIndexEntrySize != stat.Size()-segmentFooterSize ||
+		blockNum != (s.size+s.blockSize-1)/s.blockSize {
+		return ErrSegmentCorrupted
+	}
+
+	index := make([]byte, blockNum*segmentIndexEntrySize)
+	if _, err := s.fd.ReadAt(index, indexOffset); err != nil {
+		return err
+	}
+	s.blocks = make([]segmentBlock, blockNum)
+	for i := range s.blocks {
+		entry := index[i*segmentIndexEntrySize:]
+		s.blocks[i] = segmentBlock{
+			offset: int64(binary.LittleEndian.Uint64(entry[0:])),
+			size:   binary.LittleEndian.Uint32(entry[8:]),
+			crc:    binary.LittleEndian.Uint32(entry[12:]),
+		}
+		if s.blocks[i].offset+int64(s.blocks[i].size) > indexOffset {
+			return ErrSegmentCorrupted
+		}
+	}
+	return nil
+}
+
+// Read 按照原始数据中的偏移读取，跨越多个块时依次解压
+func (s *Segment) Read(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= s.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(b) && offset < s.size {
+		block, err := s.readBlock(int(offset / s.blockSize))
+		if err != nil {
+			return n, err
+		}
+		copied := copy(b[n:], block[offset%s.blockSize:])
+		n += copied
+		offset += int64(copied)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 返回解压之后的块数据，调用方不能修改
+func (s *Segment) readBlock(i int) ([]byte, error) {
+	s.mu.Lock()
+	if s.cacheIndex == i {
+		data := s.cacheData
+		s.mu.Unlock()
+		return data, nil
+	}
+	s.mu.Unlock()
+
+	block := s.blocks[i]
+	compressed := make([]byte, block.size)
+	if _, err := s.fd.ReadAt(compressed, block.offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(compressed) != block.crc {
+		return nil, ErrSegmentCorrupted
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, err
+	}
+	expected := s.blockSize
+	if int64(i) == int64(len(s.blocks))-1 {
+		expected = s.size - int64(i)*s.blockSize
+	}
+	if int64(len(data)) != expected {
+		return nil, ErrSegmentCorrupted
+	}
+
+	s.mu.Lock()
+	s.cacheIndex, s.cacheData = i, data
+	s.mu.Unlock()
+	return data, nil
+}
+
+func (s *Segment) Write([]byte) (int, error) {
+	return 0, ErrSegmentReadOnly
+}
+
+func (s *Segment) Sync() error {
+	return nil
+}
+
+func (s *Segment) Close() error {
+	return s.fd.Close()
+}
+
+// Size 返回原始数据的大小
+func (s *Segment) Size() (int64, error) {
+	return s.size, nil
+}
+
+func (s *Segment) Truncate(int64) error {
+	return ErrSegmentReadOnly
+}
+
+// CreateSegmentFile 将 srcFileName 中的数据按块压缩写入段文件 destFileName
+// 先写入临时文件，持久化之后再重命名，所以 destFileName 存在时一定是完整的段文件
+func CreateSegmentFile(srcFileName, destFileName string) error {
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	tmpFileName := destFileName + ".tmp"
+	if err := writeSegment(src, tmpFileName); err != nil {
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	if err := os.Rename(tmpFileName, destFileName); err != nil {
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	return nil
+}
+
+func writeSegment(src io.Reader, fileName string) error {
+	dest, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dest.Close()
+	}()
+
+	var (
+		blocks     []segmentBlock
+		offset     int64
+		size       int64
+		compressed bytes.Buffer
+	)
+	writer, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	buf := make([]byte, segmentBlockSize)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			compressed.Reset()
+			writer.Reset(&compressed)
+			if _, err := writer.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := writer.Close(); err != nil {
+				return err
+			}
+			if _, err := dest.Write(compressed.Bytes()); err != nil {
+				return err
+			}
+			blocks = append(blocks, segmentBlock{
+				offset: offset,
+				size:   uint32(compressed.Len()),
+				crc:    crc32.ChecksumIEEE(compressed.Bytes()),
+			})
+			offset += int64(compressed.Len())
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	tail := make([]byte, len(blocks)*segmentIndexEntrySize+segmentFooterSize)
+	for i, block := range blocks {
+		entry := tail[i*segmentIndexEntrySize:]
+		binary.LittleEndian.PutUint64(entry[0:], uint64(block.offset))
+		binary.LittleEndian.PutUint32(entry[8:], block.size)
+		binary.LittleEndian.PutUint32(entry[12:], block.crc)
+	}
+	footer := tail[len(blocks)*segmentIndexEntrySize:]
+	binary.LittleEndian.PutUint64(footer[0:], uint64(offset))
+	binary.LittleEndian.PutUint32(footer[8:], uint32(len(blocks)))
+	binary.LittleEndian.PutUint32(footer[12:], segmentBlockSize)
+	binary.LittleEndian.PutUint64(footer[16:], uint64(size))
+	binary.LittleEndian.PutUint64(footer[24:], segmentMagic)
+	if _, err := dest.Write(tail); err != nil {
+		return err
+	}
+	return dest.Sync()
+}
@@ -0,0 +1,114 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegment_Read(t *testing.T) {
+	src := filepath.Join("/tmp", "segment-a.data")
+	dest := filepath.Join("/tmp", "segment-a.seg")
+	defer destroyFile(src)
+	defer destroyFile(dest)
+
+	// 超过多个块大小的数据，最后一个块不满
+	content := make([]byte, segmentBlockSize*3+100)
+	for i := range content {
+		content[i] = byte(i % 13)
+	}
+	err := os.WriteFile(src, content, DataFilePerm)
+	assert.Nil(t, err)
+
+	err = CreateSegmentFile(src, dest)
+	assert.Nil(t, err)
+	stat, err := os.Stat(dest)
+	assert.Nil(t, err)
+	assert.True(t, stat.Size() < int64(len(content)))
+
+	seg, err := NewIOManager(dest, SegmentFIO)
+	assert.Nil(t, err)
+	defer seg.Close()
+	size, err := seg.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	// 按照原始数据中的偏移随机读取，包括跨越块边界的读取
+	for i := 0; i < 100; i++ {
+		offset := rand.Int63n(int64(len(content)) - 200)
+		b := make([]byte, 200)
+		n, err := seg.Read(b, offset)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, n)
+		assert.Equal(t, content[offset:offset+200], b)
+	}
+	b := make([]byte, 10)
+	n, err := seg.Read(b, segmentBlockSize-5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, content[segmentBlockSize-5:segmentBlockSize+5], b)
+
+	// 读到文件末尾
+	n, err = seg.Read(b, int64(len(content))-4)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 4, n)
+	_, err = seg.Read(b, int64(len(content)))
+	assert.Equal(t, io.EOF, err)
+
+	// 段文件是只读的
+	_, err = seg.Write([]byte("a"))
+	assert.Equal(t, ErrSegmentReadOnly, err)
+	assert.Equal(t, ErrSegmentReadOnly, seg.Truncate(0))
+}
+
+func TestSegment_Empty(t *testing.T) {
+	src := filepath.Join("/tmp", "segment-b.data")
+	dest := filepath.Join("/tmp", "segment-b.seg")
+	defer destroyFile(src)
+	defer destroyFile(dest)
+
+	err := os.WriteFile(src, nil, DataFilePerm)
+	assert.Nil(t, err)
+	err = CreateSegmentFile(src, dest)
+	assert.Nil(t, err)
+
+	seg, err := NewSegmentIOManager(dest)
+	assert.Nil(t, err)
+	defer seg.Close()
+	size, err := seg.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+	_, err = seg.Read(make([]byte, 1), 0)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSegment_Corrupted(t *testing.T) {
+	src := filepath.Join("/tmp", "segment-c.data")
+	dest := filepath.Join("/tmp", "segment-c.seg")
+	defer destroyFile(src)
+	defer destroyFile(dest)
+
+	err := os.WriteFile(src, []byte("bitcask-kv segment"), DataFilePerm)
+	assert.Nil(t, err)
+	err = CreateSegmentFile(src, dest)
+	assert.Nil(t, err)
+
+	// 压缩块中的数据被修改
+	fd, err := os.OpenFile(dest, os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte{0xff}, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+	seg, err := NewSegmentIOManager(dest)
+	assert.Nil(t, err)
+	_, err = seg.Read(make([]byte, 5), 0)
+	assert.Equal(t, ErrSegmentCorrupted, err)
+	assert.Nil(t, seg.Close())
+
+	// 不是段文件
+	_, err = NewSegmentIOManager(src)
+	assert.Equal(t, ErrSegmentCorrupted, err)
+}
@@ -0,0 +1,242 @@
+package fio
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// io_uring 相关的常量，参考 linux/io_uring.h
+const (
+	uringOffSqRing = 0
+	uringOffCqRing = 0x8000000
+	uringOffSqes   = 0x10000000
+
+	uringEnterGetEvents = 1 << 0
+
+	uringOpRead  = 22
+	uringOpWrite = 23
+
+	uringSqeSize = 64
+	uringCqeSize = 16
+
+	// 每个 ring 的队列深度
+	uringEntries = 128
+)
+
+type uringSqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSqringOffsets
+	cqOff                                                                  uringCqringOffsets
+}
+
+type uringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad2        uint64
+}
+
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// 提交到 io_uring 的一个读写操作
+type uringOp struct {
+	opcode uint8
+	fd     int32
+	buf    []byte
+	offset int64
+	res    int32 // 读写的字节数，负数表示错误码
+}
+
+// uring 一个 io_uring 实例，提交和收割都在锁内完成
+type uring struct {
+	mu      sync.Mutex
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqeMem  []byte
+	params  uringParams
+	entries uint32
+	err     error // 提交失败之后 ring 的状态不再可信，之后的提交都直接返回此错误
+}
+
+var (
+	uringPoolOnce sync.Once
+	uringPool     chan *uring
+	uringPoolErr  error
+)
+
+// 所有使用 io_uring 的文件共享的 ring，数量和 CPU 核数相关
+func getUringPool() (chan *uring, error) {
+	uringPoolOnce.Do(func() {
+		size := runtime.GOMAXPROCS(0)
+		if size > 4 {
+			size = 4
+		}
+		pool := make(chan *uring, size)
+		for i := 0; i < size; i++ {
+			ring, err := newUring(uringEntries)
+			if err != nil {
+				for len(pool) > 0 {
+					(<-pool).close()
+				}
+				uringPoolErr = err
+				return
+			}
+			pool <- ring
+		}
+		uringPool = pool
+	})
+	return uringPool, uringPoolErr
+}
+
+// 提交一批读写操作并等待全部完成
+func submitUringOps(ops []*uringOp) error {
+	pool, err := getUringPool()
+	if err != nil {
+		return err
+	}
+	ring := <-pool
+	defer func() {
+		pool <- ring
+	}()
+	return ring.submit(ops)
+}
+
+func newUring(entries uint32) (*uring, error) {
+	r := &uring{}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r.fd = int(fd)
+	r.entries = r.params.sqEntries
+
+	var err error
+	sqSize := int(r.params.sqOff.array + r.params.sqEntries*4)
+	if r.sqRing, err = unix.Mmap(r.fd, uringOffSqRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, err
+	}
+	cqSize := int(r.params.cqOff.cqes + r.params.cqEntries*uringCqeSize)
+	if r.cqRing, err = unix.Mmap(r.fd, uringOffCqRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, err
+	}
+	sqeSize := int(r.params.sqEntries * uringSqeSize)
+	if r.sqeMem, err = unix.Mmap(r.fd, uringOffSqes, sqeSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *uring) close() {
+	for _, mem := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if mem != nil {
+			_ = unix.Munmap(mem)
+		}
+	}
+	_ = unix.Close(r.fd)
+}
+
+func (r *uring) submit(ops []*uringOp) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > int(r.entries) {
+			n = int(r.entries)
+		}
+		if err := r.submitChunk(ops[:n]); err != nil {
+			r.err = err
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// 一次提交不超过队列深度的操作，收割到所有的完成事件之后返回
+func (r *uring) submitChunk(ops []*uringOp) error {
+	sqTail := r.u32(r.sqRing, r.params.sqOff.tail)
+	sqMask := *r.u32(r.sqRing, r.params.sqOff.ringMask)
+	tail := atomic.LoadUint32(sqTail)
+	for i, op := range ops {
+		idx := (tail + uint32(i)) & sqMask
+		sqe := (*uringSqe)(unsafe.Pointer(&r.sqeMem[idx*uringSqeSize]))
+		*sqe = uringSqe{
+			opcode:   op.opcode,
+			fd:       op.fd,
+			off:      uint64(op.offset),
+			len:      uint32(len(op.buf)),
+			userData: uint64(i),
+		}
+		if len(op.buf) > 0 {
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&op.buf[0])))
+		}
+		*r.u32(r.sqRing, r.params.sqOff.array+idx*4) = idx
+	}
+	atomic.StoreUint32(sqTail, tail+uint32(len(ops)))
+
+	toSubmit, completed := len(ops), 0
+	cqHead := r.u32(r.cqRing, r.params.cqOff.head)
+	cqTail := r.u32(r.cqRing, r.params.cqOff.tail)
+	cqMask := *r.u32(r.cqRing, r.params.cqOff.ringMask)
+	for completed < len(ops) {
+		submitted, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit),
+			uintptr(len(ops)-completed), uringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR && errno != syscall.EAGAIN {
+			return errno
+		}
+		if errno == 0 {
+			toSubmit -= int(submitted)
+		}
+
+		head := atomic.LoadUint32(cqHead)
+		for ; head != atomic.LoadUint32(cqTail); head++ {
+			cqe := (*uringCqe)(unsafe.Pointer(&r.cqRing[r.params.cqOff.cqes+(head&cqMask)*uringCqeSize]))
+			ops[cqe.userData].res = cqe.res
+			completed++
+		}
+		atomic.StoreUint32(cqHead, head)
+	}
+	runtime.KeepAlive(ops)
+	return nil
+}
+
+func (r *uring) u32(mem []byte, offset uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[offset]))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	bitcask "db-bitcask"
+	"db-bitcask/metrics"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -104,7 +105,11 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	stat := db.Stat()
+	stat, err := db.Stat()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	writer.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(writer).Encode(stat)
 }
@@ -116,6 +121,7 @@ func main() {
 	http.HandleFunc("/bitcask/delete", handleDelete)
 	http.HandleFunc("/bitcask/listkeys", handleListKeys)
 	http.HandleFunc("/bitcask/stat", handleStat)
+	http.Handle("/metrics", metrics.Handler(db.Metrics()))
 
 	// 启动 HTTP 服务
 	_ = http.ListenAndServe("localhost:8080", nil)
@@ -24,41 +24,52 @@ func NewART() *AdaptiveRadixTree {
 	}
 }
 
-func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	art.lock.Lock()
 	oldValue, _ := art.tree.Insert(key, pos)
 	art.lock.Unlock()
 	if oldValue == nil {
-		return nil
+		return nil, nil
 	}
-	return oldValue.(*data.LogRecordPos)
+	return oldValue.(*data.LogRecordPos), nil
 }
 
-func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) CompareAndSwap(key []byte, oldPos, newPos *data.LogRecordPos) (bool, error) {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	value, found := art.tree.Search(key)
+	if !found || !samePos(value.(*data.LogRecordPos), oldPos) {
+		return false, nil
+	}
+	art.tree.Insert(key, newPos)
+	return true, nil
+}
+
+func (art *AdaptiveRadixTree) Get(key []byte) (*data.LogRecordPos, error) {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
 	value, found := art.tree.Search(key)
 	if !found {
-		return nil
+		return nil, nil
 	}
-	return value.(*data.LogRecordPos)
+	return value.(*data.LogRecordPos), nil
 }
 
-func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	art.lock.Lock()
 	oldValue, deleted := art.tree.Delete(key)
 	art.lock.Unlock()
 	if oldValue == nil {
-		return nil, false
+		return nil, false, nil
 	}
-	return oldValue.(*data.LogRecordPos), deleted
+	return oldValue.(*data.LogRecordPos), deleted, nil
 }
 
-func (art *AdaptiveRadixTree) Size() int {
+func (art *AdaptiveRadixTree) Size() (int, error) {
 	art.lock.RLock()
 	size := art.tree.Size()
 	art.lock.RUnlock()
-	return size
+	return size, nil
 }
 
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
@@ -18,12 +18,12 @@ type BPlusTree struct {
 }
 
 // NewBPlusTree 初始化 B+ 树索引
-func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+func NewBPlusTree(dirPath string, syncWrites bool) (*BPlusTree, error) {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
 	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, &OpError{Op: "open", Err: err}
 	}
 
 	// 创建对应的 bucket
@@ -31,28 +31,45 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
 		_, err := tx.CreateBucketIfNotExists(indexBucketName)
 		return err
 	}); err != nil {
-		panic("failed to create bucket in bptree")
+		_ = bptree.Close()
+		return nil, &OpError{Op: "create bucket", Err: err}
 	}
 
-	return &BPlusTree{tree: bptree}
+	return &BPlusTree{tree: bptree}, nil
 }
 
-func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	var oldVal []byte
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		oldVal = bucket.Get(key)
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
 	}); err != nil {
-		panic("failed to put value in bptree")
+		return nil, &OpError{Op: "put", Err: err}
 	}
 	if len(oldVal) == 0 {
-		return nil
+		return nil, nil
+	}
+	return data.DecodeLogRecordPos(oldVal), nil
+}
+
+func (bpt *BPlusTree) CompareAndSwap(key []byte, oldPos, newPos *data.LogRecordPos) (bool, error) {
+	var swapped bool
+	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		value := bucket.Get(key)
+		if len(value) == 0 || !samePos(data.DecodeLogRecordPos(value), oldPos) {
+			return nil
+		}
+		swapped = true
+		return bucket.Put(key, data.EncodeLogRecordPos(newPos))
+	}); err != nil {
+		return false, &OpError{Op: "compare and swap", Err: err}
 	}
-	return data.DecodeLogRecordPos(oldVal)
+	return swapped, nil
 }
 
-func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+func (bpt *BPlusTree) Get(key []byte) (*data.LogRecordPos, error) {
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -62,12 +79,12 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 		}
 		return nil
 	}); err != nil {
-		panic("failed to get value in bptree")
+		return nil, &OpError{Op: "get", Err: err}
 	}
-	return pos
+	return pos, nil
 }
 
-func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	var oldVal []byte
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -76,24 +93,24 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 		}
 		return nil
 	}); err != nil {
-		panic("failed to delete value in bptree")
+		return nil, false, &OpError{Op: "delete", Err: err}
 	}
 	if len(oldVal) == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	return data.DecodeLogRecordPos(oldVal), true
+	return data.DecodeLogRecordPos(oldVal), true, nil
 }
 
-func (bpt *BPlusTree) Size() int {
+func (bpt *BPlusTree) Size() (int, error) {
 	var size int
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("failed to get size in bptree")
+		return 0, &OpError{Op: "size", Err: err}
 	}
-	return size
+	return size, nil
 }
 
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
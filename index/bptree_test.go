@@ -15,16 +15,21 @@ func TestBPlusTree_Put(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
-	res1 := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	res1, err := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2 := tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	res2, err := tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	res3, err := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
 
-	res4 := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 7744, Offset: 883})
+	res4, err := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 7744, Offset: 883})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(123), res4.Fid)
 	assert.Equal(t, int64(999), res4.Offset)
 }
@@ -35,17 +40,21 @@ func TestBPlusTree_Get(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
-	pos := tree.Get([]byte("not exist"))
+	pos, err := tree.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos1)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 9884, Offset: 1232})
-	pos2 := tree.Get([]byte("aac"))
+	pos2, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
@@ -55,19 +64,23 @@ func TestBPlusTree_Delete(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
-	res1, ok1 := tree.Delete([]byte("not exist"))
+	res1, ok1, err := tree.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.False(t, ok1)
 	assert.Nil(t, res1)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	res2, ok2 := tree.Delete([]byte("aac"))
+	res2, ok2, err := tree.Delete([]byte("aac"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(123), res2.Fid)
 	assert.Equal(t, int64(999), res2.Offset)
 
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 }
 
@@ -77,15 +90,20 @@ func TestBPlusTree_Size(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
-	assert.Equal(t, 0, tree.Size())
+	size, err := tree.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
 
-	assert.Equal(t, 3, tree.Size())
+	size, err = tree.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, size)
 }
 
 func TestBPlusTree_Iterator(t *testing.T) {
@@ -94,7 +112,8 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
 	tree.Put([]byte("caac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("bbca"), &data.LogRecordPos{Fid: 123, Offset: 999})
@@ -108,3 +127,32 @@ func TestBPlusTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestBPlusTree_Error(t *testing.T) {
+	// 目录不存在时无法打开
+	_, err := NewBPlusTree(filepath.Join(os.TempDir(), "bptree-not-exist", "sub"), false)
+	var opErr *OpError
+	assert.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "open", opErr.Op)
+
+	path := filepath.Join(os.TempDir(), "bptree-error")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Close())
+
+	// 关闭之后读写返回错误而不是 panic
+	_, err = tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	assert.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "put", opErr.Op)
+	_, err = tree.Get([]byte("aac"))
+	assert.ErrorAs(t, err, &opErr)
+	_, _, err = tree.Delete([]byte("aac"))
+	assert.ErrorAs(t, err, &opErr)
+	_, err = tree.Size()
+	assert.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "size", opErr.Op)
+}
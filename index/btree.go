@@ -24,39 +24,52 @@ func NewBTree() *BTree {
 	}
 }
 
-func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	it := &Item{key: key, pos: pos}
 	bt.lock.Lock()
 	oldItem := bt.tree.ReplaceOrInsert(it)
 	bt.lock.Unlock()
 	if oldItem == nil {
-		return nil
+		return nil, nil
 	}
-	return oldItem.(*Item).pos
+	return oldItem.(*Item).pos, nil
 }
 
-func (bt *BTree) Get(key []byte) *data.LogRecordPos {
+func (bt *BTree) CompareAndSwap(key []byte, oldPos, newPos *data.LogRecordPos) (bool, error) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	btreeItem := bt.tree.Get(&Item{key: key})
+	if btreeItem == nil || !samePos(btreeItem.(*Item).pos, oldPos) {
+		return false, nil
+	}
+	bt.tree.ReplaceOrInsert(&Item{key: key, pos: newPos})
+	return true, nil
+}
+
+func (bt *BTree) Get(key []byte) (*data.LogRecordPos, error) {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
-		return nil
+		return nil, nil
 	}
-	return btreeItem.(*Item).pos
+	return btreeItem.(*Item).pos, nil
 }
 
-func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	it := &Item{key: key}
 	bt.lock.Lock()
 	oldItem := bt.tree.Delete(it)
 	bt.lock.Unlock()
 	if oldItem == nil {
-		return nil, false
+		return nil, false, nil
 	}
-	return oldItem.(*Item).pos, true
+	return oldItem.(*Item).pos, true, nil
 }
 
-func (bt *BTree) Size() int {
-	return bt.tree.Len()
+func (bt *BTree) Size() (int, error) {
+	return bt.tree.Len(), nil
 }
 
 func (bt *BTree) Iterator(reverse bool) Iterator {
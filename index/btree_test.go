@@ -10,13 +10,16 @@ import (
 func TestBTree_Put(t *testing.T) {
 	bt := NewBTree()
 
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, err := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
 
-	res3 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	res3, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	assert.Nil(t, err)
 	assert.Equal(t, res3.Fid, uint32(1))
 	assert.Equal(t, res3.Offset, int64(2))
 }
@@ -24,36 +27,45 @@ func TestBTree_Put(t *testing.T) {
 func TestBTree_Get(t *testing.T) {
 	bt := NewBTree()
 
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, err := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 
-	pos1 := bt.Get(nil)
+	pos1, err := bt.Get(nil)
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), pos1.Fid)
 	assert.Equal(t, int64(100), pos1.Offset)
 
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	res3, err := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Nil(t, err)
 	assert.Equal(t, res3.Fid, uint32(1))
 	assert.Equal(t, res3.Offset, int64(2))
 
-	pos2 := bt.Get([]byte("a"))
+	pos2, err := bt.Get([]byte("a"))
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), pos2.Fid)
 	assert.Equal(t, int64(3), pos2.Offset)
 }
 
 func TestBTree_Delete(t *testing.T) {
 	bt := NewBTree()
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, err := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2, ok1 := bt.Delete(nil)
+	res2, ok1, err := bt.Delete(nil)
+	assert.Nil(t, err)
 	assert.True(t, ok1)
 	assert.Equal(t, res2.Fid, uint32(1))
 	assert.Equal(t, res2.Offset, int64(100))
 
-	res3 := bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	res3, err := bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
-	res4, ok2 := bt.Delete([]byte("aaa"))
+	res4, ok2, err := bt.Delete([]byte("aaa"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, res4.Fid, uint32(22))
 	assert.Equal(t, res4.Offset, int64(33))
@@ -3,20 +3,42 @@ package index
 import (
 	"bytes"
 	"db-bitcask/data"
+	"errors"
 
 	"github.com/google/btree"
 )
 
-// Indexer 抽象索引接口
+var ErrUnsupportedIndexType = errors.New("unsupported index type")
+
+// OpError 存储在磁盘上的索引读写失败时返回的错误，Op 为失败的操作
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return "index " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Indexer 抽象索引接口，内存索引不会返回错误，存储在磁盘上的索引读写失败时返回 *OpError
 type Indexer interface {
-	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
+	// Put 返回 key 之前对应的位置，不存在时为 nil
+	Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error)
+
+	Get(key []byte) (*data.LogRecordPos, error)
 
-	Get(key []byte) *data.LogRecordPos
+	// Delete 返回 key 之前对应的位置以及 key 是否存在
+	Delete(key []byte) (*data.LogRecordPos, bool, error)
 
-	Delete(key []byte) (*data.LogRecordPos, bool)
+	// CompareAndSwap 只有 key 当前的位置和 oldPos 相同时才更新为 newPos，返回是否更新
+	CompareAndSwap(key []byte, oldPos, newPos *data.LogRecordPos) (bool, error)
 
 	// Size 索引中的数据量
-	Size() int
+	Size() (int, error)
 
 	// Iterator 索引迭代器
 	Iterator(reverse bool) Iterator
@@ -38,19 +60,24 @@ const (
 )
 
 // NewIndexer 根据类型初始化索引
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
+func NewIndexer(typ IndexType, dirPath string, sync bool) (Indexer, error) {
 	switch typ {
 	case Btree:
-		return NewBTree()
+		return NewBTree(), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPTree:
 		return NewBPlusTree(dirPath, sync)
 	default:
-		panic("unsupported index type")
+		return nil, ErrUnsupportedIndexType
 	}
 }
 
+// 位置是否指向同一条记录
+func samePos(a, b *data.LogRecordPos) bool {
+	return a != nil && b != nil && a.Fid == b.Fid && a.Offset == b.Offset
+}
+
 type Item struct {
 	key []byte
 	pos *data.LogRecordPos
@@ -0,0 +1,67 @@
+package index
+
+import (
+	"db-bitcask/data"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIndexer(t *testing.T) {
+	indexer, err := NewIndexer(Btree, os.TempDir(), false)
+	assert.Nil(t, err)
+	assert.IsType(t, &BTree{}, indexer)
+
+	indexer, err = NewIndexer(ART, os.TempDir(), false)
+	assert.Nil(t, err)
+	assert.IsType(t, &AdaptiveRadixTree{}, indexer)
+
+	_, err = NewIndexer(IndexType(100), os.TempDir(), false)
+	assert.Equal(t, ErrUnsupportedIndexType, err)
+}
+
+func TestIndexer_CompareAndSwap(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "indexer-cas")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	for _, typ := range []IndexType{Btree, ART, BPTree} {
+		indexer, err := NewIndexer(typ, path, false)
+		assert.Nil(t, err)
+
+		oldPos := &data.LogRecordPos{Fid: 1, Offset: 10, Size: 20}
+		newPos := &data.LogRecordPos{Fid: 5, Offset: 100, Size: 20}
+
+		// key 不存在时不更新
+		swapped, err := indexer.CompareAndSwap([]byte("aac"), oldPos, newPos)
+		assert.Nil(t, err)
+		assert.False(t, swapped)
+		pos, err := indexer.Get([]byte("aac"))
+		assert.Nil(t, err)
+		assert.Nil(t, pos)
+
+		_, err = indexer.Put([]byte("aac"), oldPos)
+		assert.Nil(t, err)
+		swapped, err = indexer.CompareAndSwap([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 10}, newPos)
+		assert.Nil(t, err)
+		assert.True(t, swapped)
+		pos, err = indexer.Get([]byte("aac"))
+		assert.Nil(t, err)
+		assert.Equal(t, newPos.Fid, pos.Fid)
+		assert.Equal(t, newPos.Offset, pos.Offset)
+
+		// 位置已经变化时不更新
+		swapped, err = indexer.CompareAndSwap([]byte("aac"), oldPos, &data.LogRecordPos{Fid: 6, Offset: 0})
+		assert.Nil(t, err)
+		assert.False(t, swapped)
+		pos, err = indexer.Get([]byte("aac"))
+		assert.Nil(t, err)
+		assert.Equal(t, newPos.Fid, pos.Fid)
+
+		assert.Nil(t, indexer.Close())
+	}
+}
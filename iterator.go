@@ -2,6 +2,7 @@ package db_bitcask
 
 import (
 	"bytes"
+	"db-bitcask/data"
 	"db-bitcask/index"
 )
 
@@ -10,69 +11,170 @@ type Iterator struct {
 	indexIter index.Iterator // 索引迭代器
 	db        *DB
 	options   IteratorOptions
+	prefetch  []*prefetchEntry // 预读的数据，只在 PrefetchSize 大于 0 时使用
+	head      int              // 当前遍历位置在 prefetch 中的下标
+	gen       uint64           // 创建时的数据文件版本，关闭之前 merge 替换下来的旧数据文件不会被删除
+	closed    bool
+}
+
+// 预读的一条数据，value 在第一次访问时和之后的数据一起批量读取
+type prefetchEntry struct {
+	key    []byte
+	pos    *data.LogRecordPos
+	value  []byte
+	loaded bool
 }
 
 // NewIterator 初始化迭代器
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	gen := db.acquireFiles()
 	indexIter := db.index.Iterator(opts.Reverse)
-	return &Iterator{
+	it := &Iterator{
 		db:        db,
 		indexIter: indexIter,
 		options:   opts,
+		gen:       gen,
 	}
+	it.resetPrefetch()
+	return it
 }
 
 // Rewind 重新回到迭代器的起点
 func (it *Iterator) Rewind() {
 	it.indexIter.Rewind()
 	it.skipToNext()
+	it.resetPrefetch()
 }
 
 // Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
 func (it *Iterator) Seek(key []byte) {
 	it.indexIter.Seek(key)
 	it.skipToNext()
+	it.resetPrefetch()
 }
 
 // Next 跳转到下一个 key
 func (it *Iterator) Next() {
+	if it.options.PrefetchSize > 0 {
+		it.head++
+		if it.head >= len(it.prefetch) {
+			it.resetPrefetch()
+		}
+		return
+	}
 	it.indexIter.Next()
 	it.skipToNext()
 }
 
 // Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
 func (it *Iterator) Valid() bool {
+	if it.options.PrefetchSize > 0 {
+		return it.head < len(it.prefetch)
+	}
 	return it.indexIter.Valid()
 }
 
 // Key 当前遍历位置的 Key 数据
 func (it *Iterator) Key() []byte {
+	if it.options.PrefetchSize > 0 {
+		return it.prefetch[it.head].key
+	}
 	return it.indexIter.Key()
 }
 
 // Value 当前遍历位置的 Value 数据
 func (it *Iterator) Value() ([]byte, error) {
+	if it.options.PrefetchSize > 0 {
+		return it.prefetchValue()
+	}
 	logRecordPos := it.indexIter.Value()
 	it.db.mu.RLock()
 	defer it.db.mu.RUnlock()
 	return it.db.getValueByPosition(logRecordPos)
 }
 
+// Meta 当前遍历位置的元数据
+func (it *Iterator) Meta() (*Meta, error) {
+	logRecordPos := it.position()
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	logRecord, err := it.db.readLogRecord(logRecordPos)
+	if err != nil {
+		return nil, err
+	}
+	return newMeta(logRecord), nil
+}
+
 // Close 关闭迭代器，释放相应资源
 func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
 	it.indexIter.Close()
+	it.db.releaseFiles(it.gen)
 }
 
 func (it *Iterator) skipToNext() {
+	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		if it.matches(it.indexIter.Key()) {
+			break
+		}
+	}
+}
+
+// key 是否需要被遍历，跳过二级索引的数据以及不符合前缀的数据
+func (it *Iterator) matches(key []byte) bool {
+	if isSecondaryIndexKey(key) {
+		return false
+	}
 	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
+	return prefixLen == 0 || prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0
+}
+
+// 当前遍历位置的索引信息
+func (it *Iterator) position() *data.LogRecordPos {
+	if it.options.PrefetchSize > 0 {
+		return it.prefetch[it.head].pos
+	}
+	return it.indexIter.Value()
+}
+
+// 丢弃已经遍历过的数据，从索引迭代器中取出之后的 PrefetchSize 条数据
+func (it *Iterator) resetPrefetch() {
+	if it.options.PrefetchSize <= 0 {
 		return
 	}
+	it.prefetch = it.prefetch[:0]
+	it.head = 0
+	for ; it.indexIter.Valid() && len(it.prefetch) < it.options.PrefetchSize; it.indexIter.Next() {
+		if it.matches(it.indexIter.Key()) {
+			it.prefetch = append(it.prefetch, &prefetchEntry{key: it.indexIter.Key(), pos: it.indexIter.Value()})
+		}
+	}
+}
 
-	for ; it.indexIter.Valid(); it.indexIter.Next() {
-		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			break
+// 读取当前位置的 value，还没有读取时批量读取当前位置之后所有预读数据的 value
+func (it *Iterator) prefetchValue() ([]byte, error) {
+	entry := it.prefetch[it.head]
+	if !entry.loaded {
+		entries := it.prefetch[it.head:]
+		positions := make([]*data.LogRecordPos, len(entries))
+		for i, e := range entries {
+			positions[i] = e.pos
+		}
+		it.db.mu.RLock()
+		values, err := it.db.getValuesByPositions(positions)
+		it.db.mu.RUnlock()
+		if err != nil {
+			return nil, err
 		}
+		for i, e := range entries {
+			e.value, e.loaded = values[i], true
+		}
+	}
+	if entry.value == nil {
+		return nil, ErrKeyNotFound
 	}
+	return entry.value, nil
 }
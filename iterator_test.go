@@ -97,3 +97,72 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 	}
 	iter3.Close()
 }
+
+func TestDB_Iterator_Meta(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-iterator-meta")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithFlags(utils.GetTestKey(1), utils.RandomValue(10), 7)
+	assert.Nil(t, err)
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	assert.True(t, iterator.Valid())
+	meta, err := iterator.Meta()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), meta.Flags)
+	assert.False(t, meta.Timestamp.IsZero())
+}
+
+func TestDB_Iterator_Prefetch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-iterator-prefetch")
+	opts.DirPath = dir
+	opts.IOType = IOUring
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("other"), []byte("other"))
+	assert.Nil(t, err)
+
+	for _, reverse := range []bool{false, true} {
+		iterOpts := IteratorOptions{Prefix: []byte("bitcask-go-key"), Reverse: reverse, PrefetchSize: 16}
+		iter := db.NewIterator(iterOpts)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, iter.Key(), val)
+			meta, err := iter.Meta()
+			assert.Nil(t, err)
+			assert.NotNil(t, meta)
+			count++
+		}
+		iter.Close()
+		assert.Equal(t, 100, count)
+	}
+
+	iter := db.NewIterator(IteratorOptions{PrefetchSize: 8})
+	defer iter.Close()
+	iter.Seek(utils.GetTestKey(50))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, utils.GetTestKey(50), iter.Key())
+	// 只访问 key 不读取 value
+	for i := 0; i < 20; i++ {
+		iter.Next()
+	}
+	val, err := iter.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(70), val)
+}
@@ -0,0 +1,32 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LogInfo)
+
+	logger.Log(LogDebug, "hidden")
+	assert.Equal(t, 0, buf.Len())
+
+	logger.Log(LogWarn, "slow operation", "op", "put", "err", errors.New("disk is full"), "fid")
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, "time="))
+	assert.True(t, strings.HasSuffix(line, "\n"))
+	assert.Contains(t, line, ` level=warn msg="slow operation" op=put err="disk is full" fid="(MISSING)"`)
+}
+
+func TestLogLevel_String(t *testing.T) {
+	assert.Equal(t, "debug", LogDebug.String())
+	assert.Equal(t, "info", LogInfo.String())
+	assert.Equal(t, "warn", LogWarn.String())
+	assert.Equal(t, "error", LogError.String())
+	assert.Equal(t, "unknown", LogLevel(10).String())
+}
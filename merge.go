@@ -1,6 +1,7 @@
 package db_bitcask
 
 import (
+	"context"
 	"db-bitcask/data"
 	"db-bitcask/utils"
 	"io"
@@ -9,77 +10,160 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	mergeDirName     = "-merge"
 	mergeFinishedKey = "merge.finished"
+	mergeFileIdKey   = "merge.fid"
+
+	// 替换 merge 的数据文件时每批更新的索引数量，每批之间释放锁，避免长时间阻塞读写
+	mergeSwapBatchSize = 1024
 )
 
+// merge 重写的一条记录，替换时只有索引中的位置仍然是 oldPos 才更新为 newPos
+type mergedRecord struct {
+	key    []byte
+	oldPos *data.LogRecordPos
+	newPos *data.LogRecordPos
+}
+
 // Merge 清理无效数据，生成 Hint 文件
+// merge 的过程中可以正常读写，完成之后新的数据文件直接替换正在使用的旧数据文件，不需要重新打开数据库
+// 之前创建的迭代器和流式读取仍然可以读取旧的位置，旧的数据文件在它们都关闭之后才会被删除
 func (db *DB) Merge() error {
+	return db.MergeCtx(context.Background())
+}
+
+// MergeCtx 和 Merge 相同，每个数据文件以及每条记录之间检查 ctx，取消时返回 ctx.Err()
+// 中途取消时 merge 目录中没有完成标识，下次打开或者 merge 时会被清理，不影响原有的数据
+func (db *DB) MergeCtx(ctx context.Context) (err error) {
+	defer db.metrics.merge.observe(time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	// 重写期间旧的数据文件不能被移动到冷存储目录或者压缩
+	db.moveMu.RLock()
+	// 等待正在进行的流式写入完成，避免分块和头部记录被拆分到 merge 范围的两侧
+	db.streamMu.Lock()
+	db.mu.Lock()
 	// 如果数据库为空，则直接返回
 	if db.activeFile == nil {
+		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return nil
 	}
-	db.mu.Lock()
 	// 如果 merge 正在进行当中，则直接返回
 	if db.isMerging {
 		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return ErrMergeIsProgress
 	}
 
 	// 查看可以 merge 的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.totalDirSize()
 	if err != nil {
 		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return err
 	}
 	if float32(db.reclaimSize)/float32(totalSize) < db.options.DataFileMergeRatio {
 		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return ErrMergeRatioUnreached
 	}
 
 	// 查看剩余的空间容量是否可以容纳 merge 之后的数据量
-	availableDiskSize, err := utils.AvailableDiskSize()
+	availableSize, err := availableDiskSize(db.options.DirPath)
 	if err != nil {
 		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return err
 	}
-	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
+	// 压缩之后的段文件比原始数据小，无效数据量可能超过目录的大小
+	mergeSize := totalSize - db.reclaimSize
+	if mergeSize < 0 {
+		mergeSize = 0
+	}
+	if uint64(mergeSize) >= availableSize {
 		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return ErrNoEnoughSpaceForMerge
 	}
 
 	db.isMerging = true
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
 	}()
 
-	// 持久化当前活跃文件转化为旧的
-	if err := db.activeFile.Sync(); err != nil {
+	// 取出所有需要 merge 的文件，包括当前的活跃文件
+	sealedFile := db.activeFile
+	mergeFiles := []*data.DataFile{sealedFile}
+	for _, file := range db.olderFiles {
+		mergeFiles = append(mergeFiles, file)
+	}
+
+	// merge 的输出使用活跃文件之后预留的文件 id，不会和正在使用的数据文件重复，新的活跃文件从预留的范围之后开始
+	// 重写之后的数据量不会超过原有的数据，预留两倍的文件数量可以容纳输出的所有数据文件
+	mergeFileId := sealedFile.FileId + 1
+	nonMergeFileId := mergeFileId + uint32(2*len(mergeFiles))
+	if err := db.setActiveDataFileWithId(nonMergeFileId); err != nil {
 		db.mu.Unlock()
+		db.streamMu.Unlock()
+		db.moveMu.RUnlock()
 		return err
 	}
+	db.olderFiles[sealedFile.FileId] = sealedFile
+	db.fileRotated(sealedFile)
+	reclaimSize := db.reclaimSize
+	db.mu.Unlock()
+	db.streamMu.Unlock()
 
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	db.mergeBegin(MergeBeginInfo{FileNum: len(mergeFiles), ReclaimableSize: reclaimSize, TotalSize: totalSize})
+	defer func(start time.Time) {
+		db.mergeEnd(start, err)
+	}(time.Now())
 
-	// 打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
-		db.mu.Unlock()
-		return nil
+	// 持久化之前的活跃文件时不持有锁，不阻塞写入
+	if err := db.syncDataFile(sealedFile); err != nil {
+		db.moveMu.RUnlock()
+		return err
+	}
+	db.mu.Lock()
+	err = db.sealDataFile(sealedFile)
+	db.mu.Unlock()
+	if err != nil {
+		db.moveMu.RUnlock()
+		return err
 	}
-	// 记录最近没有参与 merge 的文件 id
-	nonMergeFileId := db.activeFile.FileId
 
-	// 取出所有需要 merge 的文件
-	var mergeFiles []*data.DataFile
-	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
+	merged, err := db.rewriteMergeFiles(ctx, mergeFiles, mergeFileId, nonMergeFileId)
+	db.moveMu.RUnlock()
+	if err != nil {
+		return err
 	}
-	db.mu.Unlock()
-	// 把文件读取后就关闭掉
 
+	// 替换数据文件时和备份互斥
+	db.moveMu.Lock()
+	defer db.moveMu.Unlock()
+	return db.swapMergeFiles(mergeFiles, merged, reclaimSize)
+}
+
+// 将有效的数据重写到 merge 目录中，并生成 hint 文件以及标识 merge 完成的文件
+func (db *DB) rewriteMergeFiles(ctx context.Context, mergeFiles []*data.DataFile, mergeFileId, nonMergeFileId uint32) (merged []*mergedRecord, err error) {
 	// 先排序
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
@@ -90,55 +174,96 @@ func (db *DB) Merge() error {
 	// 保存新的merge
 	if _, err := os.Stat(mergePath); err == nil {
 		if err := os.RemoveAll(mergePath); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	// 新建一个 merge path 的目录
 	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
-		return err
+		return nil, err
 	}
 	// 打开一个新的临时 bitcask 实例
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	// merge 的输出在替换时根据策略放到对应的目录中
+	mergeOptions.ColdDirPath = ""
+	mergeOptions.CompressSealedFiles = false
+	// 磁盘空间在 merge 开始之前已经检查过，临时实例不检查，避免写满时 merge 无法进行
+	mergeOptions.DiskSoftLimit = 0
+	mergeOptions.DiskHardLimit = 0
+	// 临时实例的内部事件不需要通知用户
+	mergeOptions.Logger = nil
+	mergeOptions.EventListener = EventListener{}
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
+	// 从预留的文件 id 开始写入
+	if err := mergeDB.setActiveDataFileWithId(mergeFileId); err != nil {
+		return nil, err
 	}
 
 	// 打开 hint 文件存储索引
 	hintFile, err := data.OpenHintFile(mergePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
 	// 遍历处理每个数据文件
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
 		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
-				return err
+				return nil, err
+			}
+			if err := db.rateLimiter.WaitN(ctx, size); err != nil {
+				return nil, err
 			}
 			// 解析拿到实际的 key
 			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
+			logRecordPos, err := db.index.Get(realKey)
+			if err != nil {
+				return nil, err
+			}
 			// 和内存中的索引位置进行比较，如果有效则重写
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
 				logRecordPos.Offset == offset {
-				// 清除事务标记
-				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				pos, err := mergeDB.appendLogRecord(logRecord)
+				var pos *data.LogRecordPos
+				if logRecord.Type == data.LogRecordStream {
+					// 流式写入的数据需要连同分块一起重写
+					pos, err = db.mergeStream(mergeDB, realKey, logRecord)
+				} else {
+					// 清除事务标记
+					logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+					pos, err = mergeDB.appendLogRecord(logRecord)
+				}
 				if err != nil {
-					return err
+					return nil, err
+				}
+				if pos.Fid >= nonMergeFileId {
+					return nil, ErrMergeOutputTooLarge
+				}
+				if err := db.rateLimiter.WaitN(ctx, int64(pos.Size)); err != nil {
+					return nil, err
 				}
 				// 将当前位置索引写到 Hint 文件当中
 				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
-					return err
+					return nil, err
 				}
+				merged = append(merged, &mergedRecord{key: realKey, oldPos: logRecordPos, newPos: pos})
 			}
 			// 增加 offset
 			offset += size
@@ -147,30 +272,110 @@ func (db *DB) Merge() error {
 
 	// sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 	if err := mergeDB.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 
-	// 写标识 merge 完成的文件
+	// 写标识 merge 完成的文件，同时记录 merge 输出的第一个数据文件 id
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	for _, record := range []*data.LogRecord{
+		{Key: []byte(mergeFinishedKey), Value: []byte(strconv.Itoa(int(nonMergeFileId)))},
+		{Key: []byte(mergeFileIdKey), Value: []byte(strconv.Itoa(int(mergeFileId)))},
+	} {
+		encRecord, _ := data.EncodeLogRecord(record)
+		if err := mergeFinishedFile.Write(encRecord); err != nil {
+			return nil, err
+		}
 	}
-	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
-	if err := mergeFinishedFile.Write(encRecord); err != nil {
+	if err := mergeFinishedFile.Sync(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// 将 merge 生成的数据文件替换到正在使用的数据库中
+// 先打开新的数据文件，再分批更新索引中仍然指向旧位置的数据，最后替换下旧的数据文件
+// 旧的数据文件在替换之前打开的迭代器以及流式读取都关闭之后才会被关闭并删除
+// 中途失败时 merge 目录中的完成标识还在，下次打开时会继续完成替换
+func (db *DB) swapMergeFiles(mergeFiles []*data.DataFile, merged []*mergedRecord, reclaimSize int64) error {
+	mergePath := db.getMergePath()
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Sync(); err != nil {
+	fileIds, err := db.moveMergeDataFiles(mergePath, nonMergeFileId)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	db.mu.Lock()
+	for _, fid := range fileIds {
+		ioManager, err := db.newOlderIOManager(fid, db.options.IOType)
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		db.olderFiles[fid] = data.NewDataFile(fid, ioManager)
+	}
+	db.mu.Unlock()
+
+	// 重写之后被覆盖或者删除的数据位置已经变化，不会被更新
+	for start := 0; start < len(merged); start += mergeSwapBatchSize {
+		end := start + mergeSwapBatchSize
+		if end > len(merged) {
+			end = len(merged)
+		}
+		db.mu.Lock()
+		for _, record := range merged[start:end] {
+			if _, err := db.index.CompareAndSwap(record.key, record.oldPos, record.newPos); err != nil {
+				db.mu.Unlock()
+				return err
+			}
+		}
+		db.mu.Unlock()
+	}
+
+	mergeFileId, err := db.getMergeFileId(mergePath)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	retired := make(map[uint32]*data.DataFile, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		if older, ok := db.olderFiles[dataFile.FileId]; ok {
+			delete(db.olderFiles, dataFile.FileId)
+			retired[dataFile.FileId] = older
+		}
+	}
+	// 旧数据文件中的无效数据已经被清理，只保留 merge 期间新增的部分
+	// 重写之前已经被覆盖的数据也计算在新增的部分中，所以是一个近似值
+	db.reclaimSize -= reclaimSize
+	if db.reclaimSize < 0 {
+		db.reclaimSize = 0
+	}
+	if db.valueCache != nil {
+		db.valueCache.purge()
+	}
+	if err := db.installMergeFiles(mergePath, false); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	db.compactedFileId = mergeFileId
+	// 旧数据文件在仍然打开的迭代器以及流式读取都关闭之后才会被删除
+	err = db.retireFiles(retired, mergeFileId)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(mergePath)
 }
 
 func (db *DB) getMergePath() string {
@@ -180,7 +385,19 @@ func (db *DB) getMergePath() string {
 }
 
 // 加载 merge 数据目录
+// merge 完成之后没有替换完数据文件就退出时，打开时继续完成替换
 func (db *DB) loadMergeFiles() error {
+	// 上一次 merge 替换之后还有读取在使用，没有来得及删除的旧数据文件
+	if _, err := os.Stat(filepath.Join(db.options.DirPath, data.MergeFinishedFileName)); err == nil {
+		mergeFileId, err := db.getMergeFileId(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		if err := db.removeDataFilesBefore(mergeFileId); err != nil {
+			return err
+		}
+	}
+
 	mergePath := db.getMergePath()
 	// merge 目录不存在的话直接返回
 	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
@@ -190,55 +407,117 @@ func (db *DB) loadMergeFiles() error {
 		_ = os.RemoveAll(mergePath)
 	}()
 
-	dirEntries, err := os.ReadDir(mergePath)
+	// 标识 merge 完成的文件不存在或者没有写完，说明 merge 没有完成，直接返回
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err != nil {
+		return nil
+	}
+	if _, err := db.getNonMergeFileId(mergePath); err != nil {
+		return nil
+	}
+	if _, err := db.getMergeFileId(mergePath); err != nil {
+		return nil
+	}
+	return db.installMergeFiles(mergePath, true)
+}
+
+// 将 merge 目录中的文件移动到数据目录中，removeOld 为 true 时删除旧的数据文件
+// 标识 merge 完成的文件最后移动，中途退出时可以重新执行
+func (db *DB) installMergeFiles(mergePath string, removeOld bool) error {
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if err != nil {
+		return err
+	}
+	mergeFileId, err := db.getMergeFileId(mergePath)
 	if err != nil {
 		return err
 	}
 
-	// 查找标识 merge 完成的文件，判断 merge 是否处理完了
-	var mergeFinished bool
-	var mergeFileNames []string
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
-		}
-		if entry.Name() == data.SeqNoFileName {
-			continue
+	// 旧版本 merge 输出的文件 id 从 0 开始，和旧的数据文件重复，需要先删除旧的数据文件
+	if mergeFileId == 0 {
+		if err := db.removeDataFilesBefore(nonMergeFileId); err != nil {
+			return err
 		}
-		if entry.Name() == fileLockName {
-			continue
+	}
+	if _, err := db.moveMergeDataFiles(mergePath, nonMergeFileId); err != nil {
+		return err
+	}
+	if removeOld {
+		if err := db.removeDataFilesBefore(mergeFileId); err != nil {
+			return err
 		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
 	}
 
-	// 没有 merge 完成则直接返回
-	if !mergeFinished {
-		return nil
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		srcPath := filepath.Join(mergePath, fileName)
+		if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(srcPath, filepath.Join(db.options.DirPath, fileName)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+// 将 merge 目录中的数据文件移动到数据目录中，启用冷存储目录时符合策略的数据文件直接移动到冷存储目录
+// 返回移动的数据文件 id
+func (db *DB) moveMergeDataFiles(mergePath string, nonMergeFileId uint32) ([]uint32, error) {
+	dirEntries, err := os.ReadDir(mergePath)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	// 删除旧的数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return err
+	var fileIds []uint32
+	for _, entry := range dirEntries {
+		fileName := entry.Name()
+		if !strings.HasSuffix(fileName, data.DataFileNameSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(fileName, data.DataFileNameSuffix))
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		srcPath := filepath.Join(mergePath, fileName)
+		destPath := filepath.Join(db.options.DirPath, fileName)
+		if db.options.ColdDirPath != "" {
+			info, err := os.Stat(srcPath)
+			if err != nil {
+				return nil, err
+			}
+			if db.isColdFile(uint32(fid), nonMergeFileId, info.ModTime()) {
+				destPath = filepath.Join(db.options.ColdDirPath, fileName)
 			}
 		}
+		if err := utils.MoveFile(srcPath, destPath); err != nil {
+			return nil, err
+		}
+		fileIds = append(fileIds, uint32(fid))
 	}
+	return fileIds, nil
+}
 
-	// 将新的数据文件移动到数据目录中
-	for _, fileName := range mergeFileNames {
-		srcPath := filepath.Join(mergePath, fileName)
-		destPath := filepath.Join(db.options.DirPath, fileName)
-		if err := os.Rename(srcPath, destPath); err != nil {
+// 删除数据目录以及冷存储目录中文件 id 小于 fileId 的数据文件
+func (db *DB) removeDataFilesBefore(fileId uint32) error {
+	for _, dirPath := range append([]string{db.options.DirPath}, db.coldDirPaths()...) {
+		dirEntries, err := os.ReadDir(dirPath)
+		if err != nil {
 			return err
 		}
+		for _, entry := range dirEntries {
+			if !data.IsDataFileName(entry.Name()) {
+				continue
+			}
+			fid, err := strconv.Atoi(strings.Split(entry.Name(), ".")[0])
+			if err != nil {
+				return ErrDataDirectoryCorrupted
+			}
+			if uint32(fid) >= fileId {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dirPath, entry.Name())); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -248,6 +527,9 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	record, _, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
 		return 0, err
@@ -259,6 +541,46 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 	return uint32(nonMergeFileId), nil
 }
 
+// 获取已经被 merge 重写过的数据文件的边界，小于此 id 的数据文件中的位置不再有效，没有 merge 过时返回 0
+func (db *DB) getCompactedFileId(dirPath string) (uint32, error) {
+	if _, err := os.Stat(filepath.Join(dirPath, data.MergeFinishedFileName)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	mergeFileId, err := db.getMergeFileId(dirPath)
+	if err != nil || mergeFileId > 0 {
+		return mergeFileId, err
+	}
+	// 旧版本 merge 的输出和之前的数据文件 id 重复，非 merge 文件之前的都被重写过
+	return db.getNonMergeFileId(dirPath)
+}
+
+// 获取 merge 输出的第一个数据文件 id，旧版本的 merge 没有记录时返回 0
+func (db *DB) getMergeFileId(dirPath string) (uint32, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	_, size, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil {
+		return 0, err
+	}
+	record, _, err := mergeFinishedFile.ReadLogRecord(size)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	mergeFileId, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(mergeFileId), nil
+}
+
 // 从 hint 文件中加载索引
 func (db *DB) loadIndexFromHintFile() error {
 	// 查看 hint 索引文件是否存在
@@ -282,10 +604,17 @@ func (db *DB) loadIndexFromHintFile() error {
 			}
 			return err
 		}
+		if err := db.rateLimiter.WaitN(context.Background(), size); err != nil {
+			return err
+		}
 
 		// 解码拿到实际的位置索引
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		oldPos, err := db.index.Put(logRecord.Key, pos)
+		if err != nil {
+			return err
+		}
+		db.countIndexKey(logRecord.Key, data.LogRecordNormal, oldPos != nil)
 		offset += size
 	}
 	return nil
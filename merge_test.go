@@ -1,10 +1,16 @@
 package db_bitcask
 
 import (
+	"bytes"
+	"context"
+	"db-bitcask/data"
 	"db-bitcask/utils"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -202,3 +208,346 @@ func TestDB_Merge5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// merge 中途取消，merge 目录不影响原有的数据，之后可以重新 merge
+func TestDB_MergeCtx(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-merge-ctx")
+	opts.DataFileSize = 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.MergeCtx(ctx)
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+
+	err = db.MergeCtx(newCancelAfterContext(1000))
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, db.isMerging)
+	// merge 目录中没有完成标识
+	_, err = os.Stat(db.getMergePath())
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(db.getMergePath(), data.MergeFinishedFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 重启之后丢弃没有完成的 merge
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(db2.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	keys := db2.ListKeys()
+	assert.Equal(t, 5000, len(keys))
+
+	err = db2.MergeCtx(context.Background())
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	for i := 5000; i < 10000; i++ {
+		val, err := db3.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+func TestDB_MergeRateLimit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-merge-rate-limit")
+	opts.DataFileSize = 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	opts.RateLimit = -1
+	_, err := Open(opts)
+	assert.Equal(t, ErrInvalidRateLimit, err)
+
+	opts.RateLimit = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	// 读写大约 600KB 的数据，超过了一秒的令牌，需要等待
+	assert.Equal(t, ErrInvalidRateLimit, db.SetRateLimit(-1))
+	assert.Nil(t, db.SetRateLimit(512*1024))
+	start := time.Now()
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.ThrottledTime > 0)
+
+	// 取消限速之后不再等待
+	assert.Nil(t, db.SetRateLimit(0))
+	throttled := stat.ThrottledTime
+	err = db.Merge()
+	assert.Nil(t, err)
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, throttled, stat.ThrottledTime)
+}
+
+// merge 完成之后不需要重新打开，新的数据文件直接替换旧的数据文件
+func TestDB_Merge_LiveSwap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-merge-live")
+	opts.DataFileSize = 256 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.ValueCacheSize = 1024 * 1024
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 读取一次，让缓存中有旧位置的数据
+	for i := 5000; i < 10000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	oldFileIds := make([]uint32, 0, len(db.olderFiles)+1)
+	for fid := range db.olderFiles {
+		oldFileIds = append(oldFileIds, fid)
+	}
+	oldFileIds = append(oldFileIds, db.activeFile.FileId)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.ReclaimableSize > 0)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 旧的数据文件已经被关闭并删除
+	for _, fid := range oldFileIds {
+		_, ok := db.olderFiles[fid]
+		assert.False(t, ok)
+		assert.False(t, fileExists(data.GetDataFileName(dir, fid)))
+	}
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	stat2, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat2.ReclaimableSize)
+	assert.True(t, stat2.DiskSize < stat.DiskSize)
+
+	assert.Equal(t, 5000, len(db.ListKeys()))
+	for i := 0; i < 10000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i < 5000 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 替换之后可以继续写入和 merge
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, 6000, len(db.ListKeys()))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 6000, len(db2.ListKeys()))
+	for i := 5000; i < 10000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+// merge 期间被覆盖的数据不会被重写的旧数据替换
+func TestDB_Merge_ConcurrentOverwrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-merge-overwrite")
+	opts.DataFileSize = 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("old"))
+		assert.Nil(t, err)
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20000; i += 2 {
+			err := db.Put(utils.GetTestKey(i), []byte("new"))
+			assert.Nil(t, err)
+		}
+	}()
+	err = db.Merge()
+	assert.Nil(t, err)
+	wg.Wait()
+
+	check := func(db *DB) {
+		for i := 0; i < 20000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			if i%2 == 0 {
+				assert.Equal(t, []byte("new"), val)
+			} else {
+				assert.Equal(t, []byte("old"), val)
+			}
+		}
+	}
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
+
+func TestDB_Merge_OpenReaders(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-merge-readers")
+	opts.DataFileSize = 256 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.StreamChunkSize = 4 * 1024
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 2500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	value := utils.RandomValue(64 * 1024)
+	err = db.PutStream([]byte("stream"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	oldFileIds := []uint32{db.activeFile.FileId}
+	for fid := range db.olderFiles {
+		oldFileIds = append(oldFileIds, fid)
+	}
+
+	// merge 之前打开的迭代器和流式读取
+	iter := db.NewIterator(IteratorOptions{PrefetchSize: 16})
+	iter.Rewind()
+	reader, err := db.GetReader([]byte("stream"))
+	assert.Nil(t, err)
+	buf := make([]byte, 1024)
+	_, err = io.ReadFull(reader, buf)
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	for _, fid := range oldFileIds {
+		_, ok := db.olderFiles[fid]
+		assert.False(t, ok)
+		assert.True(t, fileExists(data.GetDataFileName(dir, fid)))
+	}
+
+	// 仍然可以读取旧的位置
+	var count int
+	for ; iter.Valid(); iter.Next() {
+		_, err := iter.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 2501, count)
+	rest, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, append(buf, rest...))
+
+	// 都关闭之后旧的数据文件被删除
+	iter.Close()
+	for _, fid := range oldFileIds {
+		assert.True(t, fileExists(data.GetDataFileName(dir, fid)))
+	}
+	assert.Nil(t, reader.Close())
+	for _, fid := range oldFileIds {
+		assert.False(t, fileExists(data.GetDataFileName(dir, fid)))
+	}
+
+	// 关闭数据库时没有关闭的读取不再阻止删除
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	oldFileIds = []uint32{db.activeFile.FileId}
+	for fid := range db.olderFiles {
+		oldFileIds = append(oldFileIds, fid)
+	}
+	iter2 := db.NewIterator(DefaultIteratorOptions)
+	defer iter2.Close()
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.True(t, fileExists(data.GetDataFileName(dir, oldFileIds[0])))
+	err = db.Close()
+	assert.Nil(t, err)
+	for _, fid := range oldFileIds {
+		assert.False(t, fileExists(data.GetDataFileName(dir, fid)))
+	}
+
+	// 崩溃时没有来得及删除的旧数据文件在打开时被删除
+	stale := data.GetDataFileName(dir, oldFileIds[0])
+	assert.Nil(t, os.WriteFile(stale, []byte("stale"), 0644))
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.False(t, fileExists(stale))
+	assert.Equal(t, 3501, len(db2.ListKeys()))
+}
@@ -0,0 +1,124 @@
+package db_bitcask
+
+import (
+	"db-bitcask/metrics"
+	"math"
+	"time"
+)
+
+// 数据库的操作指标，每个 DB 实例有独立的 Registry
+type dbMetrics struct {
+	registry     *metrics.Registry
+	put          *opMetrics
+	get          *opMetrics
+	delete       *opMetrics
+	batchCommit  *opMetrics
+	merge        *opMetrics
+	sync         *opMetrics
+	open         *opMetrics
+	bytesWritten *metrics.Counter
+}
+
+// 一种操作的次数、失败次数以及耗时
+type opMetrics struct {
+	op      string
+	total   *metrics.Counter
+	errors  *metrics.Counter
+	latency *metrics.Histogram
+	done    func(op string, duration time.Duration, err error)
+}
+
+// done 在每次操作完成之后调用，用于检查慢操作
+func newDBMetrics(done func(op string, duration time.Duration, err error)) *dbMetrics {
+	registry := metrics.NewRegistry()
+	newOp := func(op string) *opMetrics {
+		return &opMetrics{
+			op:      op,
+			done:    done,
+			total:   registry.Counter("bitcask_operations_total", "Total number of operations.", "op", op),
+			errors:  registry.Counter("bitcask_operation_errors_total", "Total number of failed operations.", "op", op),
+			latency: registry.Histogram("bitcask_operation_duration_seconds", "Latency of operations in seconds.", metrics.DefaultLatencyBuckets, "op", op),
+		}
+	}
+	return &dbMetrics{
+		registry:     registry,
+		put:          newOp("put"),
+		get:          newOp("get"),
+		delete:       newOp("delete"),
+		batchCommit:  newOp("batch_commit"),
+		merge:        newOp("merge"),
+		sync:         newOp("sync"),
+		open:         newOp("open"),
+		bytesWritten: registry.Counter("bitcask_written_bytes_total", "Total number of bytes appended to data files."),
+	}
+}
+
+// 记录一次操作，在操作开始时 defer 调用，err 指向操作返回的错误
+// key 不存在属于正常的读取结果，不计为失败
+func (m *opMetrics) observe(start time.Time, err *error) {
+	duration := time.Since(start)
+	m.total.Inc()
+	if *err != nil && *err != ErrKeyNotFound {
+		m.errors.Inc()
+	}
+	m.latency.Observe(duration.Seconds())
+	if m.done != nil {
+		m.done(m.op, duration, *err)
+	}
+}
+
+// 注册需要在输出时读取数据库状态的指标
+func (db *DB) registerStateMetrics() {
+	registry := db.metrics.registry
+	registry.GaugeFunc("bitcask_index_keys", "Number of keys in the index.", func() float64 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		size, err := db.index.Size()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(size)
+	})
+	registry.GaugeFunc("bitcask_data_files", "Number of data files including the active file.", func() float64 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		n := len(db.olderFiles)
+		if db.activeFile != nil {
+			n++
+		}
+		return float64(n)
+	})
+	registry.GaugeFunc("bitcask_reclaimable_bytes", "Bytes of stale data that merge can reclaim.", func() float64 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return float64(db.reclaimSize)
+	})
+	registry.CounterFunc("bitcask_throttled_seconds_total", "Total time merge, backup and index loading waited for the rate limiter.", func() float64 {
+		return db.rateLimiter.Throttled().Seconds()
+	})
+	if db.disk != nil {
+		registry.GaugeFunc("bitcask_disk_available_bytes", "Available bytes of the disk holding the data directory at the last check.", func() float64 {
+			_, available := db.DiskState()
+			return float64(available)
+		})
+		registry.GaugeFunc("bitcask_disk_state", "Disk space state, 0 ok, 1 below the soft limit, 2 below the hard limit.", func() float64 {
+			state, _ := db.DiskState()
+			return float64(state)
+		})
+	}
+	if db.valueCache != nil {
+		registry.CounterFunc("bitcask_value_cache_hits_total", "Total number of value cache hits.", func() float64 {
+			hits, _ := db.valueCache.stat()
+			return float64(hits)
+		})
+		registry.CounterFunc("bitcask_value_cache_misses_total", "Total number of value cache misses.", func() float64 {
+			_, misses := db.valueCache.stat()
+			return float64(misses)
+		})
+	}
+}
+
+// Metrics 返回数据库的指标，可以通过 metrics.Handler 以 Prometheus 文本格式输出
+func (db *DB) Metrics() *metrics.Registry {
+	return db.metrics.registry
+}
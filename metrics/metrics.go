@@ -0,0 +1,266 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets 操作耗时直方图默认的桶，秒为单位
+var DefaultLatencyBuckets = []float64{
+	0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5,
+}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry 保存所有的指标，按照 Prometheus 文本格式输出
+// 名称相同、标签不同的指标属于同一个指标族，HELP 和 TYPE 只输出一次
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series []*series
+}
+
+// 指标族中带有一组标签的指标
+type series struct {
+	labels string // 已经格式化的标签，例如 op="put"
+	write  func(w io.Writer, name, labels string) error
+}
+
+// NewRegistry 初始化 Registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter 创建只增不减的计数器，labels 为成对的标签名和标签值
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	r.register(name, help, typeCounter, labels, func(w io.Writer, name, labels string) error {
+		return writeSample(w, name, labels, float64(c.Value()))
+	})
+	return c
+}
+
+// CounterFunc 注册在输出时调用 fn 获取值的计数器，用于已经在别处统计的累计值
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	r.register(name, help, typeCounter, labels, func(w io.Writer, name, labels string) error {
+		return writeSample(w, name, labels, fn())
+	})
+}
+
+// GaugeFunc 注册在输出时调用 fn 获取当前值的指标
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.register(name, help, typeGauge, labels, func(w io.Writer, name, labels string) error {
+		return writeSample(w, name, labels, fn())
+	})
+}
+
+// Histogram 创建直方图，buckets 为从小到大排列的桶的上界
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		buckets: append([]float64(nil), buckets...),
+		counts:  make([]uint64, len(buckets)),
+	}
+	sort.Float64s(h.buckets)
+	r.register(name, help, typeHistogram, labels, h.write)
+	return h
+}
+
+func (r *Registry) register(name, help, typ string, labels []string, write func(io.Writer, string, string) error) {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: labels of %s must be name/value pairs", name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		r.families[name] = f
+	}
+	if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s is already registered as %s", name, f.typ))
+	}
+	f.series = append(f.series, &series{labels: formatLabels(labels), write: write})
+}
+
+// WriteTo 按照 Prometheus 文本格式输出所有的指标，指标族按照名称排序
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		if _, err := fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.typ); err != nil {
+			return cw.n, err
+		}
+		for _, s := range f.series {
+			if err := s.write(cw, f.name, s.labels); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// Handler 返回输出 Registry 中所有指标的 http.Handler，可以挂载到 /metrics
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(writer)
+	})
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Histogram 直方图，每个桶只记录落在该桶中的数量，输出时再累加
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64 // 所有观测值的和，按照 float64 的位存储以便原子更新
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count 返回观测值的数量
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) error {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := joinLabels(labels, `le="`+formatFloat(bound)+`"`)
+		if err := writeSample(w, name+"_bucket", le, float64(cumulative)); err != nil {
+			return err
+		}
+	}
+	// 并发写入时总数可能比各个桶的和多，+Inf 桶使用总数保证单调
+	count := atomic.LoadUint64(&h.count)
+	if count < cumulative {
+		count = cumulative
+	}
+	if err := writeSample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(count)); err != nil {
+		return err
+	}
+	if err := writeSample(w, name+"_sum", labels, math.Float64frombits(atomic.LoadUint64(&h.sumBits))); err != nil {
+		return err
+	}
+	return writeSample(w, name+"_count", labels, float64(count))
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) error {
+	var err error
+	if labels == "" {
+		_, err = fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	} else {
+		_, err = fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(v))
+	}
+	return err
+}
+
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabelValue(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+
+// 统计写入的字节数
+type countWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	put := r.Counter("ops_total", "Total ops.", "op", "put")
+	get := r.Counter("ops_total", "Total ops.", "op", "get")
+	put.Inc()
+	put.Add(2)
+	get.Inc()
+	r.GaugeFunc("keys", "Number of keys.", func() float64 { return 42 })
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "op", "put")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+	assert.Equal(t, uint64(3), h.Count())
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	expected := `# HELP keys Number of keys.
+# TYPE keys gauge
+keys 42
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="put",le="0.1"} 1
+latency_seconds_bucket{op="put",le="1"} 2
+latency_seconds_bucket{op="put",le="+Inf"} 3
+latency_seconds_sum{op="put"} 2.55
+latency_seconds_count{op="put"} 3
+# HELP ops_total Total ops.
+# TYPE ops_total counter
+ops_total{op="put"} 3
+ops_total{op="get"} 1
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestRegistry_Escape(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("escaped_total", "Line one\nline two.", "path", "a\"b\\c\n").Inc()
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `# HELP escaped_total Line one\nline two.`)
+	assert.Contains(t, buf.String(), `escaped_total{path="a\"b\\c\n"} 1`)
+}
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("name", "help")
+	assert.Panics(t, func() {
+		r.GaugeFunc("name", "help", func() float64 { return 0 })
+	})
+	assert.Panics(t, func() {
+		r.Counter("other", "help", "op")
+	})
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Total requests.").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler(r).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(t, recorder.Body.String(), "requests_total 1\n")
+}
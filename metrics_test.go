@@ -0,0 +1,65 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Metrics(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-metrics")
+	opts.DirPath = dir
+	opts.ValueCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(16))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(nil)
+	assert.Equal(t, ErrKeyIsEmpty, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	err = wb.Put(utils.GetTestKey(20), utils.RandomValue(16))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint64(10), db.metrics.put.total.Value())
+	assert.Equal(t, uint64(3), db.metrics.get.total.Value())
+	// key 不存在不计为失败
+	assert.Equal(t, uint64(1), db.metrics.get.errors.Value())
+	assert.Equal(t, uint64(3), db.metrics.get.latency.Count())
+	assert.Equal(t, uint64(1), db.metrics.delete.total.Value())
+	assert.Equal(t, uint64(1), db.metrics.batchCommit.total.Value())
+	assert.Equal(t, uint64(1), db.metrics.sync.total.Value())
+	assert.Equal(t, uint64(1), db.metrics.open.total.Value())
+	assert.Equal(t, uint64(db.activeFile.WriteOff), db.metrics.bytesWritten.Value())
+
+	var buf bytes.Buffer
+	_, err = db.Metrics().WriteTo(&buf)
+	assert.Nil(t, err)
+	text := buf.String()
+	assert.Contains(t, text, `bitcask_operations_total{op="put"} 10`)
+	assert.Contains(t, text, `bitcask_operation_errors_total{op="get"} 1`)
+	assert.Contains(t, text, `bitcask_operation_duration_seconds_count{op="get"} 3`)
+	assert.Contains(t, text, "bitcask_index_keys 10\n")
+	assert.Contains(t, text, "bitcask_data_files 1\n")
+	assert.Contains(t, text, "# TYPE bitcask_reclaimable_bytes gauge")
+	assert.Contains(t, text, "bitcask_value_cache_hits_total 0\n")
+}
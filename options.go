@@ -1,6 +1,10 @@
 package db_bitcask
 
-import "os"
+import (
+	"db-bitcask/fio"
+	"os"
+	"time"
+)
 
 type Options struct {
 	// 数据库数据目录
@@ -21,8 +25,62 @@ type Options struct {
 	// 启动时是否使用 MMap 加载数据
 	MMapAtStartup bool
 
+	// 数据文件的 IO 类型，启动加载完成之后活跃文件和旧的数据文件都使用此类型
+	IOType IOType
+
 	//	数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	// 流式写入大 value 时每个分块的大小，为 0 时使用默认的 4MB
+	StreamChunkSize int64
+
+	// 是否以只读方式打开，只读实例不接受任何写入和 merge
+	ReadOnly bool
+
+	// 是否作为复制的从节点打开，从节点只接受 ApplyRawLog 应用主节点的记录，用户写入和 merge 返回 ErrReadOnly
+	Replica bool
+
+	// value 缓存的容量，字节为单位，为 0 表示不启用缓存
+	ValueCacheSize int64
+
+	// 同时打开的旧数据文件数量上限，超过之后关闭最久没有读取的文件，为 0 表示不限制
+	MaxOpenFiles int
+
+	// 冷存储目录，符合策略的旧数据文件会在后台移动到此目录，为空表示不启用
+	ColdDirPath string
+
+	// 保留在 DirPath 中的最新的旧数据文件数量，为 0 表示不按照文件 id 判断
+	HotFileNum uint32
+
+	// 旧数据文件最后一次修改之后超过此时长移动到冷存储目录，为 0 表示不按照时间判断
+	// HotFileNum 和 ColdFileAge 都为 0 时所有的旧数据文件都会被移动
+	ColdFileAge time.Duration
+
+	// 是否在后台将旧数据文件压缩为只读的 .seg 段文件，使用 HotFileNum 和 ColdFileAge 判断哪些文件需要压缩
+	CompressSealedFiles bool
+
+	// 日志输出，为 nil 时不输出日志
+	Logger Logger
+
+	// 文件切换、merge、恢复时截断数据等内部事件的回调
+	EventListener EventListener
+
+	// 操作耗时超过此阈值时输出警告日志并触发 SlowOperation 事件，为 0 表示不检查
+	SlowOperationThreshold time.Duration
+
+	// merge、备份以及启动加载索引时读写数据的速率上限，字节每秒，为 0 表示不限速
+	// 可以通过 DB.SetRateLimit 在运行时修改
+	RateLimit int64
+
+	// 数据目录所在磁盘的可用空间低于此值时写入等待或者返回 ErrDiskSpaceLow，并在后台触发 merge，为 0 表示不检查
+	DiskSoftLimit uint64
+
+	// 数据目录所在磁盘的可用空间低于此值时数据库变为只读，写入返回 ErrDiskFull，空间恢复之后自动恢复写入，为 0 表示不检查
+	DiskHardLimit uint64
+
+	// 可用空间低于 DiskSoftLimit 时写入最多等待的时长，超时之后返回 ErrDiskSpaceLow，为 0 表示直接返回错误
+	// 删除操作不受 DiskSoftLimit 的限制，以便释放空间
+	DiskStallTimeout time.Duration
 }
 
 // IteratorOptions 索引迭代器配置项
@@ -31,6 +89,8 @@ type IteratorOptions struct {
 	Prefix []byte
 	// 是否反向遍历，默认 false 是正向
 	Reverse bool
+	// 预读的数据条数，读取 Value 时一次批量读取之后多条数据的 value，默认为 0 不预读
+	PrefetchSize int
 }
 
 // WriteBatchOptions 批量写配置项
@@ -42,6 +102,45 @@ type WriteBatchOptions struct {
 	SyncWrites bool
 }
 
+// ExportOptions 导出数据配置项
+type ExportOptions struct {
+	// 只导出前缀为指定值的 Key，默认为空
+	Prefix []byte
+
+	// 导出的 Key 范围 [Start, End)，为空表示不限制
+	Start []byte
+	End   []byte
+}
+
+type ExportFormat = int8
+
+const (
+	// ExportJSONL 每行一个 JSON 对象，key 和 value 使用 base64 编码
+	ExportJSONL ExportFormat = iota + 1
+
+	// ExportCSV 带有表头的 CSV，key 和 value 使用 base64 编码
+	ExportCSV
+
+	// ExportBinary 紧凑的二进制格式，key 和 value 带有长度前缀
+	ExportBinary
+)
+
+type IOType = fio.FileIOType
+
+const (
+	// StandardIO 标准文件 IO
+	StandardIO IOType = fio.StandardFIO
+
+	// MMapIO 可读写的内存文件映射，写入时预先扩大映射区域，关闭时截断到实际大小
+	MMapIO IOType = fio.MemoryMap
+
+	// DirectIO 使用 O_DIRECT 读写，创建活跃文件时预先分配 DataFileSize 大小的空间，只支持 Linux
+	DirectIO IOType = fio.DirectFIO
+
+	// IOUring 使用 io_uring 提交读写请求，MultiGet 和迭代器预读时批量提交，系统不支持时使用标准文件 IO
+	IOUring IOType = fio.IOUringFIO
+)
+
 type IndexerType = int8
 
 const (
@@ -56,18 +155,39 @@ const (
 )
 
 var DefaultOptions = Options{
-	DirPath:            os.TempDir(),
-	DataFileSize:       256 * 1024 * 1024, // 256MB
-	SyncWrites:         false,
-	BytesPerSync:       0,
-	IndexType:          BTree,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:                os.TempDir(),
+	DataFileSize:           256 * 1024 * 1024, // 256MB
+	SyncWrites:             false,
+	BytesPerSync:           0,
+	IndexType:              BTree,
+	MMapAtStartup:          true,
+	IOType:                 StandardIO,
+	DataFileMergeRatio:     0.5,
+	StreamChunkSize:        defaultStreamChunkSize,
+	ValueCacheSize:         0,
+	MaxOpenFiles:           0,
+	ColdDirPath:            "",
+	HotFileNum:             0,
+	ColdFileAge:            0,
+	CompressSealedFiles:    false,
+	Logger:                 nil,
+	SlowOperationThreshold: 0,
+	RateLimit:              0,
+	DiskSoftLimit:          0,
+	DiskHardLimit:          0,
+	DiskStallTimeout:       0,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
-	Prefix:  nil,
-	Reverse: false,
+	Prefix:       nil,
+	Reverse:      false,
+	PrefetchSize: 0,
+}
+
+var DefaultExportOptions = ExportOptions{
+	Prefix: nil,
+	Start:  nil,
+	End:    nil,
 }
 
 var DefaultWriteBatchOptions = WriteBatchOptions{
@@ -0,0 +1,179 @@
+package raft
+
+import (
+	bitcask "db-bitcask"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+type opType = byte
+
+const (
+	opPut opType = iota + 1
+	opDelete
+)
+
+// 一次状态机操作
+type op struct {
+	typ   opType
+	key   []byte
+	value []byte
+}
+
+// 编码日志条目中的命令: 操作数量 | 每个操作的 type keySize key valueSize value
+// 空的命令是 leader 当选之后写入的 no-op 条目
+func encodeCommand(ops []*op) []byte {
+	size := binary.MaxVarintLen64
+	for _, o := range ops {
+		size += 1 + binary.MaxVarintLen64*2 + len(o.key) + len(o.value)
+	}
+	buf := make([]byte, size)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(len(ops)))
+	for _, o := range ops {
+		buf[index] = o.typ
+		index++
+		index += binary.PutUvarint(buf[index:], uint64(len(o.key)))
+		index += copy(buf[index:], o.key)
+		index += binary.PutUvarint(buf[index:], uint64(len(o.value)))
+		index += copy(buf[index:], o.value)
+	}
+	return buf[:index]
+}
+
+// 解码日志条目中的命令
+func decodeCommand(buf []byte) ([]*op, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	var index = 0
+	readBytes := func() ([]byte, error) {
+		n, size := binary.Uvarint(buf[index:])
+		if size <= 0 || uint64(len(buf)-index-size) < n {
+			return nil, ErrInvalidCommand
+		}
+		index += size
+		b := buf[index : index+int(n)]
+		index += int(n)
+		return b, nil
+	}
+
+	count, size := binary.Uvarint(buf)
+	if size <= 0 {
+		return nil, ErrInvalidCommand
+	}
+	index += size
+	ops := make([]*op, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if index >= len(buf) {
+			return nil, ErrInvalidCommand
+		}
+		o := &op{typ: buf[index]}
+		index++
+		var err error
+		if o.key, err = readBytes(); err != nil {
+			return nil, err
+		}
+		if o.value, err = readBytes(); err != nil {
+			return nil, err
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+// 命令不合法导致的错误，在每个节点上应用时的结果都相同
+func isRejected(err error) bool {
+	return errors.Is(err, ErrInvalidCommand) || errors.Is(err, bitcask.ErrKeyIsEmpty) ||
+		errors.Is(err, bitcask.ErrKeyReserved) || errors.Is(err, bitcask.ErrExceedMaxBatchNum)
+}
+
+// 将已经提交的命令应用到状态机
+func applyCommand(db *bitcask.DB, ops []*op) error {
+	switch len(ops) {
+	case 0:
+		return nil
+	case 1:
+		return applyOp(db, ops[0])
+	}
+
+	wb, err := db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	if err != nil {
+		return err
+	}
+	for _, o := range ops {
+		var err error
+		switch o.typ {
+		case opPut:
+			err = wb.Put(o.key, o.value)
+		case opDelete:
+			err = wb.Delete(o.key)
+		default:
+			err = ErrInvalidCommand
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+func applyOp(db *bitcask.DB, o *op) error {
+	switch o.typ {
+	case opPut:
+		return db.Put(o.key, o.value)
+	case opDelete:
+		return db.Delete(o.key)
+	default:
+		return ErrInvalidCommand
+	}
+}
+
+// WriteBatch 通过共识提交的批量写，所有操作会被编码为同一个日志条目原子地应用
+type WriteBatch struct {
+	node *Node
+	mu   sync.Mutex
+	ops  []*op
+}
+
+// NewWriteBatch 初始化批量写
+func (n *Node) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{node: n}
+}
+
+// Put 批量写数据
+func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.ops = append(wb.ops, &op{typ: opPut, key: key, value: value})
+	return nil
+}
+
+// Delete 删除数据
+func (wb *WriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.ops = append(wb.ops, &op{typ: opDelete, key: key})
+	return nil
+}
+
+// Commit 提交事务，只能在 leader 上调用，等待条目提交并应用到本地状态机之后返回
+func (wb *WriteBatch) Commit() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if len(wb.ops) == 0 {
+		return nil
+	}
+	if err := wb.node.propose(encodeCommand(wb.ops)); err != nil {
+		return err
+	}
+	wb.ops = nil
+	return nil
+}
@@ -0,0 +1,14 @@
+package raft
+
+import "errors"
+
+var (
+	ErrNotLeader       = errors.New("node is not the leader")
+	ErrNodeClosed      = errors.New("raft node is closed")
+	ErrProposalTimeout = errors.New("timeout waiting for the proposal to be applied")
+	ErrProposalDropped = errors.New("proposal was dropped by a new leader")
+	ErrInvalidCommand  = errors.New("invalid raft command")
+	ErrInvalidSnapshot = errors.New("invalid raft snapshot")
+	ErrUnreachable     = errors.New("raft peer is unreachable")
+	ErrInvalidConfig   = errors.New("invalid raft config")
+)
@@ -0,0 +1,793 @@
+package raft
+
+import (
+	"context"
+	bitcask "db-bitcask"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	raftLogDirName = "raft"
+	dataDirName    = "data"
+
+	// 检查选举超时和心跳的间隔
+	tickInterval = 10 * time.Millisecond
+
+	// 状态机应用条目失败之后重试的间隔
+	applyRetryInterval = 100 * time.Millisecond
+
+	// 一次 AppendEntries 请求最多携带的条目数量
+	maxEntriesPerAppend = 256
+)
+
+type State = byte
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+// Config raft 节点配置项
+type Config struct {
+	// 节点 id
+	ID string
+
+	// 集群中所有节点的 id，包括当前节点
+	Peers []string
+
+	// 节点的数据目录，raft 日志、快照以及状态机的数据都保存在该目录下
+	Dir string
+
+	// 状态机的配置项，DirPath 会被忽略
+	Options bitcask.Options
+
+	// 节点之间的通信
+	Transport Transport
+
+	// 选举超时时间，实际的超时时间在 [ElectionTimeout, 2*ElectionTimeout) 之间随机
+	ElectionTimeout time.Duration
+
+	// leader 发送心跳的间隔，需要小于选举超时时间
+	HeartbeatInterval time.Duration
+
+	// 应用的条目数量超过该值之后生成快照并压缩日志，为 0 表示不生成快照
+	SnapshotThreshold uint64
+
+	// 等待写入提交并应用的超时时间
+	ProposalTimeout time.Duration
+}
+
+var DefaultConfig = Config{
+	Options:           bitcask.DefaultOptions,
+	ElectionTimeout:   300 * time.Millisecond,
+	HeartbeatInterval: 50 * time.Millisecond,
+	SnapshotThreshold: 10000,
+	ProposalTimeout:   5 * time.Second,
+}
+
+// Node raft 节点，复制的状态机是一个 bitcask 实例
+// Put、Delete 以及 WriteBatch 只能在 leader 上执行，通过共识提交之后再应用到每个节点的状态机
+type Node struct {
+	config Config
+	peers  []string // 除当前节点之外的其他节点
+
+	mu               sync.Mutex
+	state            State
+	currentTerm      uint64
+	votedFor         string
+	leaderID         string
+	log              []Entry // log[0] 为快照中最后一个条目的 index 和 term，没有快照时都为 0
+	commitIndex      uint64
+	lastApplied      uint64
+	applyErr         error // 最近一次应用条目到状态机失败的错误，重试成功之后清空
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	waiters          map[uint64]*waiter
+	isClosed         bool
+	storage          *storage
+
+	applyMu   sync.Mutex // 串行化应用日志、生成快照以及安装快照
+	applyCond *sync.Cond
+	dbMu      sync.RWMutex // 保护状态机实例，安装快照时会被替换
+	db        *bitcask.DB
+	snapMu    sync.RWMutex // 保护快照目录以及正在接收的快照
+
+	incomingIndex uint64 // 正在接收的快照的最后一个条目的 index
+	incomingSeq   uint64 // 正在接收的快照下一个分块的序号
+
+	replicateCh map[string]chan struct{}
+	closed      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// 等待日志条目被应用的写入请求
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// NewNode 打开 raft 节点，从快照和持久化的日志中恢复
+func NewNode(config Config) (*Node, error) {
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// 打开保存 raft 日志的存储引擎实例
+	logOptions := bitcask.DefaultOptions
+	logOptions.DirPath = filepath.Join(config.Dir, raftLogDirName)
+	logOptions.SyncWrites = config.Options.SyncWrites
+	storage, err := openStorage(logOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		config:      config,
+		storage:     storage,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		waiters:     make(map[uint64]*waiter),
+		replicateCh: make(map[string]chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	for _, peer := range config.Peers {
+		if peer != config.ID {
+			n.peers = append(n.peers, peer)
+			n.replicateCh[peer] = make(chan struct{}, 1)
+		}
+	}
+
+	if err := n.load(); err != nil {
+		_ = storage.close()
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	if err := config.Transport.Serve(n); err != nil {
+		_ = n.db.Close()
+		_ = storage.close()
+		return nil, err
+	}
+
+	n.wg.Add(2 + len(n.peers))
+	go n.runTicker()
+	go n.runApplier()
+	for _, peer := range n.peers {
+		go n.runReplicator(peer)
+	}
+	return n, nil
+}
+
+func checkConfig(config Config) error {
+	if config.ID == "" || config.Dir == "" || config.Transport == nil {
+		return ErrInvalidConfig
+	}
+	if config.HeartbeatInterval <= 0 || config.ElectionTimeout <= config.HeartbeatInterval {
+		return ErrInvalidConfig
+	}
+	if config.ProposalTimeout <= 0 {
+		return ErrInvalidConfig
+	}
+	for _, peer := range config.Peers {
+		if peer == config.ID {
+			return nil
+		}
+	}
+	return ErrInvalidConfig
+}
+
+// 加载持久化的状态，状态机从最近的快照恢复，之后的条目在重新提交之后再次应用
+func (n *Node) load() error {
+	term, vote, err := n.storage.loadState()
+	if err != nil {
+		return err
+	}
+	snapIndex, snapTerm, err := n.storage.loadSnapshotMeta()
+	if err != nil {
+		return err
+	}
+	entries, err := n.storage.loadEntries(snapIndex)
+	if err != nil {
+		return err
+	}
+
+	n.currentTerm = term
+	n.votedFor = vote
+	n.log = append([]Entry{{Index: snapIndex, Term: snapTerm}}, entries...)
+	n.commitIndex = snapIndex
+	n.lastApplied = snapIndex
+	if err := n.restoreStateMachine(snapIndex); err != nil {
+		return err
+	}
+	return n.removeStaleSnapshots(snapIndex)
+}
+
+// ID 节点 id
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+// State 节点当前的角色
+func (n *Node) State() State {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state
+}
+
+// IsLeader 当前节点是否为 leader
+func (n *Node) IsLeader() bool {
+	return n.State() == Leader
+}
+
+// Leader 当前已知的 leader id，未知时为空
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID
+}
+
+// Term 当前任期
+func (n *Node) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.currentTerm
+}
+
+// Put 通过共识写入数据，只能在 leader 上调用
+func (n *Node) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	return n.propose(encodeCommand([]*op{{typ: opPut, key: key, value: value}}))
+}
+
+// Delete 通过共识删除数据，只能在 leader 上调用
+func (n *Node) Delete(key []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	return n.propose(encodeCommand([]*op{{typ: opDelete, key: key}}))
+}
+
+// ApplyError 最近一次将已提交的条目应用到状态机失败的错误，没有失败或者已经重试成功时返回 nil
+func (n *Node) ApplyError() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applyErr
+}
+
+// Get 从本地状态机读取数据，follower 上读到的数据可能落后于 leader
+func (n *Node) Get(key []byte) ([]byte, error) {
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	return n.db.Get(key)
+}
+
+// Close 关闭节点
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.isClosed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.isClosed = true
+	close(n.closed)
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+
+	_ = n.config.Transport.Close()
+	n.wg.Wait()
+
+	n.dbMu.Lock()
+	defer n.dbMu.Unlock()
+	if err := n.db.Close(); err != nil {
+		_ = n.storage.close()
+		return err
+	}
+	return n.storage.close()
+}
+
+// 追加日志条目并等待其被提交和应用
+func (n *Node) propose(data []byte) error {
+	n.mu.Lock()
+	if n.isClosed {
+		n.mu.Unlock()
+		return ErrNodeClosed
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	index, err := n.appendLocal(data)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	w := &waiter{term: n.currentTerm, ch: make(chan error, 1)}
+	n.waiters[index] = w
+	n.triggerReplicate()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(n.config.ProposalTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.ch:
+		return err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, index)
+		applyErr := n.applyErr
+		n.mu.Unlock()
+		// 条目可能已经提交，但是状态机应用失败
+		if applyErr != nil {
+			return applyErr
+		}
+		return ErrProposalTimeout
+	case <-n.closed:
+		return ErrNodeClosed
+	}
+}
+
+// 在 leader 的日志中追加条目，调用方需要持有 mu
+func (n *Node) appendLocal(data []byte) (uint64, error) {
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.currentTerm, Data: data}
+	if err := n.storage.appendEntries([]Entry{entry}, nil); err != nil {
+		return 0, err
+	}
+	n.log = append(n.log, entry)
+	n.advanceCommitIndex()
+	return entry.Index, nil
+}
+
+func (n *Node) runTicker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if n.state == Leader {
+		if now.Sub(n.lastHeartbeat) >= n.config.HeartbeatInterval {
+			n.lastHeartbeat = now
+			n.triggerReplicate()
+		}
+		return
+	}
+	if now.After(n.electionDeadline) {
+		n.startElection()
+	}
+}
+
+// 发起选举，调用方需要持有 mu
+func (n *Node) startElection() {
+	n.state = Candidate
+	n.currentTerm++
+	n.votedFor = n.config.ID
+	n.leaderID = ""
+	n.resetElectionDeadline()
+	if err := n.storage.saveState(n.currentTerm, n.votedFor); err != nil {
+		return
+	}
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &RequestVoteRequest{
+		Term:         n.currentTerm,
+		CandidateID:  n.config.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+			defer cancel()
+			resp, err := n.config.Transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.currentTerm {
+				_ = n.becomeFollower(resp.Term, "")
+				return
+			}
+			if n.state != Candidate || n.currentTerm != req.Term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// 调用方需要持有 mu
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leaderID = n.config.ID
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	// 写入一个空的条目，提交之前任期遗留的条目
+	// 写入失败时无法提交任何条目，退回 follower 等待下一次选举
+	if _, err := n.appendLocal(nil); err != nil {
+		n.state = Follower
+		n.leaderID = ""
+		n.resetElectionDeadline()
+		return
+	}
+	n.lastHeartbeat = time.Now()
+	n.triggerReplicate()
+}
+
+// 调用方需要持有 mu
+func (n *Node) becomeFollower(term uint64, leaderID string) error {
+	n.state = Follower
+	n.leaderID = leaderID
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		return n.storage.saveState(term, "")
+	}
+	return nil
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) triggerReplicate() {
+	for _, peer := range n.peers {
+		n.triggerPeer(peer)
+	}
+}
+
+func (n *Node) triggerPeer(peer string) {
+	select {
+	case n.replicateCh[peer] <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) runReplicator(peer string) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-n.replicateCh[peer]:
+			n.replicateTo(peer)
+		}
+	}
+}
+
+// 向 follower 复制日志条目，follower 需要的条目已经被压缩时发送快照
+func (n *Node) replicateTo(peer string) {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return
+	}
+	term := n.currentTerm
+	next := n.nextIndex[peer]
+	snapIndex := n.log[0].Index
+	if next <= snapIndex {
+		snapTerm := n.log[0].Term
+		n.mu.Unlock()
+		n.sendSnapshot(peer, term, snapIndex, snapTerm)
+		return
+	}
+
+	end := n.lastIndex() + 1
+	if end-next > maxEntriesPerAppend {
+		end = next + maxEntriesPerAppend
+	}
+	entries := make([]Entry, end-next)
+	copy(entries, n.log[next-snapIndex:end-snapIndex])
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.config.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+	defer cancel()
+	resp, err := n.config.Transport.AppendEntries(ctx, peer, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.currentTerm {
+		_ = n.becomeFollower(resp.Term, "")
+		return
+	}
+	if n.state != Leader || n.currentTerm != term {
+		return
+	}
+	if !resp.Success {
+		next := resp.ConflictIndex
+		if next < 1 {
+			next = 1
+		}
+		if next > n.lastIndex()+1 {
+			next = n.lastIndex() + 1
+		}
+		n.nextIndex[peer] = next
+		n.triggerPeer(peer)
+		return
+	}
+
+	match := req.PrevLogIndex + uint64(len(entries))
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+	}
+	if match+1 > n.nextIndex[peer] {
+		n.nextIndex[peer] = match + 1
+	}
+	n.advanceCommitIndex()
+	if n.nextIndex[peer] <= n.lastIndex() {
+		n.triggerPeer(peer)
+	}
+}
+
+// leader 根据多数派的复制进度推进提交位置，只能直接提交当前任期的条目，调用方需要持有 mu
+func (n *Node) advanceCommitIndex() {
+	if n.state != Leader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.currentTerm {
+			return
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// 将已经提交的条目依次应用到状态机
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex && !n.isClosed {
+			n.applyCond.Wait()
+		}
+		if n.isClosed {
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		err := n.applyCommitted()
+		n.maybeSnapshot()
+		n.applyMu.Unlock()
+
+		// 应用失败时等待一段时间之后从失败的条目开始重试
+		if err != nil {
+			select {
+			case <-n.closed:
+				return
+			case <-time.After(applyRetryInterval):
+			}
+		}
+	}
+}
+
+// 将已经提交的条目依次应用到状态机，调用方需要持有 applyMu
+// 命令本身不合法时每个节点的结果都相同，直接返回给等待的写入请求并继续应用之后的条目
+// 其他错误（例如磁盘写入失败）会停在失败的条目，lastApplied 不会前进，leader 会退回 follower，之后重试
+func (n *Node) applyCommitted() error {
+	n.mu.Lock()
+	snapIndex := n.log[0].Index
+	entries := make([]Entry, n.commitIndex-n.lastApplied)
+	copy(entries, n.log[n.lastApplied+1-snapIndex:n.commitIndex+1-snapIndex])
+	n.mu.Unlock()
+
+	for _, entry := range entries {
+		ops, err := decodeCommand(entry.Data)
+		if err == nil {
+			n.dbMu.RLock()
+			err = applyCommand(n.db, ops)
+			n.dbMu.RUnlock()
+		}
+
+		n.mu.Lock()
+		if err != nil && !isRejected(err) {
+			n.applyErr = err
+			if n.state == Leader {
+				_ = n.becomeFollower(n.currentTerm, "")
+				n.resetElectionDeadline()
+			}
+			n.mu.Unlock()
+			return err
+		}
+		n.applyErr = nil
+		n.lastApplied = entry.Index
+		if w, ok := n.waiters[entry.Index]; ok {
+			delete(n.waiters, entry.Index)
+			// 该位置的条目已经被新的 leader 覆盖
+			if w.term != entry.Term {
+				err = ErrProposalDropped
+			}
+			w.ch <- err
+		}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+// 调用方需要持有 mu
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+// 调用方需要持有 mu
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// 获取 index 位置条目的任期，index 不能小于快照的位置，调用方需要持有 mu
+func (n *Node) termAt(index uint64) uint64 {
+	return n.log[index-n.log[0].Index].Term
+}
+
+// RequestVote 处理投票请求
+func (n *Node) RequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isClosed {
+		return nil, ErrNodeClosed
+	}
+
+	if req.Term > n.currentTerm {
+		if err := n.becomeFollower(req.Term, ""); err != nil {
+			return nil, err
+		}
+	}
+	resp := &RequestVoteResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		return resp, nil
+	}
+
+	// 候选人的日志至少和自己一样新才会投票
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		if err := n.storage.saveState(n.currentTerm, n.votedFor); err != nil {
+			return nil, err
+		}
+		n.resetElectionDeadline()
+		resp.VoteGranted = true
+	}
+	return resp, nil
+}
+
+// AppendEntries 处理 leader 的日志复制和心跳
+func (n *Node) AppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isClosed {
+		return nil, ErrNodeClosed
+	}
+
+	resp := &AppendEntriesResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		return resp, nil
+	}
+	if err := n.becomeFollower(req.Term, req.LeaderID); err != nil {
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	resp.Term = n.currentTerm
+
+	// 缺少 PrevLogIndex 之前的条目
+	snapIndex := n.log[0].Index
+	if req.PrevLogIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	// PrevLogIndex 位置的任期不一致，跳过该任期的所有条目
+	if req.PrevLogIndex >= snapIndex && n.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		conflictTerm := n.termAt(req.PrevLogIndex)
+		index := req.PrevLogIndex
+		for index > snapIndex+1 && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+
+	// 跳过已经存在的条目，从第一个不一致的位置开始截断并写入
+	var truncated []Entry
+	var i = 0
+	for ; i < len(req.Entries); i++ {
+		entry := req.Entries[i]
+		if entry.Index <= snapIndex {
+			continue
+		}
+		if entry.Index > n.lastIndex() {
+			break
+		}
+		if n.termAt(entry.Index) != entry.Term {
+			truncated = make([]Entry, n.lastIndex()+1-entry.Index)
+			copy(truncated, n.log[entry.Index-snapIndex:])
+			break
+		}
+	}
+	entries := req.Entries[i:]
+	if len(entries) > 0 {
+		if err := n.storage.appendEntries(entries, truncated); err != nil {
+			return nil, err
+		}
+		if len(truncated) > 0 {
+			n.log = n.log[:entries[0].Index-snapIndex]
+		}
+		n.log = append(n.log, entries...)
+	}
+
+	resp.Success = true
+	if req.LeaderCommit > n.commitIndex {
+		commitIndex := req.LeaderCommit
+		if lastNew := req.PrevLogIndex + uint64(len(req.Entries)); lastNew < commitIndex {
+			commitIndex = lastNew
+		}
+		if commitIndex > n.commitIndex {
+			n.commitIndex = commitIndex
+			n.applyCond.Broadcast()
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,345 @@
+package raft
+
+import (
+	bitcask "db-bitcask"
+	"db-bitcask/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	configs map[string]Config
+	nodes   map[string]*Node
+}
+
+func newTestCluster(t *testing.T, size int, snapshotThreshold uint64) *testCluster {
+	var peers []string
+	for i := 0; i < size; i++ {
+		peers = append(peers, fmt.Sprintf("node-%d", i))
+	}
+	c := &testCluster{
+		t:       t,
+		network: NewInmemNetwork(),
+		configs: make(map[string]Config),
+		nodes:   make(map[string]*Node),
+	}
+	for _, id := range peers {
+		dir, _ := os.MkdirTemp("", "db-bitcask-raft-"+id)
+		config := DefaultConfig
+		config.ID = id
+		config.Peers = peers
+		config.Dir = dir
+		config.Transport = c.network.Transport(id)
+		config.ElectionTimeout = 150 * time.Millisecond
+		config.ProposalTimeout = time.Second
+		config.SnapshotThreshold = snapshotThreshold
+		c.configs[id] = config
+		c.start(id)
+	}
+	return c
+}
+
+func (c *testCluster) start(id string) {
+	node, err := NewNode(c.configs[id])
+	assert.Nil(c.t, err)
+	c.nodes[id] = node
+}
+
+func (c *testCluster) stop(id string) {
+	assert.Nil(c.t, c.nodes[id].Close())
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) destroy() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	for _, config := range c.configs {
+		_ = os.RemoveAll(config.Dir)
+	}
+}
+
+// 等待选举出 leader，exclude 中的节点不参与
+func (c *testCluster) waitForLeader(exclude ...string) *Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for id, node := range c.nodes {
+			if contains(exclude, id) {
+				continue
+			}
+			if node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+// 等待所有节点都应用了数据
+func (c *testCluster) waitForValue(key, value []byte) {
+	for id, node := range c.nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			val, err := node.Get(key)
+			if err == nil && string(val) == string(value) {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.t.Fatalf("node %s did not apply key %s", id, key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func (c *testCluster) waitForDeleted(key []byte) {
+	for id, node := range c.nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := node.Get(key); err == bitcask.ErrKeyNotFound {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.t.Fatalf("node %s did not apply delete of key %s", id, key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNode_Replication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	defer c.destroy()
+
+	leader := c.waitForLeader()
+	err := leader.Put(utils.GetTestKey(1), []byte("value-1"))
+	assert.Nil(t, err)
+	err = leader.Put(utils.GetTestKey(2), []byte("value-2"))
+	assert.Nil(t, err)
+	err = leader.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	wb := leader.NewWriteBatch()
+	_ = wb.Put(utils.GetTestKey(3), []byte("value-3"))
+	_ = wb.Put(utils.GetTestKey(4), []byte("value-4"))
+	_ = wb.Delete(utils.GetTestKey(1))
+	assert.Nil(t, wb.Commit())
+
+	c.waitForDeleted(utils.GetTestKey(1))
+	c.waitForDeleted(utils.GetTestKey(2))
+	c.waitForValue(utils.GetTestKey(3), []byte("value-3"))
+	c.waitForValue(utils.GetTestKey(4), []byte("value-4"))
+
+	// follower 不能写入
+	for _, node := range c.nodes {
+		if node != leader {
+			assert.Equal(t, ErrNotLeader, node.Put(utils.GetTestKey(5), []byte("x")))
+			assert.Equal(t, leader.ID(), node.Leader())
+		}
+	}
+}
+
+func TestNode_LeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	defer c.destroy()
+
+	oldLeader := c.waitForLeader()
+	err := oldLeader.Put(utils.GetTestKey(1), []byte("before"))
+	assert.Nil(t, err)
+	c.waitForValue(utils.GetTestKey(1), []byte("before"))
+
+	// leader 和其他节点断开之后，剩下的节点选举出新的 leader
+	c.network.Disconnect(oldLeader.ID())
+	newLeader := c.waitForLeader(oldLeader.ID())
+	assert.True(t, newLeader.Term() > oldLeader.Term())
+	err = newLeader.Put(utils.GetTestKey(2), []byte("after"))
+	assert.Nil(t, err)
+
+	// 旧的 leader 无法提交数据
+	err = oldLeader.Put(utils.GetTestKey(3), []byte("lost"))
+	assert.NotNil(t, err)
+
+	// 恢复连接之后旧的 leader 变为 follower 并追上数据
+	c.network.Connect(oldLeader.ID())
+	c.waitForValue(utils.GetTestKey(2), []byte("after"))
+	c.waitForDeleted(utils.GetTestKey(3))
+	assert.False(t, oldLeader.IsLeader())
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	// 快照分成多个分块发送
+	defer func(size int) {
+		snapshotChunkSize = size
+	}(snapshotChunkSize)
+	snapshotChunkSize = 512
+
+	c := newTestCluster(t, 3, 20)
+	defer c.destroy()
+
+	leader := c.waitForLeader()
+	var lagging string
+	for id := range c.nodes {
+		if id != leader.ID() {
+			lagging = id
+			break
+		}
+	}
+
+	// 落后的 follower 需要的日志已经被压缩，只能通过快照追上
+	c.network.Disconnect(lagging)
+	for i := 0; i < 100; i++ {
+		err := leader.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+	leader.mu.Lock()
+	assert.True(t, leader.log[0].Index > 0)
+	leader.mu.Unlock()
+
+	c.network.Connect(lagging)
+	c.waitForValue(utils.GetTestKey(0), []byte("value-0"))
+	c.waitForValue(utils.GetTestKey(99), []byte("value-99"))
+
+	// 重启之后从快照和日志中恢复
+	c.stop(lagging)
+	err := leader.Put(utils.GetTestKey(100), []byte("value-100"))
+	assert.Nil(t, err)
+	c.start(lagging)
+	c.waitForValue(utils.GetTestKey(50), []byte("value-50"))
+	c.waitForValue(utils.GetTestKey(100), []byte("value-100"))
+}
+
+func TestNode_InstallSnapshot_OutOfOrder(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	defer c.destroy()
+	node := c.waitForLeader()
+	term := node.Term()
+
+	req := &InstallSnapshotRequest{Term: term, LeaderID: "node-x", LastIncludedIndex: 100, LastIncludedTerm: term, File: "a", Data: []byte("a")}
+	_, err := node.InstallSnapshot(req)
+	assert.Nil(t, err)
+
+	// 缺少分块时拒绝，需要从头重新发送
+	req.Seq = 2
+	_, err = node.InstallSnapshot(req)
+	assert.Equal(t, ErrInvalidSnapshot, err)
+	req.Seq, req.Data, req.Done = 1, nil, true
+	_, err = node.InstallSnapshot(req)
+	assert.Nil(t, err)
+
+	content, err := os.ReadFile(filepath.Join(node.snapshotDir(100), "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), content)
+	_, err = os.Stat(filepath.Join(node.config.Dir, incomingSnapshotDirName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNode_BecomeLeader_AppendError(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	defer c.destroy()
+	node := c.waitForLeader()
+
+	// 无法写入空条目时不能成为 leader
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.state = Follower
+	assert.Nil(t, node.storage.close())
+	node.becomeLeader()
+	assert.Equal(t, Follower, node.state)
+
+	logOptions := bitcask.DefaultOptions
+	logOptions.DirPath = filepath.Join(node.config.Dir, raftLogDirName)
+	storage, err := openStorage(logOptions)
+	assert.Nil(t, err)
+	node.storage = storage
+}
+
+func TestNode_ApplyError(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	defer c.destroy()
+	node := c.waitForLeader()
+	err := node.Put(utils.GetTestKey(0), []byte("value-0"))
+	assert.Nil(t, err)
+	term := node.Term()
+
+	// 状态机无法写入时不能跳过已经提交的条目
+	swapDB := func(readOnly bool) {
+		node.dbMu.Lock()
+		defer node.dbMu.Unlock()
+		assert.Nil(t, node.db.Close())
+		options := node.config.Options
+		options.DirPath = filepath.Join(node.config.Dir, dataDirName)
+		options.ReadOnly = readOnly
+		db, err := bitcask.Open(options)
+		assert.Nil(t, err)
+		node.db = db
+	}
+	swapDB(true)
+	err = node.Put(utils.GetTestKey(1), []byte("value-1"))
+	assert.ErrorIs(t, err, bitcask.ErrReadOnly)
+	assert.ErrorIs(t, node.ApplyError(), bitcask.ErrReadOnly)
+	// 应用失败之后 leader 会退回 follower，重新选举之后任期增加
+	assert.Greater(t, node.Term(), term)
+	node.mu.Lock()
+	assert.Less(t, node.lastApplied, node.commitIndex)
+	node.mu.Unlock()
+
+	// 状态机恢复之后从失败的条目开始继续应用
+	swapDB(false)
+	c.waitForValue(utils.GetTestKey(1), []byte("value-1"))
+	assert.Nil(t, node.ApplyError())
+	val, err := node.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-0"), val)
+}
+
+func TestNode_Restart(t *testing.T) {
+	c := newTestCluster(t, 1, 10)
+	defer c.destroy()
+
+	leader := c.waitForLeader()
+	for i := 0; i < 25; i++ {
+		err := leader.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+
+	id := leader.ID()
+	c.stop(id)
+	c.start(id)
+	c.waitForLeader()
+	c.waitForValue(utils.GetTestKey(0), []byte("value-0"))
+	c.waitForValue(utils.GetTestKey(24), []byte("value-24"))
+}
+
+func TestCommand_Encode(t *testing.T) {
+	ops := []*op{
+		{typ: opPut, key: []byte("key-1"), value: []byte("value-1")},
+		{typ: opDelete, key: []byte("key-2")},
+	}
+	decoded, err := decodeCommand(encodeCommand(ops))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(decoded))
+	assert.Equal(t, ops[0].key, decoded[0].key)
+	assert.Equal(t, ops[0].value, decoded[0].value)
+	assert.Equal(t, opDelete, decoded[1].typ)
+
+	_, err = decodeCommand([]byte{1, opPut, 10})
+	assert.Equal(t, ErrInvalidCommand, err)
+}
@@ -0,0 +1,395 @@
+package raft
+
+import (
+	"context"
+	bitcask "db-bitcask"
+	"db-bitcask/utils"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotDirPrefix = "snapshot-"
+
+	// 正在接收的快照所在的目录，不能以 snapshotDirPrefix 开头，避免被清理旧快照时删除
+	incomingSnapshotDirName = "incoming-snapshot"
+)
+
+// 发送快照时每个分块的大小，测试时可以调小
+var snapshotChunkSize = 1024 * 1024
+
+// 快照目录，快照的内容是状态机的备份
+func (n *Node) snapshotDir(index uint64) string {
+	return filepath.Join(n.config.Dir, fmt.Sprintf("%s%020d", snapshotDirPrefix, index))
+}
+
+// 应用的条目数量超过阈值之后生成快照，调用方需要持有 applyMu
+func (n *Node) maybeSnapshot() {
+	if n.config.SnapshotThreshold == 0 {
+		return
+	}
+	n.mu.Lock()
+	index := n.lastApplied
+	if index-n.log[0].Index < n.config.SnapshotThreshold {
+		n.mu.Unlock()
+		return
+	}
+	term := n.termAt(index)
+	n.mu.Unlock()
+
+	_ = n.takeSnapshot(index, term)
+}
+
+// 使用 Backup 生成状态机的快照，然后压缩快照已经包含的日志条目，调用方需要持有 applyMu
+func (n *Node) takeSnapshot(index, term uint64) error {
+	dir := n.snapshotDir(index)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	n.dbMu.RLock()
+	err := n.db.Backup(dir)
+	n.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	snapIndex := n.log[0].Index
+	compacted := make([]Entry, index-snapIndex)
+	copy(compacted, n.log[1:index-snapIndex+1])
+	if err := n.storage.saveSnapshotMeta(index, term, compacted); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.log = append([]Entry{{Index: index, Term: term}}, n.log[index-snapIndex+1:]...)
+	n.mu.Unlock()
+
+	return n.removeStaleSnapshots(index)
+}
+
+// 删除 index 之外的其他快照目录
+func (n *Node) removeStaleSnapshots(index uint64) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	dirs, err := filepath.Glob(filepath.Join(n.config.Dir, snapshotDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	keep := n.snapshotDir(index)
+	for _, dir := range dirs {
+		if dir == keep {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 快照中的一个文件
+type snapshotFile struct {
+	name string
+	file *os.File
+}
+
+// 打开快照目录中的所有文件，文件打开之后即使快照目录被删除也可以继续读取
+func (n *Node) openSnapshotFiles(index uint64) ([]*snapshotFile, error) {
+	n.snapMu.RLock()
+	defer n.snapMu.RUnlock()
+
+	dir := n.snapshotDir(index)
+	var files []*snapshotFile
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &snapshotFile{name: name, file: file})
+		return nil
+	})
+	if err != nil {
+		closeSnapshotFiles(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+func closeSnapshotFiles(files []*snapshotFile) {
+	for _, f := range files {
+		_ = f.file.Close()
+	}
+}
+
+// 将快照的一个分块写入到接收目录中，分块需要按照序号连续到达
+func (n *Node) receiveSnapshotChunk(req *InstallSnapshotRequest) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	dir := filepath.Join(n.config.Dir, incomingSnapshotDirName)
+	if req.Seq == 0 {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		n.incomingIndex, n.incomingSeq = req.LastIncludedIndex, 0
+	}
+	if req.LastIncludedIndex != n.incomingIndex || req.Seq != n.incomingSeq {
+		return ErrInvalidSnapshot
+	}
+
+	path := filepath.Join(dir, filepath.Clean(string(filepath.Separator)+req.File))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	flag := os.O_CREATE | os.O_WRONLY
+	if req.Offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(req.Data, req.Offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	n.incomingSeq++
+	return nil
+}
+
+// 接收完所有分块之后将接收目录作为 index 对应的快照目录，seq 为最后一个请求的序号
+func (n *Node) finishIncomingSnapshot(index, seq uint64) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	if index != n.incomingIndex || seq != n.incomingSeq {
+		return ErrInvalidSnapshot
+	}
+	n.incomingIndex, n.incomingSeq = 0, 0
+	dir := n.snapshotDir(index)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	incomingDir := filepath.Join(n.config.Dir, incomingSnapshotDirName)
+	// 快照中没有任何文件时接收目录不存在
+	if err := os.MkdirAll(incomingDir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(incomingDir, dir)
+}
+
+// 丢弃没有接收完或者不再需要的快照
+func (n *Node) discardIncomingSnapshot() error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+	n.incomingIndex, n.incomingSeq = 0, 0
+	return os.RemoveAll(filepath.Join(n.config.Dir, incomingSnapshotDirName))
+}
+
+// 使用快照重建状态机，index 为 0 表示没有快照，调用方需要持有 applyMu
+func (n *Node) restoreStateMachine(index uint64) error {
+	n.dbMu.Lock()
+	defer n.dbMu.Unlock()
+
+	if n.db != nil {
+		if err := n.db.Close(); err != nil {
+			return err
+		}
+		n.db = nil
+	}
+	dataDir := filepath.Join(n.config.Dir, dataDirName)
+	if err := os.RemoveAll(dataDir); err != nil {
+		return err
+	}
+	if index > 0 {
+		if _, err := os.Stat(n.snapshotDir(index)); err != nil {
+			return ErrInvalidSnapshot
+		}
+		n.snapMu.RLock()
+		err := utils.CopyDir(n.snapshotDir(index), dataDir, nil)
+		n.snapMu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	options := n.config.Options
+	options.DirPath = dataDir
+	db, err := bitcask.Open(options)
+	if err != nil {
+		return err
+	}
+	n.db = db
+	return nil
+}
+
+// 向落后太多的 follower 分块发送快照，每个分块单独等待响应，不需要把整个快照读到内存中
+func (n *Node) sendSnapshot(peer string, term, index, snapTerm uint64) {
+	files, err := n.openSnapshotFiles(index)
+	if err != nil {
+		return
+	}
+	defer closeSnapshotFiles(files)
+
+	var seq uint64
+	buf := make([]byte, snapshotChunkSize)
+	for _, f := range files {
+		for offset := int64(0); ; {
+			size, err := f.file.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return
+			}
+			req := &InstallSnapshotRequest{
+				Term:              term,
+				LeaderID:          n.config.ID,
+				LastIncludedIndex: index,
+				LastIncludedTerm:  snapTerm,
+				Seq:               seq,
+				File:              f.name,
+				Offset:            offset,
+				Data:              buf[:size],
+			}
+			if !n.sendSnapshotChunk(peer, req) {
+				return
+			}
+			seq++
+			offset += int64(size)
+			if err == io.EOF {
+				break
+			}
+		}
+	}
+	req := &InstallSnapshotRequest{
+		Term:              term,
+		LeaderID:          n.config.ID,
+		LastIncludedIndex: index,
+		LastIncludedTerm:  snapTerm,
+		Seq:               seq,
+		Done:              true,
+	}
+	if !n.sendSnapshotChunk(peer, req) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index > n.matchIndex[peer] {
+		n.matchIndex[peer] = index
+	}
+	if index+1 > n.nextIndex[peer] {
+		n.nextIndex[peer] = index + 1
+	}
+	n.triggerPeer(peer)
+}
+
+// 发送快照的一个分块，失败或者当前节点不再是发送时任期的 leader 时返回 false
+func (n *Node) sendSnapshotChunk(peer string, req *InstallSnapshotRequest) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ProposalTimeout)
+	defer cancel()
+	resp, err := n.config.Transport.InstallSnapshot(ctx, peer, req)
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.currentTerm {
+		_ = n.becomeFollower(resp.Term, "")
+		return false
+	}
+	return n.state == Leader && n.currentTerm == req.Term
+}
+
+// InstallSnapshot 处理 leader 发送的快照，使用快照替换本地的状态机
+func (n *Node) InstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.mu.Lock()
+	if n.isClosed {
+		n.mu.Unlock()
+		return nil, ErrNodeClosed
+	}
+	resp := &InstallSnapshotResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.becomeFollower(req.Term, req.LeaderID); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	resp.Term = n.currentTerm
+	n.wg.Add(1)
+	n.mu.Unlock()
+	defer n.wg.Done()
+
+	if !req.Done {
+		if err := n.receiveSnapshotChunk(req); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	// 已经应用过快照中的所有条目
+	n.mu.Lock()
+	applied := n.lastApplied
+	n.mu.Unlock()
+	if req.LastIncludedIndex <= applied {
+		if err := n.discardIncomingSnapshot(); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if err := n.finishIncomingSnapshot(req.LastIncludedIndex, req.Seq); err != nil {
+		return nil, err
+	}
+	if err := n.restoreStateMachine(req.LastIncludedIndex); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	// 本地日志中包含快照的最后一个条目时保留之后的条目，否则丢弃所有条目
+	snapIndex := n.log[0].Index
+	var compacted, rest []Entry
+	if req.LastIncludedIndex <= n.lastIndex() && n.termAt(req.LastIncludedIndex) == req.LastIncludedTerm {
+		compacted = n.log[1 : req.LastIncludedIndex-snapIndex+1]
+		rest = n.log[req.LastIncludedIndex-snapIndex+1:]
+	} else {
+		compacted = n.log[1:]
+	}
+	if err := n.storage.saveSnapshotMeta(req.LastIncludedIndex, req.LastIncludedTerm, compacted); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.log = append([]Entry{{Index: req.LastIncludedIndex, Term: req.LastIncludedTerm}}, rest...)
+	if req.LastIncludedIndex > n.commitIndex {
+		n.commitIndex = req.LastIncludedIndex
+	}
+	n.lastApplied = req.LastIncludedIndex
+	n.mu.Unlock()
+
+	if err := n.removeStaleSnapshots(req.LastIncludedIndex); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
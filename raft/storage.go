@@ -0,0 +1,159 @@
+package raft
+
+import (
+	bitcask "db-bitcask"
+	"encoding/binary"
+)
+
+var (
+	termKey     = []byte("term")
+	voteKey     = []byte("vote")
+	snapshotKey = []byte("snapshot")
+	entryPrefix = []byte("entry/")
+)
+
+// Entry 日志条目
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+// 持久化的 raft 状态，当前任期、投票以及日志条目都保存在一个独立的 bitcask 实例中
+type storage struct {
+	db         *bitcask.DB
+	syncWrites bool
+}
+
+func openStorage(options bitcask.Options) (*storage, error) {
+	db, err := bitcask.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{db: db, syncWrites: options.SyncWrites}, nil
+}
+
+func (s *storage) close() error {
+	return s.db.Close()
+}
+
+// 加载当前任期和投票
+func (s *storage) loadState() (uint64, string, error) {
+	var term uint64
+	buf, err := s.db.Get(termKey)
+	if err != nil && err != bitcask.ErrKeyNotFound {
+		return 0, "", err
+	}
+	if len(buf) == 8 {
+		term = binary.BigEndian.Uint64(buf)
+	}
+	vote, err := s.db.Get(voteKey)
+	if err != nil && err != bitcask.ErrKeyNotFound {
+		return 0, "", err
+	}
+	return term, string(vote), nil
+}
+
+func (s *storage) saveState(term uint64, vote string) error {
+	wb, err := s.db.NewWriteBatch(s.batchOptions())
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, term)
+	_ = wb.Put(termKey, buf)
+	if vote == "" {
+		_ = wb.Delete(voteKey)
+	} else {
+		_ = wb.Put(voteKey, []byte(vote))
+	}
+	return wb.Commit()
+}
+
+// 加载最近一次快照包含的最后一个条目的 index 和 term
+func (s *storage) loadSnapshotMeta() (uint64, uint64, error) {
+	buf, err := s.db.Get(snapshotKey)
+	if err == bitcask.ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(buf) != 16 {
+		return 0, 0, ErrInvalidSnapshot
+	}
+	return binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:]), nil
+}
+
+// 保存快照的元数据，并删除快照已经包含的日志条目
+func (s *storage) saveSnapshotMeta(index, term uint64, compacted []Entry) error {
+	wb, err := s.db.NewWriteBatch(s.batchOptions())
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], index)
+	binary.BigEndian.PutUint64(buf[8:], term)
+	_ = wb.Put(snapshotKey, buf)
+	for _, e := range compacted {
+		_ = wb.Delete(entryKey(e.Index))
+	}
+	return wb.Commit()
+}
+
+// 加载 index 大于 from 的所有日志条目
+func (s *storage) loadEntries(from uint64) ([]Entry, error) {
+	var entries []Entry
+	iter := s.db.NewIterator(bitcask.IteratorOptions{Prefix: entryPrefix})
+	defer iter.Close()
+	for iter.Seek(entryKey(from + 1)); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		if err != nil {
+			return nil, err
+		}
+		if len(value) < 8 {
+			return nil, ErrInvalidCommand
+		}
+		index := binary.BigEndian.Uint64(iter.Key()[len(entryPrefix):])
+		entries = append(entries, Entry{
+			Index: index,
+			Term:  binary.BigEndian.Uint64(value[:8]),
+			Data:  value[8:],
+		})
+	}
+	return entries, nil
+}
+
+// 写入新的日志条目，同时删除被覆盖的旧条目
+func (s *storage) appendEntries(entries []Entry, truncated []Entry) error {
+	wb, err := s.db.NewWriteBatch(s.batchOptions())
+	if err != nil {
+		return err
+	}
+	for _, e := range truncated {
+		_ = wb.Delete(entryKey(e.Index))
+	}
+	for _, e := range entries {
+		value := make([]byte, 8+len(e.Data))
+		binary.BigEndian.PutUint64(value[:8], e.Term)
+		copy(value[8:], e.Data)
+		_ = wb.Put(entryKey(e.Index), value)
+	}
+	return wb.Commit()
+}
+
+func (s *storage) batchOptions() bitcask.WriteBatchOptions {
+	opts := bitcask.DefaultWriteBatchOptions
+	opts.SyncWrites = s.syncWrites
+	// 截断日志时删除的条目数量没有上限
+	opts.MaxBatchNum = ^uint(0)
+	return opts
+}
+
+// 日志条目的 key，使用大端序保证按照 index 有序
+func entryKey(index uint64) []byte {
+	key := make([]byte, len(entryPrefix)+8)
+	copy(key, entryPrefix)
+	binary.BigEndian.PutUint64(key[len(entryPrefix):], index)
+	return key
+}
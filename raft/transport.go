@@ -0,0 +1,164 @@
+package raft
+
+import (
+	"context"
+	"sync"
+)
+
+// RequestVoteRequest 候选人请求投票
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest leader 复制日志条目，没有条目时作为心跳
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// 失败时 leader 下一次从该位置开始重试
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest leader 分块发送快照，每个请求携带快照目录中一个文件的一段数据
+// Seq 从 0 开始连续递增，follower 收到 Seq 为 0 的分块时丢弃之前没有接收完的快照
+// 最后一个请求的 Done 为 true 且不携带数据，follower 收到之后安装快照
+type InstallSnapshotRequest struct {
+	Term              uint64
+	LeaderID          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Seq               uint64 // 分块的序号
+	File              string // 文件在快照目录中的相对路径
+	Offset            int64  // 分块在文件中的偏移
+	Data              []byte
+	Done              bool // 快照中的所有文件都已经发送
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Handler 处理其他节点发送过来的 RPC 请求，由 Node 实现
+type Handler interface {
+	RequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Transport 节点之间的通信接口
+type Transport interface {
+	// Serve 开始接收发往当前节点的请求
+	Serve(handler Handler) error
+
+	RequestVote(ctx context.Context, target string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+
+	// Close 停止接收请求
+	Close() error
+}
+
+// InmemNetwork 进程内的网络，用于测试以及单进程部署，可以模拟节点之间的网络分区
+type InmemNetwork struct {
+	mu           sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Transport 获取节点 id 对应的传输层
+func (nw *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{network: nw, id: id}
+}
+
+// Disconnect 断开节点和其他所有节点之间的连接
+func (nw *InmemNetwork) Disconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.disconnected[id] = true
+}
+
+// Connect 恢复节点的连接
+func (nw *InmemNetwork) Connect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.disconnected, id)
+}
+
+func (nw *InmemNetwork) handler(from, target string) (Handler, error) {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	if nw.disconnected[from] || nw.disconnected[target] {
+		return nil, ErrUnreachable
+	}
+	handler, ok := nw.handlers[target]
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	return handler, nil
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+	id      string
+}
+
+func (t *inmemTransport) Serve(handler Handler) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.network.handlers[t.id] = handler
+	return nil
+}
+
+func (t *inmemTransport) RequestVote(ctx context.Context, target string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	handler, err := t.network.handler(t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.RequestVote(req)
+}
+
+func (t *inmemTransport) AppendEntries(ctx context.Context, target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	handler, err := t.network.handler(t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.AppendEntries(req)
+}
+
+func (t *inmemTransport) InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	handler, err := t.network.handler(t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.InstallSnapshot(req)
+}
+
+func (t *inmemTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.handlers, t.id)
+	return nil
+}
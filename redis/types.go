@@ -120,7 +120,10 @@ func (rds *RedisDataStructure) HSet(key []byte, field []byte, value []byte) (boo
 	}
 
 	// 采用writeBatch保证原子性
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	if err != nil {
+		return false, err
+	}
 
 	// 不存在更新meta
 	if !exist {
@@ -189,7 +192,10 @@ func (rds *RedisDataStructure) HDel(key []byte, field []byte) (bool, error) {
 	}
 
 	if exist {
-		wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+		wb, err := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+		if err != nil {
+			return false, err
+		}
 		meta.size--
 		_ = wb.Put(key, meta.encodeMetadata())
 
@@ -227,7 +233,10 @@ func (rds *RedisDataStructure) SAdd(key []byte, member []byte) (bool, error) {
 	var ok bool
 	// 如果可以找到的话说明set中这个数据已经存在了，不用进行操作
 	if _, err = rds.db.Get(enSik); err == bitcask.ErrKeyNotFound {
-		wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+		wb, err := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+		if err != nil {
+			return false, err
+		}
 		meta.size++
 		_ = wb.Put(key, meta.encodeMetadata())
 		_ = wb.Put(enSik, nil)
@@ -299,7 +308,10 @@ func (rds *RedisDataStructure) SRem(key []byte, member []byte) (bool, error) {
 	}
 
 	// 更新元数据和数据
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	if err != nil {
+		return false, err
+	}
 	meta.size--
 	_ = wb.Put(key, meta.encodeMetadata())
 	_ = wb.Delete(enSik)
@@ -341,7 +353,10 @@ func (rds *RedisDataStructure) pushInner(key []byte, element []byte, isLeft bool
 	enLik := lik.encode()
 
 	// 更新元数据和数据
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	if err != nil {
+		return 0, err
+	}
 
 	meta.size++
 	if isLeft {
@@ -443,7 +458,10 @@ func (rds *RedisDataStructure) ZADD(key []byte, member []byte, score float64) (b
 		}
 	}
 
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	if err != nil {
+		return false, err
+	}
 	if !exist {
 		meta.size++
 		_ = wb.Put(key, meta.encodeMetadata())
@@ -0,0 +1,178 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"io"
+)
+
+// LogPosition 数据文件中的位置，用于主从复制
+type LogPosition struct {
+	Fid    uint32 // 文件 id
+	Offset int64  // 偏移
+}
+
+// LogPosition 返回当前已经写入的数据的结束位置
+func (db *DB) LogPosition() LogPosition {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.activeFile == nil {
+		return LogPosition{}
+	}
+	return LogPosition{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff}
+}
+
+// ReadRawLog 读取 pos 位置开始的下一条记录编码之后的原始数据，并返回这条记录实际所在的位置
+// 当前文件读完之后会自动切换到下一个数据文件，已经读到最新的数据时返回 io.EOF
+// pos 位于已经被 merge 重写过的数据文件中时返回 ErrResyncRequired，从节点需要重新全量同步
+func (db *DB) ReadRawLog(pos LogPosition) ([]byte, LogPosition, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// 被重写过的数据文件和从节点上的内容不同，即使还没有删除也不能继续读取
+	if pos.Fid < db.compactedFileId {
+		return nil, pos, ErrResyncRequired
+	}
+
+	if db.activeFile == nil {
+		if pos == (LogPosition{}) {
+			return nil, pos, io.EOF
+		}
+		return nil, pos, ErrInvalidLogPosition
+	}
+
+	for {
+		dataFile := db.getDataFile(pos.Fid)
+		if dataFile == nil {
+			return nil, pos, ErrInvalidLogPosition
+		}
+
+		// 活跃文件以 WriteOff 为准，旧的数据文件以文件大小为准
+		var end = dataFile.WriteOff
+		if dataFile != db.activeFile {
+			size, err := dataFile.IoManager.Size()
+			if err != nil {
+				return nil, pos, err
+			}
+			end = size
+		}
+		if pos.Offset > end {
+			return nil, pos, ErrInvalidLogPosition
+		}
+
+		var logRecordSize int64
+		if pos.Offset < end {
+			_, size, err := dataFile.ReadLogRecord(pos.Offset)
+			if err != nil && err != io.EOF {
+				return nil, pos, err
+			}
+			logRecordSize = size
+		}
+
+		// 当前文件已经读完，切换到下一个数据文件
+		if logRecordSize == 0 {
+			if dataFile == db.activeFile {
+				return nil, pos, io.EOF
+			}
+			pos = LogPosition{Fid: db.nextFileId(pos.Fid), Offset: 0}
+			continue
+		}
+
+		raw := make([]byte, logRecordSize)
+		if _, err := dataFile.IoManager.Read(raw, pos.Offset); err != nil {
+			return nil, pos, err
+		}
+		return raw, pos, nil
+	}
+}
+
+// ApplyRawLog 将主节点的原始记录写入到相同的文件和位置，并更新内存索引
+// 只有以 Options.Replica 打开的从节点可以调用，从节点需要按照顺序应用记录，位置不连续时返回 ErrInvalidLogPosition
+func (db *DB) ApplyRawLog(pos LogPosition, raw []byte) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if !db.options.Replica {
+		return ErrNotReplica
+	}
+	logRecord, size, err := data.DecodeLogRecord(raw)
+	if err != nil {
+		return err
+	}
+	if size != int64(len(raw)) {
+		return data.ErrInvalidCRC
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 主节点切换了活跃文件
+	if db.activeFile == nil || pos.Fid != db.activeFile.FileId {
+		if db.activeFile != nil && pos.Fid < db.activeFile.FileId {
+			return ErrInvalidLogPosition
+		}
+		if pos.Offset != 0 {
+			return ErrInvalidLogPosition
+		}
+		// 和加载数据文件时一样查找冷存储目录，文件可能已经被移动到冷存储目录中
+		dataFile, err := data.OpenDataFile(db.options.DirPath, pos.Fid, db.options.IOType, db.coldDirPaths()...)
+		if err != nil {
+			return err
+		}
+		if db.activeFile != nil {
+			if err := db.sealActiveFile(); err != nil {
+				return err
+			}
+			db.olderFiles[db.activeFile.FileId] = db.activeFile
+		}
+		sealedFile := db.activeFile
+		db.activeFile = dataFile
+		if sealedFile != nil {
+			db.fileRotated(sealedFile)
+		}
+	}
+	if pos.Offset != db.activeFile.WriteOff {
+		return ErrInvalidLogPosition
+	}
+
+	if err := db.activeFile.Write(raw); err != nil {
+		return err
+	}
+	if err := db.flushActiveFile(); err != nil {
+		return err
+	}
+	if db.options.SyncWrites {
+		if err := db.syncActiveFile(); err != nil {
+			return err
+		}
+	}
+
+	// 更新内存索引
+	if db.replicaTxns == nil {
+		db.replicaTxns = make(map[uint64][]*data.TransactionRecord)
+	}
+	logRecordPos := &data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset, Size: uint32(size)}
+	seqNo, err := db.replayLogRecord(logRecord, logRecordPos, db.replicaTxns)
+	if err != nil {
+		return err
+	}
+	if seqNo > db.seqNo {
+		db.seqNo = seqNo
+	}
+	return nil
+}
+
+// 只读实例和复制的从节点都不接受用户写入和 merge
+func (db *DB) readOnly() bool {
+	return db.options.ReadOnly || db.options.Replica
+}
+
+// 获取比 fid 大的下一个数据文件 id
+func (db *DB) nextFileId(fid uint32) uint32 {
+	next := db.activeFile.FileId
+	for id := range db.olderFiles {
+		if id > fid && id < next {
+			next = id
+		}
+	}
+	return next
+}
@@ -0,0 +1,126 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ApplyRawLog(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-replica-leader")
+	opts.DirPath = dir
+	leader, err := Open(opts)
+	defer destroyDB(leader)
+	assert.Nil(t, err)
+	assert.Nil(t, leader.Put(utils.GetTestKey(1), []byte("v1")))
+	raw, pos, err := leader.ReadRawLog(LogPosition{})
+	assert.Nil(t, err)
+
+	// 只读实例和普通实例都不能应用主节点的记录
+	replicaOpts := DefaultOptions
+	replicaOpts.DirPath, _ = os.MkdirTemp("", "db-bitcask-replica-follower")
+	db, err := Open(replicaOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrNotReplica, db.ApplyRawLog(pos, raw))
+	assert.Nil(t, db.Close())
+
+	replicaOpts.ReadOnly = true
+	db, err = Open(replicaOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrReadOnly, db.ApplyRawLog(pos, raw))
+	assert.Nil(t, db.Close())
+
+	// 从节点可以应用记录，但不接受用户写入
+	replicaOpts.ReadOnly = false
+	replicaOpts.Replica = true
+	replica, err := Open(replicaOpts)
+	defer destroyDB(replica)
+	assert.Nil(t, err)
+	assert.Nil(t, replica.ApplyRawLog(pos, raw))
+	val, err := replica.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.Equal(t, ErrReadOnly, replica.Put(utils.GetTestKey(2), []byte("v2")))
+	assert.Equal(t, ErrReadOnly, replica.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, replica.Merge())
+}
+
+func TestDB_ReadRawLog_Compacted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-replica-compacted")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	pos := db.LogPosition()
+	_, _, err = db.ReadRawLog(pos)
+	assert.Equal(t, io.EOF, err)
+
+	// 打开的迭代器使旧的数据文件在 merge 之后仍然保留，但是其中的位置已经失效
+	iter := db.NewIterator(IteratorOptions{})
+	assert.Nil(t, db.Merge())
+	assert.NotNil(t, db.getDataFile(pos.Fid))
+	_, _, err = db.ReadRawLog(pos)
+	assert.Equal(t, ErrResyncRequired, err)
+	_, _, err = db.ReadRawLog(LogPosition{})
+	assert.Equal(t, ErrResyncRequired, err)
+	iter.Close()
+
+	// 重启之后仍然生效
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, _, err = db.ReadRawLog(pos)
+	assert.Equal(t, ErrResyncRequired, err)
+	_, _, err = db.ReadRawLog(db.LogPosition())
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDB_ApplyRawLog_ColdDir(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-replica-cold-leader")
+	opts.DirPath = dir
+	leader, err := Open(opts)
+	defer destroyDB(leader)
+	assert.Nil(t, err)
+	assert.Nil(t, leader.Put(utils.GetTestKey(1), []byte("v1")))
+	raw, pos, err := leader.ReadRawLog(LogPosition{})
+	assert.Nil(t, err)
+
+	// 数据文件已经位于从节点的冷存储目录中
+	replicaOpts := DefaultOptions
+	replicaOpts.DirPath, _ = os.MkdirTemp("", "db-bitcask-replica-cold-follower")
+	replicaOpts.ColdDirPath, _ = os.MkdirTemp("", "db-bitcask-replica-cold")
+	replicaOpts.Replica = true
+	defer func() {
+		_ = os.RemoveAll(replicaOpts.ColdDirPath)
+	}()
+	replica, err := Open(replicaOpts)
+	defer destroyDB(replica)
+	assert.Nil(t, err)
+	coldFile := data.GetDataFileName(replicaOpts.ColdDirPath, pos.Fid)
+	assert.Nil(t, os.WriteFile(coldFile, nil, 0644))
+
+	assert.Nil(t, replica.ApplyRawLog(pos, raw))
+	_, err = os.Stat(data.GetDataFileName(replicaOpts.DirPath, pos.Fid))
+	assert.True(t, os.IsNotExist(err))
+	content, err := os.ReadFile(coldFile)
+	assert.Nil(t, err)
+	assert.Equal(t, raw, content)
+	val, err := replica.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
@@ -0,0 +1,257 @@
+package replication
+
+import (
+	"bufio"
+	bitcask "db-bitcask"
+	"db-bitcask/data"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 和主节点断开之后重连的间隔
+const reconnectInterval = 500 * time.Millisecond
+
+// Follower 复制从节点，只应用主节点推送的数据，不接受用户写入
+type Follower struct {
+	options    bitcask.Options
+	leaderAddr string
+	mu         sync.RWMutex
+	db         *bitcask.DB
+	conn       net.Conn
+	closed     chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewFollower 打开从节点并连接到主节点，数据目录为空时会先从主节点全量同步
+func NewFollower(options bitcask.Options, leaderAddr string) (*Follower, error) {
+	options.Replica = true
+	f := &Follower{
+		options:    options,
+		leaderAddr: leaderAddr,
+		closed:     make(chan struct{}),
+	}
+
+	hasData, err := hasDataFiles(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if hasData {
+		db, err := bitcask.Open(options)
+		if err != nil {
+			return nil, err
+		}
+		f.db = db
+	}
+
+	f.wg.Add(1)
+	go f.run()
+	return f, nil
+}
+
+// DB 从节点的存储引擎实例，全量同步完成之前为 nil
+func (f *Follower) DB() *bitcask.DB {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.db
+}
+
+// Get 从从节点读取数据，全量同步完成之前返回 ErrNotReady
+func (f *Follower) Get(key []byte) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.db == nil {
+		return nil, ErrNotReady
+	}
+	return f.db.Get(key)
+}
+
+// Position 当前的复制位置，全量同步完成之前返回 ErrNotReady
+func (f *Follower) Position() (bitcask.LogPosition, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.db == nil {
+		return bitcask.LogPosition{}, ErrNotReady
+	}
+	return f.db.LogPosition(), nil
+}
+
+// Close 断开和主节点的连接并关闭从节点
+func (f *Follower) Close() error {
+	close(f.closed)
+	f.mu.Lock()
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db == nil {
+		return nil
+	}
+	return f.db.Close()
+}
+
+func (f *Follower) run() {
+	defer f.wg.Done()
+	for {
+		conn, err := net.DialTimeout("tcp", f.leaderAddr, reconnectInterval)
+		if err == nil {
+			f.mu.Lock()
+			f.conn = conn
+			f.mu.Unlock()
+			_ = f.replicate(conn)
+			_ = conn.Close()
+		}
+
+		select {
+		case <-f.closed:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// 和主节点完成握手，然后持续应用推送过来的数据
+func (f *Follower) replicate(conn net.Conn) error {
+	select {
+	case <-f.closed:
+		return nil
+	default:
+	}
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if err := f.sendHello(writer); err != nil {
+		return err
+	}
+
+	var inSnapshot bool
+	for {
+		typ, payload, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case msgSnapshotFile:
+			if !inSnapshot {
+				if err := f.resetDB(); err != nil {
+					return err
+				}
+				inSnapshot = true
+			}
+			name, size, err := decodeSnapshotFile(payload)
+			if err != nil {
+				return err
+			}
+			if err := f.receiveFile(reader, name, size); err != nil {
+				return err
+			}
+		case msgSnapshotEnd:
+			if !inSnapshot {
+				if err := f.resetDB(); err != nil {
+					return err
+				}
+			}
+			inSnapshot = false
+			db, err := bitcask.Open(f.options)
+			if err != nil {
+				return err
+			}
+			f.mu.Lock()
+			f.db = db
+			f.mu.Unlock()
+			// 全量同步完成之后从新的位置开始增量同步
+			if err := f.sendHello(writer); err != nil {
+				return err
+			}
+		case msgRecord:
+			pos, raw, err := decodeRecord(payload)
+			if err != nil {
+				return err
+			}
+			f.mu.RLock()
+			db := f.db
+			f.mu.RUnlock()
+			if db == nil {
+				return ErrInvalidMessage
+			}
+			if err := db.ApplyRawLog(pos, raw); err != nil {
+				return err
+			}
+		default:
+			return ErrInvalidMessage
+		}
+	}
+}
+
+func (f *Follower) sendHello(writer *bufio.Writer) error {
+	f.mu.RLock()
+	needSnapshot := f.db == nil
+	var pos bitcask.LogPosition
+	if f.db != nil {
+		pos = f.db.LogPosition()
+	}
+	f.mu.RUnlock()
+
+	if err := writeFrame(writer, msgHello, encodeHello(pos, needSnapshot)); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// 关闭当前实例并清空数据目录，准备接收全量同步的文件
+func (f *Follower) resetDB() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db != nil {
+		if err := f.db.Close(); err != nil {
+			return err
+		}
+		f.db = nil
+	}
+	if err := os.RemoveAll(f.options.DirPath); err != nil {
+		return err
+	}
+	return os.MkdirAll(f.options.DirPath, os.ModePerm)
+}
+
+func (f *Follower) receiveFile(reader io.Reader, name string, size int64) error {
+	path := filepath.Join(f.options.DirPath, filepath.Clean("/"+name))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err := io.CopyN(file, reader, size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// 数据目录中是否已经有数据文件
+func hasDataFiles(dirPath string) (bool, error) {
+	entries, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if data.IsDataFileName(entry.Name()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
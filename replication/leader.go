@@ -0,0 +1,244 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	bitcask "db-bitcask"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 没有新数据时轮询数据文件的间隔，流式写入的分块不会触发变更通知
+const pollInterval = 100 * time.Millisecond
+
+// 缓冲的数据超过该值之后立即发送
+const flushThreshold = 64 * 1024
+
+// FollowerStatus 从节点的复制状态
+type FollowerStatus struct {
+	Addr     string              // 从节点地址
+	Position bitcask.LogPosition // 已经发送给从节点的位置
+}
+
+// Leader 复制主节点，将追加写入的数据推送给从节点
+type Leader struct {
+	db        *bitcask.DB
+	listener  net.Listener
+	mu        sync.Mutex
+	followers map[net.Conn]*FollowerStatus
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewLeader 在 addr 上监听从节点的连接
+func NewLeader(db *bitcask.DB, addr string) (*Leader, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Leader{
+		db:        db,
+		listener:  listener,
+		followers: make(map[net.Conn]*FollowerStatus),
+		closed:    make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.accept()
+	return l, nil
+}
+
+// Addr 监听的地址
+func (l *Leader) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Followers 所有已连接的从节点的复制状态
+func (l *Leader) Followers() []FollowerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var status []FollowerStatus
+	for _, s := range l.followers {
+		status = append(status, *s)
+	}
+	return status
+}
+
+// Close 关闭主节点，断开所有从节点
+func (l *Leader) Close() error {
+	close(l.closed)
+	err := l.listener.Close()
+	l.mu.Lock()
+	for conn := range l.followers {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Leader) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.followers[conn] = &FollowerStatus{Addr: conn.RemoteAddr().String()}
+		l.mu.Unlock()
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			_ = l.serve(conn)
+			_ = conn.Close()
+			l.mu.Lock()
+			delete(l.followers, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+// 处理一个从节点的连接，先完成握手和全量同步，然后持续推送增量数据
+func (l *Leader) serve(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	var pos bitcask.LogPosition
+	for {
+		typ, payload, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		if typ != msgHello {
+			return ErrInvalidMessage
+		}
+		var needSnapshot bool
+		pos, needSnapshot, err = decodeHello(payload)
+		if err != nil {
+			return err
+		}
+
+		// 从节点的位置在主节点上已经不存在了，同样需要全量同步
+		if !needSnapshot {
+			_, _, err := l.db.ReadRawLog(pos)
+			if err == bitcask.ErrInvalidLogPosition || err == bitcask.ErrResyncRequired {
+				needSnapshot = true
+			}
+		}
+		if !needSnapshot {
+			break
+		}
+		if err := l.sendSnapshot(writer); err != nil {
+			return err
+		}
+	}
+
+	// 从节点断开之后结束推送
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		cancel()
+	}()
+	return l.stream(ctx, writer, conn, pos)
+}
+
+// 持续推送 pos 之后的增量数据
+func (l *Leader) stream(ctx context.Context, writer *bufio.Writer, conn net.Conn, pos bitcask.LogPosition) error {
+	changes, err := l.db.Watch(ctx, nil)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		raw, recordPos, err := l.db.ReadRawLog(pos)
+		if err == io.EOF {
+			// 已经发送了所有的数据，等待新的写入
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			select {
+			case <-changes:
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-l.closed:
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := writeFrame(writer, msgRecord, encodeRecord(recordPos, raw)); err != nil {
+			return err
+		}
+		if writer.Buffered() >= flushThreshold {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+		pos = bitcask.LogPosition{Fid: recordPos.Fid, Offset: recordPos.Offset + int64(len(raw))}
+
+		l.mu.Lock()
+		if status, ok := l.followers[conn]; ok {
+			status.Position = pos
+		}
+		l.mu.Unlock()
+	}
+}
+
+// 全量同步，复用 Backup 的逻辑拷贝所有文件之后发送给从节点
+func (l *Leader) sendSnapshot(writer *bufio.Writer) error {
+	dir, err := os.MkdirTemp("", "bitcask-replication-snapshot")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if err := l.db.Backup(dir); err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if err := writeFrame(writer, msgSnapshotFile, encodeSnapshotFile(name, info.Size())); err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		_, err = io.CopyN(writer, file, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(writer, msgSnapshotEnd, nil); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,146 @@
+package replication
+
+import (
+	"bufio"
+	bitcask "db-bitcask"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// 单个消息的最大长度
+const maxFrameSize = 1 << 30
+
+const (
+	// 从节点发送的握手消息，携带当前的复制位置
+	msgHello byte = iota + 1
+
+	// 全量同步的文件，消息之后紧跟文件内容
+	msgSnapshotFile
+
+	// 全量同步结束
+	msgSnapshotEnd
+
+	// 增量同步的一条记录，携带文件 id 和偏移
+	msgRecord
+)
+
+var (
+	ErrInvalidMessage = errors.New("invalid replication message")
+	ErrNotReady       = errors.New("the follower is not ready, full sync is in progress")
+)
+
+// 消息格式: type | length | payload
+func writeFrame(w *bufio.Writer, typ byte, payload []byte) error {
+	header := make([]byte, 1+binary.MaxVarintLen64)
+	header[0] = typ
+	n := binary.PutUvarint(header[1:], uint64(len(payload)))
+	if _, err := w.Write(header[:1+n]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxFrameSize {
+		return 0, nil, ErrInvalidMessage
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return typ, payload, nil
+}
+
+// 编码复制位置
+func encodePosition(buf []byte, pos bitcask.LogPosition) int {
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(pos.Fid))
+	index += binary.PutVarint(buf[index:], pos.Offset)
+	return index
+}
+
+// 解码复制位置
+func decodePosition(buf []byte) (bitcask.LogPosition, int, error) {
+	var index = 0
+	fid, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return bitcask.LogPosition{}, 0, ErrInvalidMessage
+	}
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return bitcask.LogPosition{}, 0, ErrInvalidMessage
+	}
+	index += n
+	return bitcask.LogPosition{Fid: uint32(fid), Offset: offset}, index, nil
+}
+
+// 握手消息: position | needSnapshot
+func encodeHello(pos bitcask.LogPosition, needSnapshot bool) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64+1)
+	index := encodePosition(buf, pos)
+	if needSnapshot {
+		buf[index] = 1
+	}
+	return buf[:index+1]
+}
+
+func decodeHello(buf []byte) (bitcask.LogPosition, bool, error) {
+	pos, index, err := decodePosition(buf)
+	if err != nil {
+		return pos, false, err
+	}
+	if index >= len(buf) {
+		return pos, false, ErrInvalidMessage
+	}
+	return pos, buf[index] == 1, nil
+}
+
+// 增量记录消息: position | raw log record
+func encodeRecord(pos bitcask.LogPosition, raw []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64+len(raw))
+	index := encodePosition(buf, pos)
+	index += copy(buf[index:], raw)
+	return buf[:index]
+}
+
+func decodeRecord(buf []byte) (bitcask.LogPosition, []byte, error) {
+	pos, index, err := decodePosition(buf)
+	if err != nil {
+		return pos, nil, err
+	}
+	return pos, buf[index:], nil
+}
+
+// 全量同步文件消息: name length | name | file size
+func encodeSnapshotFile(name string, size int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2+len(name))
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(len(name)))
+	index += copy(buf[index:], name)
+	index += binary.PutVarint(buf[index:], size)
+	return buf[:index]
+}
+
+func decodeSnapshotFile(buf []byte) (string, int64, error) {
+	nameLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < nameLen {
+		return "", 0, ErrInvalidMessage
+	}
+	name := string(buf[n : n+int(nameLen)])
+	size, m := binary.Varint(buf[n+int(nameLen):])
+	if m <= 0 || size < 0 {
+		return "", 0, ErrInvalidMessage
+	}
+	return name, size, nil
+}
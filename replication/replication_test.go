@@ -0,0 +1,134 @@
+package replication
+
+import (
+	bitcask "db-bitcask"
+	"db-bitcask/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 等待从节点追上主节点
+func waitForValue(t *testing.T, f *Follower, key, value []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		val, err := f.Get(key)
+		if err == nil && string(val) == string(value) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("follower did not replicate key %s", key)
+}
+
+func waitForDeleted(t *testing.T, f *Follower, key []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := f.Get(key); err == bitcask.ErrKeyNotFound {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("follower did not replicate delete of key %s", key)
+}
+
+func TestReplication(t *testing.T) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-replication-leader")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 从节点连接之前已经存在的数据通过全量同步获取
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+
+	leader, err := NewLeader(db, "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() {
+		_ = leader.Close()
+	}()
+
+	followerOpts := bitcask.DefaultOptions
+	followerDir, _ := os.MkdirTemp("", "db-bitcask-replication-follower")
+	followerOpts.DirPath = followerDir
+	defer func() {
+		_ = os.RemoveAll(followerDir)
+	}()
+	follower, err := NewFollower(followerOpts, leader.Addr().String())
+	assert.Nil(t, err)
+
+	val, err := db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	waitForValue(t, follower, utils.GetTestKey(999), val)
+
+	// 增量同步，跨越多个数据文件
+	for i := 1000; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	val, err = db.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	waitForValue(t, follower, utils.GetTestKey(1999), val)
+
+	// 删除和批量写入
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb, err := db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Put(utils.GetTestKey(3000), []byte("batch"))
+	assert.Nil(t, wb.Commit())
+	waitForDeleted(t, follower, utils.GetTestKey(1))
+	waitForValue(t, follower, utils.GetTestKey(3000), []byte("batch"))
+	pos, err := follower.Position()
+	assert.Nil(t, err)
+	assert.Equal(t, db.LogPosition(), pos)
+	assert.Equal(t, 1, len(leader.Followers()))
+
+	// 从节点是只读的
+	err = follower.DB().Put(utils.GetTestKey(1), []byte("x"))
+	assert.Equal(t, bitcask.ErrReadOnly, err)
+
+	// 从节点重启之后从上次的位置继续同步
+	err = follower.Close()
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(4000), []byte("after restart"))
+	assert.Nil(t, err)
+
+	follower2, err := NewFollower(followerOpts, leader.Addr().String())
+	assert.Nil(t, err)
+	defer func() {
+		_ = follower2.Close()
+	}()
+	waitForValue(t, follower2, utils.GetTestKey(4000), []byte("after restart"))
+	waitForValue(t, follower2, utils.GetTestKey(3000), []byte("batch"))
+}
+
+func TestFollower_NotReady(t *testing.T) {
+	followerOpts := bitcask.DefaultOptions
+	followerDir, _ := os.MkdirTemp("", "db-bitcask-replication-not-ready")
+	followerOpts.DirPath = followerDir
+	defer func() {
+		_ = os.RemoveAll(followerDir)
+	}()
+
+	// 主节点不可用，全量同步无法完成，从节点不能当作空的数据库
+	follower, err := NewFollower(followerOpts, "127.0.0.1:1")
+	assert.Nil(t, err)
+	defer func() {
+		_ = follower.Close()
+	}()
+	_, err = follower.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrNotReady, err)
+	_, err = follower.Position()
+	assert.Equal(t, ErrNotReady, err)
+}
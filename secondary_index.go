@@ -0,0 +1,309 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/data"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// 二级索引派生的 key 的前缀，这类 key 对 ListKeys、Fold、迭代器以及变更事件不可见
+// 派生 key 的格式: 前缀 | 索引名称 | 0 | 索引项长度 | 索引项 | 主键，value 为空
+var secondaryIndexPrefix = []byte("\x00\x00bitcask-index\x00")
+
+// 重建索引时每个批次处理的数据量
+const rebuildIndexBatchSize = 1000
+
+// IndexExtractor 从 key/value 中提取二级索引的索引项，返回空表示该数据不需要被索引
+type IndexExtractor func(key []byte, value []byte) [][]byte
+
+// RegisterIndex 注册二级索引，之后的写入会在同一个事务中更新索引
+// 索引的定义不会被持久化，每次打开数据库之后都需要重新注册，已经存在的数据需要调用 RebuildIndex 建立索引
+// 通过 PutStream 写入的 value 不会被索引，覆盖写时会删除旧的值的索引项
+// 注册之后所有的写入都通过事务完成，B+ 树索引不能使用事务时返回 ErrWriteBatchUnavailable
+func (db *DB) RegisterIndex(name string, extractor IndexExtractor) error {
+	if len(name) == 0 || bytes.IndexByte([]byte(name), 0) >= 0 || extractor == nil {
+		return ErrInvalidIndexName
+	}
+	if !db.writeBatchAvailable() {
+		return ErrWriteBatchUnavailable
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.secondaryIndexes == nil {
+		db.secondaryIndexes = make(map[string]IndexExtractor)
+	}
+	db.secondaryIndexes[name] = extractor
+	return nil
+}
+
+// QueryIndex 查询索引项为 term 的所有数据的 key，按照 key 有序
+func (db *DB) QueryIndex(name string, term []byte) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if _, ok := db.secondaryIndexes[name]; !ok {
+		return nil, ErrIndexNotFound
+	}
+
+	prefix := indexTermPrefix(name, term)
+	var keys [][]byte
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, copyBytes(key[len(prefix):]))
+	}
+	return keys, nil
+}
+
+// RebuildIndex 删除索引中已有的数据，然后根据所有数据的当前值重新建立索引
+// 重建分为多个批次进行，期间的并发写入会正常维护索引
+func (db *DB) RebuildIndex(name string) error {
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	db.mu.RLock()
+	_, ok := db.secondaryIndexes[name]
+	db.mu.RUnlock()
+	if !ok {
+		return ErrIndexNotFound
+	}
+
+	// 删除已有的索引数据
+	prefix := indexNamePrefix(name)
+	var derivedKeys [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Seek(prefix); iterator.Valid(); iterator.Next() {
+		if !bytes.HasPrefix(iterator.Key(), prefix) {
+			break
+		}
+		// B+ 树索引的迭代器返回的 key 在迭代器关闭之后不再有效
+		derivedKeys = append(derivedKeys, copyBytes(iterator.Key()))
+	}
+	iterator.Close()
+	for len(derivedKeys) > 0 {
+		n := rebuildIndexBatchSize
+		if n > len(derivedKeys) {
+			n = len(derivedKeys)
+		}
+		wb, err := db.newInternalWriteBatch()
+		if err != nil {
+			return err
+		}
+		for _, key := range derivedKeys[:n] {
+			wb.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+		}
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+		derivedKeys = derivedKeys[n:]
+	}
+
+	// 提交时根据每个 key 的当前值重新写入索引数据
+	var keys [][]byte
+	iterator = db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if !isSecondaryIndexKey(iterator.Key()) {
+			keys = append(keys, copyBytes(iterator.Key()))
+		}
+	}
+	iterator.Close()
+	for len(keys) > 0 {
+		n := rebuildIndexBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		wb, err := db.newInternalWriteBatch()
+		if err != nil {
+			return err
+		}
+		wb.reindex = name
+		wb.reindexKeys = keys[:n]
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// 提交事务时同时写入的索引数据，调用方需要持有 db.mu
+func (db *DB) indexRecords(pendingWrites map[string]*data.LogRecord) (map[string]*data.LogRecord, error) {
+	records := make(map[string]*data.LogRecord, len(pendingWrites))
+	for k, record := range pendingWrites {
+		records[k] = record
+	}
+	for _, record := range pendingWrites {
+		if isSecondaryIndexKey(record.Key) {
+			continue
+		}
+		oldValue, err := db.currentValue(record.Key)
+		if err != nil {
+			return nil, err
+		}
+		for name, extractor := range db.secondaryIndexes {
+			var oldTerms, newTerms [][]byte
+			if oldValue != nil {
+				oldTerms = extractor(record.Key, oldValue)
+			}
+			if record.Type == data.LogRecordNormal {
+				newTerms = extractor(record.Key, record.Value)
+			}
+			addIndexRecords(records, name, record.Key, oldTerms, newTerms)
+		}
+	}
+	return records, nil
+}
+
+// 根据 key 的当前值写入单个索引的数据，用于重建索引，调用方需要持有 db.mu
+func (db *DB) reindexRecords(records map[string]*data.LogRecord, name string, keys [][]byte) error {
+	extractor := db.secondaryIndexes[name]
+	if extractor == nil {
+		return ErrIndexNotFound
+	}
+	for _, key := range keys {
+		value, err := db.currentValue(key)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			addIndexRecords(records, name, key, nil, extractor(key, value))
+		}
+	}
+	return nil
+}
+
+// 获取 key 当前的值，不存在时返回 nil，调用方需要持有 db.mu
+func (db *DB) currentValue(key []byte) ([]byte, error) {
+	pos, err := db.index.Get(key)
+	if err != nil || pos == nil {
+		return nil, err
+	}
+	value, err := db.getValueByPosition(pos)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, err
+}
+
+// 删除旧的值中不再存在的索引项，写入新的值中增加的索引项
+func addIndexRecords(records map[string]*data.LogRecord, name string, key []byte, oldTerms, newTerms [][]byte) {
+	sortTerms := func(terms [][]byte) {
+		sort.Slice(terms, func(i, j int) bool {
+			return bytes.Compare(terms[i], terms[j]) < 0
+		})
+	}
+	sortTerms(oldTerms)
+	sortTerms(newTerms)
+
+	contains := func(terms [][]byte, term []byte) bool {
+		idx := sort.Search(len(terms), func(i int) bool {
+			return bytes.Compare(terms[i], term) >= 0
+		})
+		return idx < len(terms) && bytes.Equal(terms[idx], term)
+	}
+	for _, term := range oldTerms {
+		if !contains(newTerms, term) {
+			derivedKey := indexKey(name, term, key)
+			records[string(derivedKey)] = &data.LogRecord{Key: derivedKey, Type: data.LogRecordDeleted}
+		}
+	}
+	for _, term := range newTerms {
+		if !contains(oldTerms, term) {
+			derivedKey := indexKey(name, term, key)
+			records[string(derivedKey)] = &data.LogRecord{Key: derivedKey, Type: data.LogRecordNormal}
+		}
+	}
+}
+
+func indexNamePrefix(name string) []byte {
+	prefix := make([]byte, 0, len(secondaryIndexPrefix)+len(name)+1)
+	prefix = append(prefix, secondaryIndexPrefix...)
+	prefix = append(prefix, name...)
+	return append(prefix, 0)
+}
+
+func indexTermPrefix(name string, term []byte) []byte {
+	prefix := indexNamePrefix(name)
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(term)))
+	prefix = append(prefix, buf[:n]...)
+	return append(prefix, term...)
+}
+
+func indexKey(name string, term []byte, key []byte) []byte {
+	return append(indexTermPrefix(name, term), key...)
+}
+
+func isSecondaryIndexKey(key []byte) bool {
+	return bytes.HasPrefix(key, secondaryIndexPrefix)
+}
+
+// 从派生的 key 中解析出主键
+func parseIndexKey(derivedKey []byte) ([]byte, bool) {
+	if !isSecondaryIndexKey(derivedKey) {
+		return nil, false
+	}
+	rest := derivedKey[len(secondaryIndexPrefix):]
+	idx := bytes.IndexByte(rest, 0)
+	if idx < 0 {
+		return nil, false
+	}
+	rest = rest[idx+1:]
+	termSize, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < termSize {
+		return nil, false
+	}
+	return rest[n+int(termSize):], true
+}
+
+// 更新内存索引之后维护派生的 key 的数量，existed 表示更新之前 key 是否在索引中，调用方需要持有 db.mu
+func (db *DB) countIndexKey(key []byte, typ data.LogRecordType, existed bool) {
+	if !isSecondaryIndexKey(key) {
+		return
+	}
+	if typ == data.LogRecordDeleted && existed {
+		db.indexKeyNum--
+	} else if typ != data.LogRecordDeleted && !existed {
+		db.indexKeyNum++
+	}
+}
+
+// 遍历索引统计派生的 key 的数量，只在打开时不会回放数据文件的 B+ 树索引使用
+func (db *DB) scanIndexKeyNum() int64 {
+	var count int64
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Seek(secondaryIndexPrefix); iterator.Valid(); iterator.Next() {
+		if !isSecondaryIndexKey(iterator.Key()) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// 内部使用的批量写，不限制数据量，可以写入派生的 key
+func (db *DB) newInternalWriteBatch() (*WriteBatch, error) {
+	wb, err := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: math.MaxUint32, SyncWrites: db.options.SyncWrites})
+	if err != nil {
+		return nil, err
+	}
+	wb.internal = true
+	return wb, nil
+}
+
+// 注册了二级索引时写入需要通过事务完成
+func (db *DB) hasSecondaryIndexes() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.secondaryIndexes) > 0
+}
@@ -0,0 +1,310 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"context"
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// value 的格式为 city:tag1,tag2
+func cityExtractor(key []byte, value []byte) [][]byte {
+	idx := bytes.IndexByte(value, ':')
+	if idx <= 0 {
+		return nil
+	}
+	return [][]byte{value[:idx]}
+}
+
+func tagExtractor(key []byte, value []byte) [][]byte {
+	idx := bytes.IndexByte(value, ':')
+	if idx < 0 || idx == len(value)-1 {
+		return nil
+	}
+	return bytes.Split(value[idx+1:], []byte(","))
+}
+
+func TestDB_SecondaryIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-secondary-index")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.RegisterIndex("city", cityExtractor)
+	assert.Nil(t, err)
+	err = db.RegisterIndex("tag", tagExtractor)
+	assert.Nil(t, err)
+	err = db.RegisterIndex("", cityExtractor)
+	assert.Equal(t, ErrInvalidIndexName, err)
+
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("beijing:a,b")))
+	assert.Nil(t, db.Put([]byte("user-2"), []byte("shanghai:b")))
+	assert.Nil(t, db.Put([]byte("user-3"), []byte("beijing:")))
+
+	keys, err := db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1"), []byte("user-3")}, keys)
+	keys, err = db.QueryIndex("tag", []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1"), []byte("user-2")}, keys)
+
+	// 更新之后旧的索引项被删除
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("shanghai:a")))
+	keys, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-3")}, keys)
+	keys, err = db.QueryIndex("tag", []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-2")}, keys)
+
+	// 删除
+	assert.Nil(t, db.Delete([]byte("user-2")))
+	keys, err = db.QueryIndex("city", []byte("shanghai"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1")}, keys)
+
+	// 批量写
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Put([]byte("user-4"), []byte("shenzhen:c"))
+	_ = wb.Delete([]byte("user-3"))
+	assert.Nil(t, wb.Commit())
+	keys, err = db.QueryIndex("city", []byte("shenzhen"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-4")}, keys)
+	keys, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	// 索引数据对用户不可见
+	assert.Equal(t, 2, len(db.ListKeys()))
+	var folded int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		folded++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, folded)
+	iter := db.NewIterator(DefaultIteratorOptions)
+	var iterated int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.False(t, isSecondaryIndexKey(iter.Key()))
+		iterated++
+	}
+	iter.Close()
+	assert.Equal(t, 2, iterated)
+
+	err = db.Put(indexKey("city", []byte("x"), []byte("y")), nil)
+	assert.Equal(t, ErrKeyReserved, err)
+	_, err = db.QueryIndex("unknown", []byte("x"))
+	assert.Equal(t, ErrIndexNotFound, err)
+
+	// 重启之后重新注册，索引数据仍然存在
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, db2.RegisterIndex("city", cityExtractor))
+	keys, err = db2.QueryIndex("city", []byte("shanghai"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1")}, keys)
+}
+
+func TestDB_RebuildIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-rebuild-index")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 注册索引之前写入的数据
+	for _, v := range []string{"beijing:", "shanghai:", "beijing:"} {
+		key := []byte("user-" + v + string(rune('0'+len(db.ListKeys()))))
+		assert.Nil(t, db.Put(key, []byte(v)))
+	}
+
+	assert.Nil(t, db.RegisterIndex("city", cityExtractor))
+	keys, err := db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	assert.Nil(t, db.RebuildIndex("city"))
+	keys, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	// 提取规则变化之后重建，旧的索引项被清理
+	assert.Nil(t, db.RegisterIndex("city", func(key []byte, value []byte) [][]byte {
+		return [][]byte{[]byte("all")}
+	}))
+	assert.Nil(t, db.RebuildIndex("city"))
+	keys, err = db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+	keys, err = db.QueryIndex("city", []byte("all"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(keys))
+
+	assert.Equal(t, ErrIndexNotFound, db.RebuildIndex("unknown"))
+}
+
+func TestDB_SecondaryIndex_Events(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-secondary-index-events")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.RegisterIndex("city", cityExtractor))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := db.Watch(ctx, nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("beijing:")))
+	select {
+	case event := <-events:
+		assert.Equal(t, []byte("user-1"), event.Key)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for watch event")
+	}
+	// 索引数据不会产生通知
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event for key %q", event.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDB_SecondaryIndex_PutStream(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-secondary-index-stream")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.RegisterIndex("city", cityExtractor))
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("beijing:a")))
+	assert.Nil(t, db.Put([]byte("user-2"), []byte("beijing:b")))
+
+	// 覆盖写之后旧的索引项被删除，流式写入的 value 不会被索引
+	value := []byte("shanghai:c")
+	err = db.PutStream([]byte("user-1"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	keys, err := db.QueryIndex("city", []byte("beijing"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-2")}, keys)
+	keys, err = db.QueryIndex("city", []byte("shanghai"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+	val, err := db.Get([]byte("user-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// 派生的 key 不计入 key 的数量
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), stat.KeyNum)
+	assert.Equal(t, uint(1), stat.IndexKeyNum)
+
+	// 重启之后流式写入的数据仍然可以读取
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	val, err = db2.Get([]byte("user-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+}
+
+func TestDB_SecondaryIndex_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-secondary-index-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("beijing:a")))
+	assert.Nil(t, db.Close())
+
+	// 没有保存事务序列号的文件时不能使用事务，注册索引之后的写入都需要通过事务完成
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.SeqNoFileName)))
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, ErrWriteBatchUnavailable, db2.RegisterIndex("city", cityExtractor))
+	assert.Nil(t, db2.Put([]byte("user-2"), []byte("beijing:b")))
+}
+
+func TestDB_SecondaryIndex_KeyNum(t *testing.T) {
+	for _, indexType := range []IndexerType{BTree, BPlusTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "db-bitcask-secondary-index-num")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		opts.DataFileMergeRatio = 0
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		// B+ 树索引需要保存过事务序列号之后才能使用事务
+		assert.Nil(t, db.Put([]byte("seed"), nil))
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+
+		// 派生的 key 的数量和索引中的一致
+		checkKeyNum := func(expected uint) {
+			t.Helper()
+			stat, err := db.Stat()
+			assert.Nil(t, err)
+			assert.Equal(t, expected, stat.IndexKeyNum)
+			assert.Equal(t, int64(expected), db.scanIndexKeyNum())
+		}
+		assert.Nil(t, db.RegisterIndex("city", cityExtractor))
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("beijing:")))
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("beijing:")))
+		assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(100)))
+		checkKeyNum(9)
+		assert.Nil(t, db.RebuildIndex("city"))
+		checkKeyNum(9)
+
+		// 重启之后从数据文件以及 merge 生成的 hint 文件中恢复
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkKeyNum(9)
+		if indexType == BTree {
+			assert.Nil(t, db.Merge())
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			checkKeyNum(9)
+		}
+		destroyDB(db)
+	}
+}
@@ -0,0 +1,104 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/fio"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 后台检查是否有需要压缩的旧数据文件的间隔
+const segmentCheckInterval = time.Minute
+
+// CompressSealedFiles 将符合冷数据策略的旧数据文件压缩为只读的段文件，启用 Options.CompressSealedFiles 时后台会定期调用
+// 段文件保留了原始数据中的偏移，索引不需要修改，压缩时不持有锁，只在替换文件的 IOManager 时短暂地阻塞读写
+func (db *DB) CompressSealedFiles() error {
+	if db.readOnly() {
+		return nil
+	}
+	db.moveMu.Lock()
+	defer db.moveMu.Unlock()
+
+	db.mu.RLock()
+	if db.activeFile == nil || db.isMerging {
+		db.mu.RUnlock()
+		return nil
+	}
+	newestFid := db.activeFile.FileId
+	fileIds := make([]int, 0, len(db.olderFiles))
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+	db.mu.RUnlock()
+	sort.Ints(fileIds)
+
+	for _, fid := range fileIds {
+		fileName := data.ResolveDataFileName(db.options.DirPath, uint32(fid), db.coldDirPaths()...)
+		// 已经压缩过的段文件
+		if !strings.HasSuffix(fileName, data.DataFileNameSuffix) {
+			continue
+		}
+		info, err := os.Stat(fileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !db.isColdFile(uint32(fid), newestFid, info.ModTime()) {
+			continue
+		}
+		if err := db.compressDataFile(uint32(fid), fileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在数据文件所在的目录中生成段文件，替换 IOManager 之后删除原来的数据文件
+func (db *DB) compressDataFile(fid uint32, fileName string) error {
+	segFileName := strings.TrimSuffix(fileName, data.DataFileNameSuffix) + data.SegmentFileNameSuffix
+	// 旧的数据文件不会再被修改，压缩时不需要持有锁
+	if err := fio.CreateSegmentFile(fileName, segFileName); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	dataFile := db.olderFiles[fid]
+	// merge 会在锁外读取旧的数据文件，此时不能替换
+	if dataFile == nil || db.isMerging {
+		db.mu.Unlock()
+		return os.Remove(segFileName)
+	}
+	ioManager, err := db.openIOManager(segFileName, db.options.IOType)
+	if err != nil {
+		db.mu.Unlock()
+		_ = os.Remove(segFileName)
+		return err
+	}
+	if err := dataFile.IoManager.Close(); err != nil {
+		_ = ioManager.Close()
+		db.mu.Unlock()
+		_ = os.Remove(segFileName)
+		return err
+	}
+	dataFile.IoManager = ioManager
+	db.mu.Unlock()
+	return os.Remove(fileName)
+}
+
+func (db *DB) compressSealedFilesInBackground() {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(segmentCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			db.backgroundError("compress_sealed_files", db.CompressSealedFiles())
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_CompressSealedFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-segment")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.HotFileNum = 1
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 2)
+	sizeBefore, err := db.totalDirSize()
+	assert.Nil(t, err)
+
+	err = db.CompressSealedFiles()
+	assert.Nil(t, err)
+	activeFid := db.activeFile.FileId
+	for fid := range db.olderFiles {
+		compressed := fid != activeFid-1
+		assert.Equal(t, compressed, fileExists(data.GetSegmentFileName(dir, fid)))
+		assert.Equal(t, !compressed, fileExists(data.GetDataFileName(dir, fid)))
+	}
+	sizeAfter, err := db.totalDirSize()
+	assert.Nil(t, err)
+	assert.True(t, sizeAfter < sizeBefore)
+
+	// 索引中的位置在压缩之后仍然有效
+	for i := 0; i < 5000; i += 7 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	values, err := db.MultiGet([][]byte{utils.GetTestKey(1), utils.GetTestKey(4999)})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{utils.GetTestKey(1), utils.GetTestKey(4999)}, values)
+	iter := db.NewIterator(IteratorOptions{PrefetchSize: 16})
+	count := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		_, err := iter.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 5000, count)
+
+	// 再次调用时已经压缩的文件不会重复压缩
+	err = db.CompressSealedFiles()
+	assert.Nil(t, err)
+
+	// 重新打开时从段文件中加载索引
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 5000, len(db2.ListKeys()))
+	val, err := db2.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(0), val)
+
+	// merge 之后删除旧的段文件
+	for i := 0; i < 2500; i++ {
+		err := db2.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	assert.Equal(t, 2500, len(db3.ListKeys()))
+	assert.False(t, fileExists(data.GetSegmentFileName(dir, 0)))
+	val, err = db3.Get(utils.GetTestKey(4000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(4000), val)
+}
+
+func TestDB_CompressSealedFiles_ColdDir(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-segment-cold")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-segment-cold-dir")
+	defer os.RemoveAll(coldDir)
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 64 * 1024
+	opts.MaxOpenFiles = 2
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 先压缩再移动，段文件同样可以移动到冷存储目录
+	err = db.CompressSealedFiles()
+	assert.Nil(t, err)
+	err = db.MoveColdFiles()
+	assert.Nil(t, err)
+	assert.True(t, fileExists(data.GetSegmentFileName(coldDir, 0)))
+	assert.False(t, fileExists(data.GetSegmentFileName(dir, 0)))
+
+	checkpointDir, _ := os.MkdirTemp("", "bitcask-go-segment-checkpoint")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+	assert.True(t, fileExists(data.GetSegmentFileName(checkpointDir, 0)))
+
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	checkpointOpts := DefaultOptions
+	checkpointOpts.DirPath = checkpointDir
+	db2, err := Open(checkpointOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 5000, len(db2.ListKeys()))
+	val, err = db2.Get(utils.GetTestKey(4999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(4999), val)
+}
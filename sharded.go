@@ -0,0 +1,563 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"container/heap"
+	"db-bitcask/data"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	shardDirPrefix = "shard-"
+
+	// 记录数据已经按照多少个分片完成迁移的文件
+	shardBalancedFileName = "shard-balanced"
+
+	// 每个分片在哈希环上的虚拟节点数量
+	shardVirtualNodes = 128
+)
+
+// ShardedDB 使用一致性哈希将 key 分散到多个存储引擎实例中，每个分片位于单独的子目录
+type ShardedDB struct {
+	options   Options
+	mu        *sync.RWMutex
+	migrateMu *sync.Mutex // 同一时间只进行一次数据迁移
+	shards    []*DB
+	ring      *hashRing
+	prevRing  *hashRing // 迁移数据期间之前的哈希环，还没有迁移的数据从之前的分片中读取，不在迁移时为 nil
+}
+
+// OpenSharded 打开分片存储引擎实例，目录中已有的分片数量多于 shardNum 时以已有的为准
+// 分片数量和上一次完成迁移时不同时（新增分片或者上一次迁移被中断），打开时会迁移不属于当前分片的数据
+func OpenSharded(options Options, shardNum int) (*ShardedDB, error) {
+	if shardNum <= 0 {
+		return nil, ErrInvalidShardNum
+	}
+	if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// 加载已经存在的分片
+	entries, err := os.ReadDir(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	var existing int
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), shardDirPrefix) {
+			existing++
+		}
+	}
+	if existing > shardNum {
+		shardNum = existing
+	}
+
+	// 数据已经按照 balanced 个分片的哈希环分布，没有记录的旧版本目录需要检查所有的数据
+	balanced, err := readBalancedShardNum(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if balanced < 0 {
+		balanced = 0
+		if existing == 0 {
+			balanced = shardNum
+		}
+	}
+
+	sdb := &ShardedDB{options: options, mu: new(sync.RWMutex), migrateMu: new(sync.Mutex)}
+	for i := 0; i < shardNum; i++ {
+		db, err := sdb.openShard(i)
+		if err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	sdb.ring = newHashRing(shardNum)
+
+	if balanced != shardNum {
+		if err := sdb.rebalance(); err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+	}
+	if err := writeBalancedShardNum(options.DirPath, shardNum); err != nil {
+		_ = sdb.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+func (sdb *ShardedDB) openShard(i int) (*DB, error) {
+	options := sdb.options
+	options.DirPath = filepath.Join(sdb.options.DirPath, fmt.Sprintf("%s%03d", shardDirPrefix, i))
+	return Open(options)
+}
+
+// 读取数据已经完成迁移时的分片数量，没有记录时返回 -1
+func readBalancedShardNum(dirPath string) (int, error) {
+	content, err := os.ReadFile(filepath.Join(dirPath, shardBalancedFileName))
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || num < 0 {
+		return 0, ErrDataDirectoryCorrupted
+	}
+	return num, nil
+}
+
+func writeBalancedShardNum(dirPath string, num int) error {
+	fileName := filepath.Join(dirPath, shardBalancedFileName)
+	if err := os.WriteFile(fileName+".tmp", []byte(strconv.Itoa(num)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// ShardNum 分片数量
+func (sdb *ShardedDB) ShardNum() int {
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+	return len(sdb.shards)
+}
+
+// Put 写入 Key/Value 数据
+func (sdb *ShardedDB) Put(key []byte, value []byte) error {
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+	return sdb.shardOf(key).Put(key, value)
+}
+
+// Get 根据 key 读取数据，迁移期间还没有迁移的数据从之前的分片中读取
+func (sdb *ShardedDB) Get(key []byte) ([]byte, error) {
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+	value, err := sdb.shardOf(key).Get(key)
+	if err == ErrKeyNotFound && sdb.prevRing != nil {
+		if prev := sdb.prevRing.get(key); prev != sdb.ring.get(key) {
+			return sdb.shards[prev].Get(key)
+		}
+	}
+	return value, err
+}
+
+// Delete 根据 key 删除对应的数据，迁移期间同时从之前的分片中删除，避免还没有迁移的数据被迁移过去
+func (sdb *ShardedDB) Delete(key []byte) error {
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+	if err := sdb.shardOf(key).Delete(key); err != nil {
+		return err
+	}
+	if sdb.prevRing != nil {
+		if prev := sdb.prevRing.get(key); prev != sdb.ring.get(key) {
+			return sdb.shards[prev].Delete(key)
+		}
+	}
+	return nil
+}
+
+// ListKeys 获取所有分片中的 key，按照 key 有序
+func (sdb *ShardedDB) ListKeys() [][]byte {
+	var keys [][]byte
+	iter := sdb.NewIterator(IteratorOptions{})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	return keys
+}
+
+// Fold 按照 key 的顺序获取所有分片中的数据，并执行用户指定的操作，函数返回 false 时终止遍历
+func (sdb *ShardedDB) Fold(fn func(key []byte, value []byte) bool) error {
+	iter := sdb.NewIterator(IteratorOptions{})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iter.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Sync 持久化所有分片的数据
+func (sdb *ShardedDB) Sync() error {
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+	for _, db := range sdb.shards {
+		if err := db.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭所有分片
+func (sdb *ShardedDB) Close() error {
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
+	var err error
+	for _, db := range sdb.shards {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	sdb.shards = nil
+	return err
+}
+
+// AddShard 新增一个分片，并将哈希环上归属于新分片的数据迁移过去
+// 迁移分批进行，每个批次只短暂地阻塞读写，迁移期间读取还没有迁移的数据时会从之前的分片中读取
+func (sdb *ShardedDB) AddShard() error {
+	sdb.migrateMu.Lock()
+	defer sdb.migrateMu.Unlock()
+
+	sdb.mu.Lock()
+	db, err := sdb.openShard(len(sdb.shards))
+	if err != nil {
+		sdb.mu.Unlock()
+		return err
+	}
+	sdb.shards = append(sdb.shards, db)
+	sdb.prevRing = sdb.ring
+	sdb.ring = newHashRing(len(sdb.shards))
+	sdb.mu.Unlock()
+
+	if err := sdb.rebalance(); err != nil {
+		return err
+	}
+
+	sdb.mu.Lock()
+	defer sdb.mu.Unlock()
+	sdb.prevRing = nil
+	return writeBalancedShardNum(sdb.options.DirPath, len(sdb.shards))
+}
+
+// 将不属于当前分片的数据迁移到对应的分片，先写入新的分片再从旧的分片中删除，中断之后可以重复执行
+// 调用方需要持有 migrateMu 或者没有并发的读写
+func (sdb *ShardedDB) rebalance() error {
+	for i, db := range sdb.shards {
+		moved := sdb.misplacedKeys(i, db)
+		for len(moved) > 0 {
+			n := rebuildIndexBatchSize
+			if n > len(moved) {
+				n = len(moved)
+			}
+			sdb.mu.Lock()
+			err := sdb.moveKeys(db, moved[:n])
+			sdb.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			moved = moved[n:]
+		}
+	}
+	return nil
+}
+
+// 需要迁移的一个 key 以及引用它的二级索引派生的 key
+type misplacedKey struct {
+	key         []byte
+	derivedKeys [][]byte
+	target      int
+}
+
+// 找到不属于分片 i 的 key，二级索引派生的 key 跟随主键迁移，索引项不依赖索引的定义，不需要重新计算
+func (sdb *ShardedDB) misplacedKeys(i int, db *DB) []*misplacedKey {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var moved []*misplacedKey
+	byKey := make(map[string]*misplacedKey)
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		key, derived := iterator.Key(), false
+		if isSecondaryIndexKey(key) {
+			primaryKey, ok := parseIndexKey(key)
+			if !ok {
+				continue
+			}
+			key, derived = primaryKey, true
+		}
+		target := sdb.ring.get(key)
+		if target == i {
+			continue
+		}
+		mk, ok := byKey[string(key)]
+		if !ok {
+			mk = &misplacedKey{key: copyBytes(key), target: target}
+			byKey[string(key)] = mk
+			moved = append(moved, mk)
+		}
+		if derived {
+			mk.derivedKeys = append(mk.derivedKeys, copyBytes(iterator.Key()))
+		}
+	}
+	return moved
+}
+
+// 迁移一个批次的 key，保留写入时间和用户标识，调用方需要持有 sdb.mu 的写锁
+// 目标分片中已经存在的 key 是切换哈希环之后写入的新数据，只需要从旧的分片中删除
+func (sdb *ShardedDB) moveKeys(src *DB, moved []*misplacedKey) error {
+	srcBatch, err := src.newInternalWriteBatch()
+	if err != nil {
+		return err
+	}
+	dstBatches := make(map[int]*WriteBatch)
+	for _, mk := range moved {
+		dst := sdb.shards[mk.target]
+		for _, derivedKey := range mk.derivedKeys {
+			srcBatch.pendingWrites[string(derivedKey)] = &data.LogRecord{Key: derivedKey, Type: data.LogRecordDeleted}
+		}
+		record, err := src.currentRecord(mk.key)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			srcBatch.pendingWrites[string(mk.key)] = &data.LogRecord{Key: mk.key, Type: data.LogRecordDeleted}
+		}
+		exists, err := dst.index.Get(mk.key)
+		if err != nil {
+			return err
+		}
+		if exists != nil || (record == nil && len(mk.derivedKeys) == 0) {
+			continue
+		}
+
+		wb, ok := dstBatches[mk.target]
+		if !ok {
+			if wb, err = dst.newInternalWriteBatch(); err != nil {
+				return err
+			}
+			dstBatches[mk.target] = wb
+		}
+		if record != nil {
+			wb.pendingWrites[string(mk.key)] = record
+		}
+		for _, derivedKey := range mk.derivedKeys {
+			wb.pendingWrites[string(derivedKey)] = &data.LogRecord{Key: derivedKey, Type: data.LogRecordNormal}
+		}
+	}
+
+	for _, wb := range dstBatches {
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+	}
+	return srcBatch.Commit()
+}
+
+// 读取 key 当前的记录用于迁移，流式写入的数据读取所有分块之后作为普通记录迁移，key 不存在时返回 nil
+func (db *DB) currentRecord(key []byte) (*data.LogRecord, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pos, err := db.index.Get(key)
+	if err != nil || pos == nil {
+		return nil, err
+	}
+	logRecord, err := db.readLogRecord(pos)
+	if err != nil {
+		return nil, err
+	}
+	value, err := db.getValueByRecord(logRecord)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &data.LogRecord{
+		Key:       key,
+		Value:     value,
+		Type:      data.LogRecordNormal,
+		Timestamp: logRecord.Timestamp,
+		Flags:     logRecord.Flags,
+	}, nil
+}
+
+func (sdb *ShardedDB) shardOf(key []byte) *DB {
+	return sdb.shards[sdb.ring.get(key)]
+}
+
+// 一致性哈希环
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]int
+}
+
+func newHashRing(shardNum int) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]int)}
+	for i := 0; i < shardNum; i++ {
+		for v := 0; v < shardVirtualNodes; v++ {
+			hash := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s%03d#%d", shardDirPrefix, i, v)))
+			// 哈希冲突时保留编号较小的分片，保证结果是确定的
+			if _, ok := ring.owners[hash]; ok {
+				continue
+			}
+			ring.owners[hash] = i
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+	return ring
+}
+
+// 顺时针找到第一个虚拟节点对应的分片
+func (r *hashRing) get(key []byte) int {
+	hash := crc32.ChecksumIEEE(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.owners[r.hashes[idx]]
+}
+
+// ShardedIterator 合并所有分片的迭代器，按照 key 的顺序遍历
+type ShardedIterator struct {
+	iters []*shardIterator
+	heap  *iteratorHeap
+}
+
+// 单个分片的迭代器以及分片的序号
+type shardIterator struct {
+	*Iterator
+	shard int
+}
+
+// NewIterator 初始化分片迭代器，迭代期间新增分片会导致遍历的结果不完整
+// 迁移期间同一个 key 可能同时存在于之前的分片和当前的分片，以当前哈希环上归属的分片中的数据为准
+func (sdb *ShardedDB) NewIterator(opts IteratorOptions) *ShardedIterator {
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+
+	iters := make([]*shardIterator, len(sdb.shards))
+	for i, db := range sdb.shards {
+		iters[i] = &shardIterator{Iterator: db.NewIterator(opts), shard: i}
+	}
+	return &ShardedIterator{
+		iters: iters,
+		heap:  &iteratorHeap{ring: sdb.ring, reverse: opts.Reverse},
+	}
+}
+
+// Rewind 重新回到迭代器的起点
+func (si *ShardedIterator) Rewind() {
+	for _, iter := range si.iters {
+		iter.Rewind()
+	}
+	si.resetHeap()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (si *ShardedIterator) Seek(key []byte) {
+	for _, iter := range si.iters {
+		iter.Seek(key)
+	}
+	si.resetHeap()
+}
+
+// Next 跳转到下一个 key，多个分片中存在相同的 key 时只会遍历一次，其他分片中重复的 key 会被跳过
+func (si *ShardedIterator) Next() {
+	if !si.Valid() {
+		return
+	}
+	key := si.Key()
+	for si.heap.Len() > 0 && bytes.Equal(si.heap.iters[0].Key(), key) {
+		iter := si.heap.iters[0]
+		iter.Next()
+		if iter.Valid() {
+			heap.Fix(si.heap, 0)
+		} else {
+			heap.Pop(si.heap)
+		}
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key
+func (si *ShardedIterator) Valid() bool {
+	return si.heap.Len() > 0
+}
+
+// Key 当前遍历位置的 Key 数据
+func (si *ShardedIterator) Key() []byte {
+	return si.heap.iters[0].Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (si *ShardedIterator) Value() ([]byte, error) {
+	return si.heap.iters[0].Value()
+}
+
+// Close 关闭所有分片的迭代器
+func (si *ShardedIterator) Close() {
+	for _, iter := range si.iters {
+		iter.Close()
+	}
+	si.heap.iters = nil
+}
+
+func (si *ShardedIterator) resetHeap() {
+	si.heap.iters = si.heap.iters[:0]
+	for _, iter := range si.iters {
+		if iter.Valid() {
+			si.heap.iters = append(si.heap.iters, iter)
+		}
+	}
+	heap.Init(si.heap)
+}
+
+// 按照各个分片迭代器当前的 key 排序的堆，key 相同时归属于该 key 的分片排在前面
+type iteratorHeap struct {
+	iters   []*shardIterator
+	ring    *hashRing
+	reverse bool
+}
+
+func (h *iteratorHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if cmp == 0 {
+		return h.iters[i].shard == h.ring.get(h.iters[i].Key())
+	}
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iteratorHeap) Push(x any) {
+	h.iters = append(h.iters, x.(*shardIterator))
+}
+
+func (h *iteratorHeap) Pop() any {
+	n := len(h.iters)
+	iter := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return iter
+}
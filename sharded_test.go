@@ -0,0 +1,368 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func destroyShardedDB(sdb *ShardedDB) {
+	if sdb != nil {
+		_ = sdb.Close()
+		_ = os.RemoveAll(sdb.options.DirPath)
+	}
+}
+
+func TestOpenSharded(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-open")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 4)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, sdb.ShardNum())
+
+	_, err = OpenSharded(opts, 0)
+	assert.Equal(t, ErrInvalidShardNum, err)
+}
+
+func TestShardedDB_PutGetDelete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-put")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 4)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 数据分散在所有分片中
+	for _, db := range sdb.shards {
+		assert.True(t, len(db.ListKeys()) > 0)
+	}
+
+	val, err := sdb.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+
+	err = sdb.Delete(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	_, err = sdb.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 999, len(sdb.ListKeys()))
+
+	// 重启之后校验
+	err = sdb.Close()
+	assert.Nil(t, err)
+	sdb2, err := OpenSharded(opts, 1)
+	assert.Nil(t, err)
+	defer func() {
+		_ = sdb2.Close()
+	}()
+	assert.Equal(t, 4, sdb2.ShardNum())
+	val, err = sdb2.Get(utils.GetTestKey(11))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(11), val)
+}
+
+func TestShardedDB_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-iterator")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 3)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"bbcd", "aacd", "acee", "bbed", "ddce", "cadd", "ceeb"} {
+		err := sdb.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+
+	// 跨分片有序遍历
+	var keys []string
+	iter := sdb.NewIterator(IteratorOptions{})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iter.Key(), val)
+	}
+	iter.Close()
+	assert.Equal(t, []string{"aacd", "acee", "bbcd", "bbed", "cadd", "ceeb", "ddce"}, keys)
+
+	// 反向遍历
+	keys = nil
+	iter2 := sdb.NewIterator(IteratorOptions{Reverse: true})
+	for iter2.Seek([]byte("c")); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+	}
+	iter2.Close()
+	assert.Equal(t, []string{"bbed", "bbcd", "acee", "aacd"}, keys)
+
+	// 指定前缀
+	keys = nil
+	iter3 := sdb.NewIterator(IteratorOptions{Prefix: []byte("c")})
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	iter3.Close()
+	assert.Equal(t, []string{"cadd", "ceeb"}, keys)
+
+	// Fold 按顺序遍历，返回 false 时终止
+	var folded [][]byte
+	err = sdb.Fold(func(key []byte, value []byte) bool {
+		folded = append(folded, key)
+		return len(folded) < 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(folded))
+	assert.True(t, bytes.Compare(folded[0], folded[1]) < 0)
+}
+
+func TestShardedDB_AddShard(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-add")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 2)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	err = sdb.AddShard()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, sdb.ShardNum())
+
+	// 部分数据迁移到了新的分片，每个 key 只存在于其所属的分片中
+	assert.True(t, len(sdb.shards[2].ListKeys()) > 0)
+	var total int
+	for i, db := range sdb.shards {
+		for _, key := range db.ListKeys() {
+			assert.Equal(t, i, sdb.ring.get(key))
+		}
+		total += len(db.ListKeys())
+	}
+	assert.Equal(t, 1000, total)
+
+	for i := 0; i < 1000; i++ {
+		val, err := sdb.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestShardedDB_AddShard_IndexKeys(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-index")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 1)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	assert.Nil(t, sdb.shards[0].RegisterIndex("city", cityExtractor))
+	for i := 0; i < 100; i++ {
+		err := sdb.Put(utils.GetTestKey(i), []byte("beijing:"))
+		assert.Nil(t, err)
+	}
+
+	err = sdb.AddShard()
+	assert.Nil(t, err)
+
+	// 索引项跟随主键迁移到新的分片，旧的分片中不会残留
+	var total int
+	for i, db := range sdb.shards {
+		assert.Nil(t, db.RegisterIndex("city", cityExtractor))
+		keys, err := db.QueryIndex("city", []byte("beijing"))
+		assert.Nil(t, err)
+		for _, key := range keys {
+			assert.Equal(t, i, sdb.ring.get(key))
+		}
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, stat.KeyNum, stat.IndexKeyNum)
+		total += len(keys)
+	}
+	assert.Equal(t, 100, total)
+}
+
+func TestShardedDB_AddShard_Meta(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-meta")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 1)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	metas := make(map[string]*Meta)
+	for i := 0; i < 100; i++ {
+		key := utils.GetTestKey(i)
+		assert.Nil(t, sdb.shards[0].PutWithFlags(key, key, uint32(i)))
+		_, meta, err := sdb.shards[0].GetWithMeta(key)
+		assert.Nil(t, err)
+		metas[string(key)] = meta
+	}
+
+	err = sdb.AddShard()
+	assert.Nil(t, err)
+
+	// 迁移之后保留写入时间和用户标识
+	moved := sdb.shards[1].ListKeys()
+	assert.True(t, len(moved) > 0)
+	for _, key := range moved {
+		val, meta, err := sdb.shards[1].GetWithMeta(key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, val)
+		assert.Equal(t, metas[string(key)].Timestamp, meta.Timestamp)
+		assert.Equal(t, metas[string(key)].Flags, meta.Flags)
+	}
+}
+
+func TestShardedDB_Migrating(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-migrating")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 2)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 切换哈希环之后、迁移数据之前，从之前的分片中读取
+	db, err := sdb.openShard(2)
+	assert.Nil(t, err)
+	sdb.shards = append(sdb.shards, db)
+	sdb.prevRing = sdb.ring
+	sdb.ring = newHashRing(3)
+
+	var deleted, updated []byte
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i)
+		val, err := sdb.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, val)
+		if sdb.ring.get(key) == 2 {
+			if deleted == nil {
+				deleted = key
+			} else if updated == nil {
+				updated = key
+			}
+		}
+	}
+	assert.NotNil(t, updated)
+
+	// 迁移期间删除和更新的数据不会被迁移覆盖
+	assert.Nil(t, sdb.Delete(deleted))
+	assert.Nil(t, sdb.Put(updated, []byte("new-value")))
+	assert.Nil(t, sdb.rebalance())
+	sdb.prevRing = nil
+
+	_, err = sdb.Get(deleted)
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := sdb.Get(updated)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), val)
+	assert.Equal(t, 999, len(sdb.ListKeys()))
+	for i, db := range sdb.shards {
+		for _, key := range db.ListKeys() {
+			assert.Equal(t, i, sdb.ring.get(key))
+		}
+	}
+
+	// 迁移被中断时，重新打开会继续迁移
+	assert.Nil(t, sdb.Close())
+	sdb, err = OpenSharded(opts, 3)
+	assert.Nil(t, err)
+	misplaced := []byte("misplaced-key")
+	owner := sdb.ring.get(misplaced)
+	assert.Nil(t, sdb.shards[(owner+1)%3].Put(misplaced, []byte("v")))
+	assert.Nil(t, sdb.Close())
+	assert.Nil(t, writeBalancedShardNum(dir, 2))
+
+	sdb, err = OpenSharded(opts, 3)
+	assert.Nil(t, err)
+	val, err = sdb.shards[owner].Get(misplaced)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	_, err = sdb.shards[(owner+1)%3].Get(misplaced)
+	assert.Equal(t, ErrKeyNotFound, err)
+	balanced, err := readBalancedShardNum(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, balanced)
+}
+
+func TestShardedDB_Iterator_Migrating(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-sharded-iterator-migrating")
+	opts.DirPath = dir
+	sdb, err := OpenSharded(opts, 2)
+	defer destroyShardedDB(sdb)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err := sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 新增分片之后只迁移了第一个分片中的一半数据
+	db, err := sdb.openShard(2)
+	assert.Nil(t, err)
+	sdb.shards = append(sdb.shards, db)
+	sdb.prevRing = sdb.ring
+	sdb.ring = newHashRing(3)
+	moved := sdb.misplacedKeys(0, sdb.shards[0])
+	assert.True(t, len(moved) > 1)
+	assert.Nil(t, sdb.moveKeys(sdb.shards[0], moved[:len(moved)/2]))
+
+	// 还没有迁移的 key 被更新之后同时存在于之前的分片和当前的分片
+	updated := 0
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i)
+		if sdb.ring.get(key) == 2 && sdb.prevRing.get(key) == 1 {
+			assert.Nil(t, sdb.Put(key, []byte("new-value")))
+			updated++
+		}
+	}
+	assert.True(t, updated > 0)
+
+	for _, reverse := range []bool{false, true} {
+		iter := sdb.NewIterator(IteratorOptions{Reverse: reverse})
+		var prev []byte
+		count := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if prev != nil {
+				cmp := bytes.Compare(prev, key)
+				if reverse {
+					assert.True(t, cmp > 0)
+				} else {
+					assert.True(t, cmp < 0)
+				}
+			}
+			prev = key
+			count++
+
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			expected, err := sdb.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, val)
+		}
+		iter.Close()
+		assert.Equal(t, 1000, count)
+	}
+
+	assert.Nil(t, sdb.rebalance())
+	sdb.prevRing = nil
+	assert.Equal(t, 1000, len(sdb.ListKeys()))
+}
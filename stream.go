@@ -0,0 +1,344 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/data"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	// 没有配置 StreamChunkSize 时每个分块的大小
+	defaultStreamChunkSize = 4 * 1024 * 1024
+
+	// 头部记录中每个分块的位置编码之后至少占用的字节数，文件 id、偏移和大小各一个 varint
+	minEncodedChunkSize = 3
+)
+
+// PutStream 流式写入大 value，数据会被切分为多个分块分别写入数据文件
+// 所有分块写入完成之后才会写入一条头部记录并更新内存索引，中途失败或者崩溃时已写入的分块会被当做无效数据
+func (db *DB) PutStream(key []byte, reader io.Reader, size int64) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if size < 0 {
+		return ErrInvalidStreamSize
+	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	if isSecondaryIndexKey(key) {
+		return ErrKeyReserved
+	}
+	if err := db.waitDiskSpace(false); err != nil {
+		return err
+	}
+
+	// 写入期间不允许 merge 切换活跃文件，保证分块和头部记录处于同一批 merge 范围
+	db.streamMu.RLock()
+	defer db.streamMu.RUnlock()
+
+	chunkSize := db.options.StreamChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultStreamChunkSize
+	}
+	if size < chunkSize {
+		chunkSize = size
+	}
+	buf := make([]byte, chunkSize)
+
+	// 依次写入每个分块
+	var chunks []*data.LogRecordPos
+	var written int64
+	for written < size {
+		n := size - written
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			return err
+		}
+		pos, err := db.appendLogRecordWithLock(&data.LogRecord{
+			Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
+			Value: buf[:n],
+			Type:  data.LogRecordStreamChunk,
+		})
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, pos)
+		written += n
+	}
+
+	// 注册了二级索引时通过事务写入头部记录，同时删除旧的值的索引项
+	if db.hasSecondaryIndexes() {
+		wb, err := db.newInternalWriteBatch()
+		if err != nil {
+			return err
+		}
+		wb.pendingWrites[string(key)] = &data.LogRecord{
+			Key:       key,
+			Value:     encodeStreamChunks(size, chunks),
+			Type:      data.LogRecordStream,
+			Timestamp: time.Now().UnixNano(),
+		}
+		return wb.Commit()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 写入头部记录，记录所有分块的位置
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:       logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:     encodeStreamChunks(size, chunks),
+		Type:      data.LogRecordStream,
+		Timestamp: time.Now().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.flushActiveFile(); err != nil {
+		return err
+	}
+	seq := changeSeq(pos.Fid, pos.Offset+int64(pos.Size))
+	pos.Size = streamSpan(pos.Size, chunks)
+
+	// 更新内存索引
+	oldPos, err := db.index.Put(key, pos)
+	if err != nil {
+		return err
+	}
+	if oldPos != nil {
+		db.reclaimSize += int64(oldPos.Size)
+	}
+
+	// 发布变更事件，事件中只保存分块的位置，投递给订阅者时才读取完整的 value
+	db.changes.publish(seq, func() *ChangeEvent {
+		return &ChangeEvent{Type: ChangePut, Key: copyBytes(key), streamHead: encodeStreamChunks(size, chunks)}
+	})
+	return nil
+}
+
+// GetReader 根据 key 获取 value 的读取器，流式写入的数据会按分块依次读取
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	logRecordPos, err := db.index.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if logRecordPos == nil {
+		return nil, ErrKeyNotFound
+	}
+	logRecord, err := db.readLogRecord(logRecordPos)
+	if err != nil {
+		return nil, err
+	}
+
+	switch logRecord.Type {
+	case data.LogRecordDeleted:
+		return nil, ErrKeyNotFound
+	case data.LogRecordStream:
+		size, chunks, err := decodeStreamChunks(logRecord.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &streamReader{db: db, size: size, chunks: chunks, gen: db.acquireFiles()}, nil
+	default:
+		return io.NopCloser(bytes.NewReader(logRecord.Value)), nil
+	}
+}
+
+// streamReader 按分块读取流式写入的 value
+type streamReader struct {
+	db     *DB
+	size   int64                // value 的总大小
+	chunks []*data.LogRecordPos // 所有分块的位置
+	next   int                  // 下一个需要读取的分块
+	read   int64                // 已经读取的数据量
+	buf    []byte               // 当前分块中还未读取的数据
+	gen    uint64               // 创建时的数据文件版本，关闭之前 merge 替换下来的旧数据文件不会被删除
+	closed bool
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if sr.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for len(sr.buf) == 0 {
+		if sr.next >= len(sr.chunks) {
+			if sr.read != sr.size {
+				return 0, ErrStreamCorrupted
+			}
+			return 0, io.EOF
+		}
+		value, err := sr.db.readStreamChunk(sr.chunks[sr.next])
+		if err != nil {
+			return 0, err
+		}
+		sr.buf = value
+		sr.next++
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	sr.read += int64(n)
+	return n, nil
+}
+
+func (sr *streamReader) Close() error {
+	if sr.closed {
+		return nil
+	}
+	sr.closed = true
+	sr.buf = nil
+	sr.db.releaseFiles(sr.gen)
+	return nil
+}
+
+// 读取一个分块的数据，每个分块都有独立的 crc 校验
+func (db *DB) readStreamChunk(pos *data.LogRecordPos) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	logRecord, err := db.readLogRecord(pos)
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type != data.LogRecordStreamChunk {
+		return nil, ErrStreamCorrupted
+	}
+	return logRecord.Value, nil
+}
+
+// 读取流式写入的完整 value
+func (db *DB) readStreamValue(headValue []byte) ([]byte, error) {
+	size, chunks, err := decodeStreamChunks(headValue)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, size)
+	for _, pos := range chunks {
+		logRecord, err := db.readLogRecord(pos)
+		if err != nil {
+			return nil, err
+		}
+		if logRecord.Type != data.LogRecordStreamChunk {
+			return nil, ErrStreamCorrupted
+		}
+		value = append(value, logRecord.Value...)
+	}
+	if int64(len(value)) != size {
+		return nil, ErrStreamCorrupted
+	}
+	return value, nil
+}
+
+// 将流式写入的数据重写到 merge 的临时实例中，返回新的头部记录位置
+func (db *DB) mergeStream(mergeDB *DB, realKey []byte, headRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	size, chunks, err := decodeStreamChunks(headRecord.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	newChunks := make([]*data.LogRecordPos, 0, len(chunks))
+	for _, pos := range chunks {
+		db.mu.RLock()
+		logRecord, err := db.readLogRecord(pos)
+		db.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+		newPos, err := mergeDB.appendLogRecord(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		newChunks = append(newChunks, newPos)
+	}
+
+	headRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+	headRecord.Value = encodeStreamChunks(size, newChunks)
+	pos, err := mergeDB.appendLogRecord(headRecord)
+	if err != nil {
+		return nil, err
+	}
+	pos.Size = streamSpan(pos.Size, newChunks)
+	return pos, nil
+}
+
+// 编码头部记录的 value: 总大小 | 分块数量 | 每个分块的 fid offset size
+func encodeStreamChunks(size int64, chunks []*data.LogRecordPos) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2+len(chunks)*(binary.MaxVarintLen32*2+binary.MaxVarintLen64))
+	var index = 0
+	index += binary.PutVarint(buf[index:], size)
+	index += binary.PutVarint(buf[index:], int64(len(chunks)))
+	for _, pos := range chunks {
+		index += binary.PutVarint(buf[index:], int64(pos.Fid))
+		index += binary.PutVarint(buf[index:], pos.Offset)
+		index += binary.PutVarint(buf[index:], int64(pos.Size))
+	}
+	return buf[:index]
+}
+
+// 解码头部记录的 value
+func decodeStreamChunks(buf []byte) (int64, []*data.LogRecordPos, error) {
+	var index = 0
+	readVarint := func() (int64, error) {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return 0, ErrStreamCorrupted
+		}
+		index += n
+		return v, nil
+	}
+
+	size, err := readVarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := readVarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	// 数量来自磁盘上的数据，需要先和剩余的长度比较，避免损坏的记录导致过大的内存分配
+	if size < 0 || count < 0 || count > int64(len(buf)-index)/minEncodedChunkSize {
+		return 0, nil, ErrStreamCorrupted
+	}
+	chunks := make([]*data.LogRecordPos, 0, count)
+	for i := int64(0); i < count; i++ {
+		fid, err := readVarint()
+		if err != nil {
+			return 0, nil, err
+		}
+		offset, err := readVarint()
+		if err != nil {
+			return 0, nil, err
+		}
+		chunkSize, err := readVarint()
+		if err != nil {
+			return 0, nil, err
+		}
+		chunks = append(chunks, &data.LogRecordPos{Fid: uint32(fid), Offset: offset, Size: uint32(chunkSize)})
+	}
+	return size, chunks, nil
+}
+
+// 头部记录加上所有分块占用的磁盘空间，用于统计可回收的数据量
+func streamSpan(headSize uint32, chunks []*data.LogRecordPos) uint32 {
+	var span = uint64(headSize)
+	for _, pos := range chunks {
+		span += uint64(pos.Size)
+	}
+	if span > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(span)
+}
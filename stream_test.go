@@ -0,0 +1,205 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_PutStream(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-stream-put")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	opts.StreamChunkSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 跨越多个分块以及多个数据文件
+	value := bytes.Repeat(utils.RandomValue(1024), 3*1024)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.True(t, len(db.olderFiles) > 0)
+
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	readValue, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, value, readValue)
+
+	// Get 可以拿到完整的数据
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// 空的 value
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader(nil), 0)
+	assert.Nil(t, err)
+	val2, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(val2))
+
+	// 数据不足时写入失败，不会更新索引
+	err = db.PutStream(utils.GetTestKey(3), bytes.NewReader(value[:100]), 1024)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 普通数据也可以使用 GetReader
+	err = db.Put(utils.GetTestKey(4), []byte("small value"))
+	assert.Nil(t, err)
+	reader4, err := db.GetReader(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	val4, err := io.ReadAll(reader4)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small value"), val4)
+
+	// 重启之后校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_, err = db2.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	reader5, err := db2.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val5, err := io.ReadAll(reader5)
+	assert.Nil(t, err)
+	assert.Equal(t, value, val5)
+}
+
+func TestDB_PutStream_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-stream-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	opts.StreamChunkSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat(utils.RandomValue(1024), 2*1024)
+	for i := 0; i < 3; i++ {
+		err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+		assert.Nil(t, err)
+	}
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 重启之后加载 merge 的结果
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+
+	reader, err := db2.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_PutStream_MultiGet(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-stream-multi-get")
+	opts.DirPath = dir
+	opts.StreamChunkSize = 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(0), []byte("small value"))
+	assert.Nil(t, err)
+	large := utils.RandomValue(128 * 1024)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(large), int64(len(large)))
+	assert.Nil(t, err)
+	// 最后写入的头部记录位于文件末尾，记录的大小包含了之前写入的分块
+	small := utils.RandomValue(8 * 1024)
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader(small), int64(len(small)))
+	assert.Nil(t, err)
+	expected := [][]byte{[]byte("small value"), large, small}
+
+	keys := [][]byte{utils.GetTestKey(0), utils.GetTestKey(1), utils.GetTestKey(2)}
+	values, err := db.MultiGet(keys)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, values)
+
+	for _, reverse := range []bool{false, true} {
+		iter := db.NewIterator(IteratorOptions{Reverse: reverse, PrefetchSize: 4})
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, expected[bytes.Compare(iter.Key(), utils.GetTestKey(1))+1], val)
+			count++
+		}
+		iter.Close()
+		assert.Equal(t, 3, count)
+	}
+}
+
+func TestDB_PutStream_DefaultChunkSize(t *testing.T) {
+	// 字面量构造的配置项没有设置分块大小时使用默认值
+	dir, _ := os.MkdirTemp("", "db-bitcask-stream-default")
+	opts := Options{DirPath: dir, DataFileSize: 64 * 1024 * 1024, IndexType: BTree}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	value := utils.RandomValue(1024)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	opts.StreamChunkSize = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeStreamChunks_Corrupted(t *testing.T) {
+	buf := encodeStreamChunks(1024, []*data.LogRecordPos{{Fid: 1, Offset: 0, Size: 1024}})
+	size, chunks, err := decodeStreamChunks(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), size)
+	assert.Equal(t, 1, len(chunks))
+
+	// 分块数量超过剩余的数据长度
+	hostile := binary.AppendVarint(binary.AppendVarint(nil, 1024), math.MaxInt64)
+	_, _, err = decodeStreamChunks(hostile)
+	assert.Equal(t, ErrStreamCorrupted, err)
+	negative := binary.AppendVarint(binary.AppendVarint(nil, 1024), -1)
+	_, _, err = decodeStreamChunks(negative)
+	assert.Equal(t, ErrStreamCorrupted, err)
+
+	// 截断的记录
+	_, _, err = decodeStreamChunks(buf[:len(buf)-1])
+	assert.Equal(t, ErrStreamCorrupted, err)
+}
@@ -0,0 +1,139 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 后台检查是否有需要移动到冷存储目录的数据文件的间隔
+const coldFileCheckInterval = time.Minute
+
+// MoveColdFiles 将符合策略的旧数据文件移动到冷存储目录，启用冷存储目录时后台会定期调用
+// 拷贝文件时不持有锁，只在替换文件的 IOManager 时短暂地阻塞读写
+func (db *DB) MoveColdFiles() error {
+	if db.options.ColdDirPath == "" || db.readOnly() {
+		return nil
+	}
+	db.moveMu.Lock()
+	defer db.moveMu.Unlock()
+
+	db.mu.RLock()
+	if db.activeFile == nil || db.isMerging {
+		db.mu.RUnlock()
+		return nil
+	}
+	newestFid := db.activeFile.FileId
+	fileIds := make([]int, 0, len(db.olderFiles))
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+	db.mu.RUnlock()
+	sort.Ints(fileIds)
+
+	for _, fid := range fileIds {
+		hotPath := data.ResolveDataFileName(db.options.DirPath, uint32(fid))
+		info, err := os.Stat(hotPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !db.isColdFile(uint32(fid), newestFid, info.ModTime()) {
+			continue
+		}
+		if err := db.moveToColdDir(uint32(fid), hotPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 判断旧的数据文件是否应该放在冷存储目录中，newestFid 为当前最新的数据文件 id
+func (db *DB) isColdFile(fid uint32, newestFid uint32, modTime time.Time) bool {
+	hotFileNum, coldFileAge := db.options.HotFileNum, db.options.ColdFileAge
+	if hotFileNum == 0 && coldFileAge == 0 {
+		return true
+	}
+	if hotFileNum > 0 && newestFid > fid && newestFid-fid > hotFileNum {
+		return true
+	}
+	return coldFileAge > 0 && time.Since(modTime) >= coldFileAge
+}
+
+func (db *DB) moveToColdDir(fid uint32, hotPath string) error {
+	coldPath := filepath.Join(db.options.ColdDirPath, filepath.Base(hotPath))
+	tmpPath := coldPath + ".tmp"
+	// 旧的数据文件不会再被修改，拷贝时不需要持有锁
+	if _, err := utils.CopyFile(hotPath, tmpPath, -1); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, coldPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	db.mu.Lock()
+	dataFile := db.olderFiles[fid]
+	// merge 会在锁外读取旧的数据文件，此时不能替换
+	if dataFile == nil || db.isMerging {
+		db.mu.Unlock()
+		return os.Remove(coldPath)
+	}
+	ioManager, err := db.openIOManager(coldPath, db.options.IOType)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if err := dataFile.IoManager.Close(); err != nil {
+		_ = ioManager.Close()
+		db.mu.Unlock()
+		return err
+	}
+	dataFile.IoManager = ioManager
+	db.mu.Unlock()
+	return os.Remove(hotPath)
+}
+
+func (db *DB) moveColdFilesInBackground() {
+	defer db.bgWg.Done()
+	ticker := time.NewTicker(coldFileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			db.backgroundError("move_cold_files", db.MoveColdFiles())
+		}
+	}
+}
+
+// 冷存储目录，没有启用时为空
+func (db *DB) coldDirPaths() []string {
+	if db.options.ColdDirPath == "" {
+		return nil
+	}
+	return []string{db.options.ColdDirPath}
+}
+
+// 数据目录以及冷存储目录所占的磁盘空间大小
+func (db *DB) totalDirSize() (int64, error) {
+	size, err := utils.DirSize(db.options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, dir := range db.coldDirPaths() {
+		coldSize, err := utils.DirSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		size += coldSize
+	}
+	return size, nil
+}
@@ -0,0 +1,169 @@
+package db_bitcask
+
+import (
+	"db-bitcask/data"
+	"db-bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestDB_MoveColdFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiering")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tiering-cold")
+	defer os.RemoveAll(coldDir)
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 32 * 1024
+	opts.HotFileNum = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 2)
+	err = db.MoveColdFiles()
+	assert.Nil(t, err)
+
+	activeFid := db.activeFile.FileId
+	for fid := range db.olderFiles {
+		hot := fileExists(data.GetDataFileName(dir, fid))
+		cold := fileExists(data.GetDataFileName(coldDir, fid))
+		if fid == activeFid-1 {
+			assert.True(t, hot)
+			assert.False(t, cold)
+		} else {
+			assert.False(t, hot)
+			assert.True(t, cold)
+		}
+	}
+	for i := 0; i < 2000; i += 3 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 备份时包含冷存储目录中的文件
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-tiering-backup")
+	defer os.RemoveAll(backupDir)
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	restoreDir := filepath.Join(os.TempDir(), "bitcask-go-tiering-restore")
+	defer os.RemoveAll(restoreDir)
+	err = Restore(backupDir, restoreDir)
+	assert.Nil(t, err)
+	restoreOpts := DefaultOptions
+	restoreOpts.DirPath = restoreDir
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(restored.ListKeys()))
+	assert.Nil(t, restored.Close())
+
+	// 重新打开之后从两个目录中加载数据文件
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+	val, err := db2.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(0), val)
+}
+
+func TestDB_MoveColdFiles_Age(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiering-age")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tiering-age-cold")
+	defer os.RemoveAll(coldDir)
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 32 * 1024
+	opts.ColdFileAge = time.Hour
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.MoveColdFiles()
+	assert.Nil(t, err)
+	for fid := range db.olderFiles {
+		assert.True(t, fileExists(data.GetDataFileName(dir, fid)))
+	}
+
+	// 很久没有修改的文件
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(data.GetDataFileName(dir, 0), old, old))
+	err = db.MoveColdFiles()
+	assert.Nil(t, err)
+	assert.False(t, fileExists(data.GetDataFileName(dir, 0)))
+	assert.True(t, fileExists(data.GetDataFileName(coldDir, 0)))
+	assert.True(t, fileExists(data.GetDataFileName(dir, 1)))
+	val, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(0), val)
+}
+
+func TestDB_Merge_ColdDir(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tiering-merge")
+	coldDir, _ := os.MkdirTemp("", "bitcask-go-tiering-merge-cold")
+	defer os.RemoveAll(coldDir)
+	opts.DirPath = dir
+	opts.ColdDirPath = coldDir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.MoveColdFiles()
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// merge 的输出从活跃文件之后的文件 id 开始
+	mergeFileId := db.activeFile.FileId + 1
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// merge 输出的数据文件按照策略放到冷存储目录中
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.True(t, fileExists(data.GetDataFileName(coldDir, mergeFileId)))
+	assert.False(t, fileExists(data.GetDataFileName(dir, mergeFileId)))
+	assert.False(t, fileExists(data.GetDataFileName(coldDir, 0)))
+	assert.False(t, fileExists(data.GetDataFileName(dir, 0)))
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	val, err := db2.Get(utils.GetTestKey(1500))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1500), val)
+}
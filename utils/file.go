@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"context"
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -24,14 +27,10 @@ func DirSize(dirPath string) (int64, error) {
 	return size, err
 }
 
-func AvailableDiskSize() (uint64, error) {
-	wd, err := os.Getwd() // 获取当前工作目录
-	if err != nil {
-		return 0, err
-	}
-
+// AvailableDiskSize 获取目录所在磁盘的可用空间
+func AvailableDiskSize(dirPath string) (uint64, error) {
 	var stat unix.Statfs_t
-	err = unix.Statfs(wd, &stat)
+	err := unix.Statfs(dirPath, &stat)
 	if err != nil {
 		return 0, err
 	}
@@ -76,3 +75,107 @@ func CopyDir(src, dest string, exclude []string) error {
 		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
 	})
 }
+
+// CopyFile 拷贝文件的前 size 个字节到目标文件，size 小于 0 时拷贝整个文件，返回拷贝内容的 crc32
+func CopyFile(src, dest string, size int64) (uint32, error) {
+	return CopyFileLimited(context.Background(), src, dest, size, nil)
+}
+
+// CopyFileLimited 和 CopyFile 相同，读取源文件时经过 limiter 限速
+func CopyFileLimited(ctx context.Context, src, dest string, size int64, limiter *RateLimiter) (uint32, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	// 目标文件可能是硬链接，不能直接覆盖
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer destFile.Close()
+
+	hash := crc32.NewIEEE()
+	writer := io.MultiWriter(destFile, hash)
+	reader := limiter.Reader(ctx, srcFile)
+	if size < 0 {
+		_, err = io.Copy(writer, reader)
+	} else {
+		_, err = io.CopyN(writer, reader, size)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := destFile.Sync(); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// LinkFile 使用硬链接共享文件，不在同一个文件系统时退回到拷贝
+func LinkFile(src, dest string) error {
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dest); err != nil {
+		_, err = CopyFile(src, dest, -1)
+		return err
+	}
+	return nil
+}
+
+// LinkOrCopyFile 和 LinkFile 相同，并返回文件内容的 crc32
+func LinkOrCopyFile(src, dest string) (uint32, error) {
+	return LinkOrCopyFileLimited(context.Background(), src, dest, nil)
+}
+
+// LinkOrCopyFileLimited 和 LinkOrCopyFile 相同，拷贝以及计算 crc32 时经过 limiter 限速
+func LinkOrCopyFileLimited(ctx context.Context, src, dest string, limiter *RateLimiter) (uint32, error) {
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := os.Link(src, dest); err != nil {
+		return CopyFileLimited(ctx, src, dest, -1, limiter)
+	}
+	return fileCRC32(ctx, dest, limiter)
+}
+
+// FileCRC32 计算文件内容的 crc32
+func FileCRC32(path string) (uint32, error) {
+	return fileCRC32(context.Background(), path, nil)
+}
+
+func fileCRC32(ctx context.Context, path string, limiter *RateLimiter) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, limiter.Reader(ctx, file)); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// MoveFile 移动文件，不在同一个文件系统时先拷贝到临时文件再重命名，最后删除源文件
+func MoveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	tmpPath := dest + ".tmp"
+	if _, err := CopyFile(src, tmpPath, -1); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Remove(src)
+}
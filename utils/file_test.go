@@ -2,7 +2,9 @@ package utils
 
 import (
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,7 +16,56 @@ func TestDirSize(t *testing.T) {
 }
 
 func TestAvailableDiskSize(t *testing.T) {
-	size, err := AvailableDiskSize()
+	dir, _ := os.Getwd()
+	size, err := AvailableDiskSize(dir)
 	assert.Nil(t, err)
 	assert.True(t, size > 0)
+
+	_, err = AvailableDiskSize(filepath.Join(dir, "not-exist"))
+	assert.NotNil(t, err)
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "db-bitcask-copy-file")
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	err := os.WriteFile(src, []byte("hello world"), 0644)
+	assert.Nil(t, err)
+
+	// 只拷贝前缀
+	crc, err := CopyFile(src, filepath.Join(dir, "prefix"), 5)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(filepath.Join(dir, "prefix"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), content)
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("hello")), crc)
+
+	// 硬链接
+	crc, err = LinkOrCopyFile(src, filepath.Join(dir, "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("hello world")), crc)
+	crc2, err := FileCRC32(filepath.Join(dir, "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, crc, crc2)
+}
+
+func TestMoveFile(t *testing.T) {
+	srcDir, _ := os.MkdirTemp("", "bitcask-move-src")
+	destDir, _ := os.MkdirTemp("", "bitcask-move-dest")
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(destDir)
+
+	src := filepath.Join(srcDir, "000000001.data")
+	dest := filepath.Join(destDir, "000000001.data")
+	err := os.WriteFile(src, []byte("bitcask-kv"), 0644)
+	assert.Nil(t, err)
+
+	err = MoveFile(src, dest)
+	assert.Nil(t, err)
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+	content, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask-kv"), content)
 }
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter 以字节为单位的令牌桶限速器，桶的容量为一秒的速率
+// 单次请求超过桶中的令牌时先透支，由之后的请求等待补足，所以大于桶容量的请求也不会一直等待
+// 为 nil 或者速率不大于 0 时不限速
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      int64
+	tokens    float64
+	last      time.Time
+	changed   chan struct{} // 速率修改时关闭，唤醒正在等待的请求
+	throttled time.Duration // 累计等待的时长
+}
+
+// NewRateLimiter 初始化 RateLimiter，rate 为每秒的字节数
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		tokens:  float64(rate),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetRate 修改速率，正在等待的请求会直接返回
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	// 从不限速切换为限速时桶是满的
+	if l.rate <= 0 || l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.rate = rate
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate 返回当前的速率
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Throttled 返回因为限速累计等待的时长
+func (l *RateLimiter) Throttled() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.throttled
+}
+
+// WaitN 取出 n 个字节的令牌，令牌不足时等待，ctx 取消时返回 ctx.Err()
+// 等待期间速率被修改时直接返回，透支的令牌由之后的请求按照新的速率补足
+func (l *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	if l == nil || n <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+	wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	changed := l.changed
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-timer.C:
+	case <-changed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	l.throttled += time.Since(start)
+	l.mu.Unlock()
+	return err
+}
+
+// 按照经过的时间补充令牌，最多补充到桶的容量
+func (l *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last)
+	l.last = now
+	if elapsed <= 0 || l.rate <= 0 {
+		return
+	}
+	l.tokens += elapsed.Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+// Reader 返回读取时经过限速的 io.Reader
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if waitErr := lr.limiter.WaitN(lr.ctx, int64(n)); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
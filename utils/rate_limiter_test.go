@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_WaitN(t *testing.T) {
+	// 不限速
+	var nilLimiter *RateLimiter
+	assert.Nil(t, nilLimiter.WaitN(context.Background(), 1024))
+	assert.Equal(t, time.Duration(0), nilLimiter.Throttled())
+	unlimited := NewRateLimiter(0)
+	assert.Nil(t, unlimited.WaitN(context.Background(), 1<<30))
+	assert.Equal(t, time.Duration(0), unlimited.Throttled())
+
+	limiter := NewRateLimiter(1024 * 1024)
+	// 桶是满的，不需要等待
+	start := time.Now()
+	assert.Nil(t, limiter.WaitN(context.Background(), 1024*1024))
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	start = time.Now()
+	assert.Nil(t, limiter.WaitN(context.Background(), 100*1024))
+	assert.True(t, time.Since(start) >= 80*time.Millisecond)
+	assert.True(t, limiter.Throttled() >= 80*time.Millisecond)
+}
+
+func TestRateLimiter_Cancel(t *testing.T) {
+	limiter := NewRateLimiter(1024)
+	assert.Nil(t, limiter.WaitN(context.Background(), 1024))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := limiter.WaitN(ctx, 10*1024)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// 修改速率唤醒正在等待的请求
+	done := make(chan error)
+	go func() {
+		done <- limiter.WaitN(context.Background(), 100*1024)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	limiter.SetRate(0)
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter is not woken up after SetRate")
+	}
+	assert.Equal(t, int64(0), limiter.Rate())
+	assert.Nil(t, limiter.WaitN(context.Background(), 1<<30))
+}
+
+func TestRateLimiter_Reader(t *testing.T) {
+	limiter := NewRateLimiter(64 * 1024)
+	src := bytes.Repeat([]byte("a"), 64*1024+16*1024)
+	start := time.Now()
+	buf, err := io.ReadAll(limiter.Reader(context.Background(), bytes.NewReader(src)))
+	assert.Nil(t, err)
+	assert.Equal(t, src, buf)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
@@ -0,0 +1,73 @@
+package db_bitcask
+
+import (
+	"bytes"
+	"context"
+)
+
+// 监听通道的缓冲大小，写满之后新的通知会被丢弃
+const watchBufferSize = 16
+
+// WatchEvent key 发生变化的通知
+type WatchEvent struct {
+	Seq  uint64
+	Type ChangeType // ChangePut 或者 ChangeDelete
+	Key  []byte
+}
+
+type watcher struct {
+	prefix []byte
+	events chan *WatchEvent
+}
+
+// Watch 监听 key 或者以 keyOrPrefix 为前缀的所有 key 的变化
+// Put、Delete 以及 WriteBatch 提交之后都会通知，ctx 结束或者数据库关闭之后通道会被关闭
+// 监听者处理不及时导致通道写满时，新的通知会被丢弃，不会阻塞写入
+func (db *DB) Watch(ctx context.Context, keyOrPrefix []byte) (<-chan *WatchEvent, error) {
+	w := &watcher{
+		prefix: copyBytes(keyOrPrefix),
+		events: make(chan *WatchEvent, watchBufferSize),
+	}
+
+	cl := db.changes
+	cl.mu.Lock()
+	if cl.closed {
+		cl.mu.Unlock()
+		return nil, ErrDatabaseClosed
+	}
+	cl.watchers[w] = struct{}{}
+	cl.mu.Unlock()
+
+	// 数据库关闭之后也需要退出，ctx 不会结束时不会一直存在
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-db.bgStop:
+		}
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		// 数据库关闭时已经关闭了通道
+		if _, ok := cl.watchers[w]; ok {
+			delete(cl.watchers, w)
+			close(w.events)
+		}
+	}()
+	return w.events, nil
+}
+
+// 通知监听者，调用方需要持有 changeLog 的锁
+func (w *watcher) notify(event *ChangeEvent) {
+	ops := []*ChangeEvent{event}
+	if event.Type == ChangeBatch {
+		ops = event.Batch
+	}
+	for _, op := range ops {
+		if !bytes.HasPrefix(op.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- &WatchEvent{Seq: event.Seq, Type: op.Type, Key: op.Key}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package db_bitcask
+
+import (
+	"context"
+	"db-bitcask/utils"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := db.Watch(ctx, []byte("user:"))
+	assert.Nil(t, err)
+
+	// 不匹配的 key 不会通知
+	err = db.Put([]byte("order:1"), []byte("a"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("user:1"), []byte("b"))
+	assert.Nil(t, err)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, []byte("user:1"), event.Key)
+		assert.Equal(t, ChangePut, event.Type)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for watch event")
+	}
+
+	// 批量写入和删除
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Delete([]byte("user:1"))
+	_ = wb.Put([]byte("order:2"), []byte("c"))
+	assert.Nil(t, wb.Commit())
+
+	select {
+	case event := <-events:
+		assert.Equal(t, []byte("user:1"), event.Key)
+		assert.Equal(t, ChangeDelete, event.Type)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for watch event")
+	}
+
+	// 监听者不消费也不会阻塞写入
+	for i := 0; i < 1000; i++ {
+		err := db.Put([]byte("user:"+string(utils.GetTestKey(i))), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	// 取消之后通道被关闭
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("watch channel is not closed")
+		}
+	}
+}
+
+func TestDB_Watch_Close(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "db-bitcask-watch-close")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	goroutines := runtime.NumGoroutine()
+	events, err := db.Watch(context.Background(), []byte("user:"))
+	assert.Nil(t, err)
+
+	// 数据库关闭之后通道被关闭，监听的 goroutine 退出
+	assert.Nil(t, db.Close())
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch channel is not closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines)
+}